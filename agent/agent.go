@@ -3,22 +3,53 @@ package agent
 import (
 	"context"
 	"errors"
+	"fmt"
 	"log/slog"
+	"maps"
+	"sync"
 	"time"
 
+	"github.com/google/uuid"
+	"github.com/jacobweinstock/tink-agent/pkg/backoff"
+	"github.com/jacobweinstock/tink-agent/pkg/output"
 	"github.com/jacobweinstock/tink-agent/spec"
 )
 
-// TransportReader provides a method to read an action
+var (
+	// errWorkflowCancelled is the cause used to cancel a running workflow when it is stopped by the transport.
+	errWorkflowCancelled = errors.New("workflow cancelled")
+	// errWorkflowTimeout is the cause used to cancel a running workflow when it exceeds its global timeout.
+	errWorkflowTimeout = errors.New("workflow global timeout exceeded")
+)
+
+// DefaultCancellationExpiry is the CancellationExpiry used when none is set.
+const DefaultCancellationExpiry = 10 * time.Minute
+
+// Unreported events are written again after these delays, doubling up to the limit, until the transport
+// accepts them. Transports that connect in the background fail writes until they have connected.
+const (
+	reconcileRetryInterval    = 500 * time.Millisecond
+	maxReconcileRetryInterval = 30 * time.Second
+)
+
+// TransportReader provides a method to read a workflow
 type TransportReader interface {
-	// Read blocks until an action is available or an error occurs
-	Read(ctx context.Context) (spec.Action, error)
+	// Read blocks until a workflow is available or an error occurs
+	Read(ctx context.Context) (spec.Workflow, error)
+}
+
+// TransportCanceler is an optional interface a TransportReader can implement
+// to request that a workflow be stopped.
+type TransportCanceler interface {
+	// Cancelled returns a channel that receives the ID of each workflow that should be stopped.
+	Cancelled() <-chan string
 }
 
 // RuntimeExecutor provides a method to execute an action
 type RuntimeExecutor interface {
-	// Execute blocks until the action is completed or an error occurs
-	Execute(ctx context.Context, action spec.Action) error
+	// Execute blocks until the action is completed or an error occurs.
+	// The result is returned even when an error occurs, with as much detail as is known.
+	Execute(ctx context.Context, action spec.Action) (spec.Result, error)
 }
 
 // TransportWriter provides a method to write an event
@@ -27,19 +58,66 @@ type TransportWriter interface {
 	Write(ctx context.Context, event spec.Event) error
 }
 
+// LogWriter is an optional interface a TransportWriter can implement to receive the output of actions
+type LogWriter interface {
+	// WriteLog blocks until the line is written or an error occurs
+	WriteLog(ctx context.Context, line spec.LogLine) error
+}
+
+// StateStore provides methods to persist the progress of workflows
+type StateStore interface {
+	// Get returns the saved state of a workflow. A workflow without saved state returns the zero value.
+	Get(ctx context.Context, workflowID string) (spec.WorkflowState, error)
+	// Put saves the state of a workflow, replacing any previously saved state.
+	Put(ctx context.Context, state spec.WorkflowState) error
+	// Delete removes the saved state of a workflow.
+	Delete(ctx context.Context, workflowID string) error
+	// List returns the saved state of all workflows.
+	List(ctx context.Context) ([]spec.WorkflowState, error)
+}
+
 type Config struct {
 	TransportReader TransportReader
 	RuntimeExecutor RuntimeExecutor
 	TransportWriter TransportWriter
+	// StateStore is optional. When set, workflow progress is persisted so that completed actions
+	// are not run again after the agent restarts.
+	StateStore StateStore
+	// DefaultGlobalTimeout bounds the run time of workflows that do not define a global timeout.
+	// A zero value means those workflows are not bounded.
+	DefaultGlobalTimeout time.Duration
+	// CancellationExpiry is how long the ID of a workflow that was cancelled before it was read is kept, so the
+	// workflow is discarded if it is read. Defaults to DefaultCancellationExpiry.
+	CancellationExpiry time.Duration
+
+	mu sync.Mutex
+	// cancelled holds when workflows were stopped before the agent started running them, by workflow ID.
+	// Workflows that are never read are forgotten once they are older than CancellationExpiry.
+	cancelled map[string]time.Time
+	// running is the ID of the workflow currently being run.
+	running string
+	// cancelRunning cancels the workflow currently being run.
+	cancelRunning context.CancelCauseFunc
 }
 
 func (c *Config) Run(ctx context.Context, log *slog.Logger) {
 	// All steps are synchronous and blocking
-	// 1. get an action from the input transport
-	// 3. send running/starting event to the output transport
-	// 4. send the action to the runtime for execution
-	// 5. send the result event to the output transport
-	// 6. go to step 1
+	// 0. report any events that were not written before the agent last stopped
+	// 1. get a workflow from the input transport
+	// 2. send the workflow running event to the output transport
+	// 3. for each action, in order:
+	//    a. skip the action if it completed before the agent last stopped
+	//    b. send the action running event to the output transport
+	//    c. send the action to the runtime for execution
+	//    d. send the action result event to the output transport
+	//    e. stop running actions if the action did not succeed
+	// 4. send the workflow result event to the output transport
+	// 5. go to step 1
+
+	if tc, ok := c.TransportReader.(TransportCanceler); ok {
+		go c.watchCancellations(ctx, log, tc.Cancelled())
+	}
+	c.reconcile(ctx, log)
 
 	for {
 		select {
@@ -48,61 +126,394 @@ func (c *Config) Run(ctx context.Context, log *slog.Logger) {
 		default:
 		}
 
-		action, err := c.TransportReader.Read(ctx)
+		wf, err := c.TransportReader.Read(ctx)
 		if err != nil {
 			if errors.Is(err, context.Canceled) {
 				return
 			}
-			log.Info("error reading/retrieving action", "error", err)
+			log.Info("error reading/retrieving workflow", "error", err)
 			continue
 		}
 
-		log.Info("received action", "action", action)
-		if err := c.TransportWriter.Write(ctx, spec.Event{Action: action, Message: "running action", State: spec.StateRunning}); err != nil {
-			if errors.Is(err, context.Canceled) {
-				return
-			}
-			log.Info("error writing event", "error", err)
+		c.runWorkflow(ctx, log, wf)
+	}
+}
+
+// runWorkflow runs the actions of wf in order, stopping at the first action that does not succeed.
+func (c *Config) runWorkflow(ctx context.Context, log *slog.Logger, wf spec.Workflow) {
+	log = log.With("workflowID", wf.ID)
+	wctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	if !c.setRunning(wf.ID, cancel) {
+		log.Info("discarding cancelled workflow")
+		return
+	}
+	defer c.clearRunning()
+
+	st := c.loadState(ctx, log, wf.ID)
+	completed := map[string]bool{}
+	for _, id := range st.CompletedActions {
+		completed[id] = true
+	}
+
+	log.Info("received workflow", "actions", len(wf.Actions), "completedActions", len(completed))
+	message := "running workflow"
+	if len(completed) > 0 {
+		message = "resuming workflow"
+	}
+	// The final event is always written, even when the workflow never got going, so that the
+	// transport knows the workflow is over and can hand out the next one.
+	state := spec.StateFailure
+	defer func() {
+		if err := c.record(ctx, log, st, spec.Event{Type: spec.EventTypeWorkflow, WorkflowID: wf.ID, Message: message, State: state}); err == nil {
+			c.deleteState(ctx, log, wf.ID)
+		}
+	}()
+	if err := c.record(ctx, log, st, spec.Event{Type: spec.EventTypeWorkflow, WorkflowID: wf.ID, Message: message, State: spec.StateRunning}); err != nil {
+		message = fmt.Sprintf("unable to report workflow running: %v", err)
+		return
+	}
+
+	// The global timeout bounds all actions, including their retries.
+	timeout := c.DefaultGlobalTimeout
+	if wf.GlobalTimeoutSeconds > 0 {
+		timeout = time.Duration(wf.GlobalTimeoutSeconds) * time.Second
+	}
+	if timeout > 0 {
+		var timeoutDone context.CancelFunc
+		wctx, timeoutDone = context.WithTimeoutCause(wctx, timeout, errWorkflowTimeout)
+		defer timeoutDone()
+	}
+
+	state = spec.StateSuccess
+	message = "workflow completed"
+	for i, action := range wf.Actions {
+		action.WorkflowID = wf.ID
+		if action.ID != "" && completed[action.ID] {
+			log.Info("skipping action completed before restart", "actionIndex", i, "action", action.Name)
 			continue
 		}
-		log.Info("reported action status", "action", action, "state", spec.StateRunning)
+		if s := c.runAction(wctx, log.With("actionIndex", i), st, action); s != spec.StateSuccess {
+			state = s
+			message = "workflow did not complete, action " + action.Name + " " + string(s)
+			if errors.Is(context.Cause(wctx), errWorkflowTimeout) {
+				message = fmt.Sprintf("workflow global timeout of %v exceeded at action %v", timeout, action.Name)
+			}
+			if skipped := len(wf.Actions) - i - 1; skipped > 0 {
+				log.Info("not running remaining actions", "remaining", skipped)
+			}
+			break
+		}
+	}
+}
+
+// runAction executes action, retrying on failure, and returns its final state.
+func (c *Config) runAction(ctx context.Context, log *slog.Logger, st *spec.WorkflowState, action spec.Action) spec.State {
+	if s, ok := stopped(ctx); ok {
+		return s
+	}
+
+	rendered, err := withOutputs(action, st.Outputs)
+	if err != nil {
+		log.Info("error applying outputs of previous actions", "error", err)
+		_ = c.record(ctx, log, st, spec.Event{Type: spec.EventTypeAction, WorkflowID: action.WorkflowID, Action: action, Message: err.Error(), State: spec.StateFailure, Result: spec.Result{ExitCode: -1, Reason: "InvalidTemplate", Message: err.Error()}})
+		return spec.StateFailure
+	}
+	action = rendered
+
+	log.Info("received action", "action", action)
+	if err := c.record(ctx, log, st, spec.Event{Type: spec.EventTypeAction, WorkflowID: action.WorkflowID, Action: action, Message: "running action", State: spec.StateRunning}); err != nil {
+		if s, ok := stopped(ctx); ok {
+			return s
+		}
+		return spec.StateFailure
+	}
+
+	state := spec.StateSuccess
+	message := "action completed"
+	var result spec.Result
+	policy := retryPolicy(action)
+	timeout := time.Duration(action.TimeoutSeconds) * time.Second
+
+	// Action output is logged and, if the transport supports it, written to the transport.
+	lw, _ := c.TransportWriter.(LogWriter)
+	execCtx := output.WithSink(ctx, func(l spec.LogLine) {
+		log.Debug("action output", "stream", l.Stream, "text", l.Text)
+		if lw == nil {
+			return
+		}
+		if err := lw.WriteLog(ctx, l); err != nil {
+			log.Debug("error writing action output", "error", err)
+		}
+	})
+
+	// Actions without a timeout are only bounded by the workflow.
+	totalCtx, totalDone := execCtx, context.CancelFunc(func() {})
+	if timeout > 0 && policy.TimeoutScope == spec.TimeoutScopeTotal {
+		totalCtx, totalDone = context.WithTimeout(execCtx, timeout)
+	}
+	defer totalDone()
+	for attempt := 1; ; attempt++ {
+		attemptCtx, attemptDone := totalCtx, context.CancelFunc(func() {})
+		if timeout > 0 && policy.TimeoutScope == spec.TimeoutScopeAttempt {
+			attemptCtx, attemptDone = context.WithTimeout(totalCtx, timeout)
+		}
+		res, err := c.execute(attemptCtx, action)
+		attemptDone()
+		result = res
+		if err == nil {
+			state = spec.StateSuccess
+			message = "action completed"
+			log.Info("executed action", "action", action, "attempt", attempt)
+			break
+		}
+
+		class := spec.Classify(err)
+		log.Info("error executing action", "error", err, "failureClass", class, "exitCode", res.ExitCode, "maxAttempts", policy.MaxAttempts, "attempt", attempt)
+		if result.Reason == "" {
+			result.Reason = class.Reason()
+		}
+		if result.Message == "" {
+			result.Message = err.Error()
+		}
+		if s, ok := stopped(ctx); ok {
+			state = s
+			message = "action " + string(s) + ": " + context.Cause(ctx).Error()
+			result.Reason, result.Message = stoppedReason(s), message
+			break
+		}
+		state = spec.StateFailure
+		message = err.Error()
+		if class == spec.FailureClassTimeout {
+			state = spec.StateTimeout
+		}
+		if attempt >= policy.MaxAttempts || !retryable(policy, class) || totalCtx.Err() != nil {
+			break
+		}
+
+		delay := retryDelay(policy, attempt)
+		msg := fmt.Sprintf("attempt %v of %v failed, retrying in %v: %v", attempt, policy.MaxAttempts, delay, err)
+		_ = c.record(ctx, log, st, spec.Event{Type: spec.EventTypeAction, WorkflowID: action.WorkflowID, Action: action, Message: msg, State: spec.StateRetrying, Result: result})
+		if !backoff.Wait(totalCtx, delay) {
+			if s, ok := stopped(ctx); ok {
+				state = s
+				message = "action " + string(s) + ": " + context.Cause(ctx).Error()
+				result.Reason, result.Message = stoppedReason(s), message
+				break
+			}
+			state = spec.StateTimeout
+			message = "action timeout exceeded before retry: " + message
+			result.Reason, result.Message = spec.FailureClassTimeout.Reason(), message
+			break
+		}
+	}
 
-		state := spec.StateSuccess
-		retries := action.Retries
-		if retries == 0 {
-			retries = 1
+	// Hooks are not run when the workflow was stopped, there is no time left to run them.
+	if _, ok := stopped(ctx); !ok {
+		c.runHook(execCtx, log, action, state)
+	}
+
+	if state == spec.StateSuccess {
+		if action.ID != "" {
+			st.CompletedActions = append(st.CompletedActions, action.ID)
 		}
-		dur := time.Duration(action.TimeoutSeconds) * time.Second
+		if len(result.Outputs) > 0 {
+			if st.Outputs == nil {
+				st.Outputs = map[string]string{}
+			}
+			maps.Copy(st.Outputs, result.Outputs)
+		}
+	}
+	// The action result is always reported, even when the workflow was cancelled.
+	_ = c.record(context.WithoutCancel(ctx), log, st, spec.Event{Type: spec.EventTypeAction, WorkflowID: action.WorkflowID, Action: action, Message: message, State: state, Result: result})
+
+	return state
+}
+
+// execute runs action with the runtime executor. A panic in the executor is returned as an error
+// so that it fails the action instead of stopping the agent.
+func (c *Config) execute(ctx context.Context, action spec.Action) (res spec.Result, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			res, err = spec.Result{ExitCode: -1}, fmt.Errorf("runtime executor panicked: %v", r)
+		}
+	}()
+
+	return c.RuntimeExecutor.Execute(ctx, action)
+}
+
+// stopped reports whether the workflow ctx belongs to was stopped before it completed,
+// along with the state its actions should be given.
+func stopped(ctx context.Context) (spec.State, bool) {
+	switch cause := context.Cause(ctx); {
+	case errors.Is(cause, errWorkflowCancelled):
+		return spec.StateCancelled, true
+	case errors.Is(cause, errWorkflowTimeout):
+		return spec.StateTimeout, true
+	}
+
+	return "", false
+}
 
-		timeoutCtx, timeoutDone := context.WithTimeout(ctx, dur)
-		for i := 1; i <= retries; i++ {
-			if err := c.RuntimeExecutor.Execute(timeoutCtx, action); err != nil {
-				log.Info("error executing action", "error", err, "maxRetries", retries, "currentRetry", i)
-				state = spec.StateFailure
-				if errors.Is(err, context.DeadlineExceeded) {
-					state = spec.StateTimeout
-					timeoutDone()
-					break
+// record writes event to the transport. When a state store is configured the event is saved
+// before it is written so that it can still be reported if the agent stops before writing it.
+func (c *Config) record(ctx context.Context, log *slog.Logger, st *spec.WorkflowState, event spec.Event) error {
+	// The ID is saved along with the event, so it is the same when the event is reported again after a restart.
+	if event.ID == "" {
+		event.ID = uuid.NewString()
+	}
+	st.LastEvent = event
+	st.Reported = false
+	c.saveState(ctx, log, st)
+	if err := c.write(ctx, log, event); err != nil {
+		return err
+	}
+	st.Reported = true
+	c.saveState(ctx, log, st)
+
+	return nil
+}
+
+// reconcile writes the last event of any saved workflow that was not reported before the agent stopped,
+// retrying each until the transport accepts it or ctx is done.
+func (c *Config) reconcile(ctx context.Context, log *slog.Logger) {
+	if c.StateStore == nil {
+		return
+	}
+	states, err := c.StateStore.List(ctx)
+	if err != nil {
+		log.Info("error listing saved workflow state", "error", err)
+		return
+	}
+	for _, st := range states {
+		log := log.With("workflowID", st.WorkflowID)
+		if !st.Reported && st.LastEvent.State != "" {
+			log.Info("reporting event not written before restart", "type", st.LastEvent.Type, "state", st.LastEvent.State)
+			for failures := 1; c.write(ctx, log, st.LastEvent) != nil; failures++ {
+				if !backoff.Wait(ctx, backoff.Exponential(reconcileRetryInterval, maxReconcileRetryInterval, failures)) {
+					return
 				}
-				if i == retries {
-					timeoutDone()
-					break
+			}
+			st.Reported = true
+			c.saveState(ctx, log, &st)
+		}
+		// Completed workflows are only kept until their final event is reported.
+		if st.LastEvent.Type == spec.EventTypeWorkflow && st.LastEvent.State.IsFinal() {
+			c.deleteState(ctx, log, st.WorkflowID)
+		}
+	}
+}
+
+func (c *Config) loadState(ctx context.Context, log *slog.Logger, workflowID string) *spec.WorkflowState {
+	st := &spec.WorkflowState{WorkflowID: workflowID}
+	if c.StateStore == nil {
+		return st
+	}
+	saved, err := c.StateStore.Get(ctx, workflowID)
+	if err != nil {
+		log.Info("error getting saved workflow state, running all actions", "error", err)
+		return st
+	}
+	st.CompletedActions = saved.CompletedActions
+	st.Outputs = saved.Outputs
+
+	return st
+}
+
+func (c *Config) saveState(ctx context.Context, log *slog.Logger, st *spec.WorkflowState) {
+	if c.StateStore == nil {
+		return
+	}
+	if err := c.StateStore.Put(ctx, *st); err != nil {
+		log.Info("error saving workflow state", "error", err)
+	}
+}
+
+func (c *Config) deleteState(ctx context.Context, log *slog.Logger, workflowID string) {
+	if c.StateStore == nil {
+		return
+	}
+	if err := c.StateStore.Delete(ctx, workflowID); err != nil {
+		log.Info("error deleting workflow state", "error", err)
+	}
+}
+
+// stoppedReason returns the failure reason for an action given state s because its workflow was stopped.
+func stoppedReason(s spec.State) string {
+	if s == spec.StateCancelled {
+		return "Cancelled"
+	}
+	return spec.FailureClassTimeout.Reason()
+}
+
+// write sends event to the transport writer, logging the outcome.
+func (c *Config) write(ctx context.Context, log *slog.Logger, event spec.Event) error {
+	if err := c.TransportWriter.Write(ctx, event); err != nil {
+		log.Info("error writing event", "error", err, "type", event.Type, "state", event.State)
+		return err
+	}
+	log.Info("reported status", "type", event.Type, "action", event.Action.Name, "state", event.State)
+
+	return nil
+}
+
+// watchCancellations cancels the running workflow when its ID is received on ch.
+// IDs of workflows that are not running are recorded so they are discarded when read.
+func (c *Config) watchCancellations(ctx context.Context, log *slog.Logger, ch <-chan string) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case id := <-ch:
+			log.Info("received workflow cancellation", "workflowID", id)
+			c.mu.Lock()
+			if c.cancelRunning != nil && c.running == id {
+				c.cancelRunning(errWorkflowCancelled)
+			} else {
+				if c.cancelled == nil {
+					c.cancelled = map[string]time.Time{}
 				}
-				timeoutDone()
-				continue
+				c.pruneCancelled()
+				c.cancelled[id] = time.Now()
 			}
-			state = spec.StateSuccess
-			log.Info("executed action", "action", action)
-			timeoutDone()
-			break
+			c.mu.Unlock()
 		}
-		timeoutDone()
+	}
+}
 
-		if err := c.TransportWriter.Write(ctx, spec.Event{Action: action, Message: "action completed", State: state}); err != nil {
-			log.Info("error writing event", "error", err)
-			continue
+// setRunning records workflowID as running. It returns false if the workflow has
+// been cancelled, in which case it should be discarded.
+func (c *Config) setRunning(workflowID string, cancel context.CancelCauseFunc) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if at, ok := c.cancelled[workflowID]; ok {
+		delete(c.cancelled, workflowID)
+		if time.Since(at) < c.cancellationExpiry() {
+			return false
 		}
-		log.Info("reported action status", "action", action, "state", state)
+	}
+	c.running = workflowID
+	c.cancelRunning = cancel
+
+	return true
+}
 
+// pruneCancelled forgets the cancelled workflows that are older than CancellationExpiry. c.mu must be held.
+func (c *Config) pruneCancelled() {
+	expiry := c.cancellationExpiry()
+	maps.DeleteFunc(c.cancelled, func(_ string, at time.Time) bool { return time.Since(at) >= expiry })
+}
+
+func (c *Config) cancellationExpiry() time.Duration {
+	if c.CancellationExpiry <= 0 {
+		return DefaultCancellationExpiry
 	}
+	return c.CancellationExpiry
+}
+
+func (c *Config) clearRunning() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.running = ""
+	c.cancelRunning = nil
 }
@@ -0,0 +1,469 @@
+package agent_test
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/jacobweinstock/tink-agent/agent"
+	"github.com/jacobweinstock/tink-agent/runtime/fake"
+	"github.com/jacobweinstock/tink-agent/spec"
+	statefile "github.com/jacobweinstock/tink-agent/state/file"
+	"github.com/jacobweinstock/tink-agent/transport/memory"
+)
+
+// start runs c until the test ends.
+func start(t *testing.T, c *agent.Config) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.Run(ctx, slog.New(slog.NewTextHandler(testWriter{t}, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+type testWriter struct{ t *testing.T }
+
+func (w testWriter) Write(p []byte) (int, error) {
+	w.t.Log(string(p))
+	return len(p), nil
+}
+
+// runWorkflow submits wf and waits for its final workflow event.
+func runWorkflow(t *testing.T, tr *memory.Config, wf spec.Workflow) []spec.Event {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := tr.Submit(ctx, wf); err != nil {
+		t.Fatalf("submitting workflow: %v", err)
+	}
+	events, err := tr.Wait(ctx, finished(wf.ID))
+	if err != nil {
+		t.Fatalf("waiting for workflow %v to finish: %v, events: %v", wf.ID, err, summarize(events))
+	}
+
+	return events
+}
+
+// finished returns whether the final workflow event for id has been written.
+func finished(id string) func([]spec.Event) bool {
+	return func(events []spec.Event) bool {
+		return slices.ContainsFunc(events, func(e spec.Event) bool {
+			return e.Type == spec.EventTypeWorkflow && e.WorkflowID == id && e.State.IsFinal()
+		})
+	}
+}
+
+// summarize returns the type, action ID, and state of events, for example "action a1 success".
+func summarize(events []spec.Event) []string {
+	out := make([]string, 0, len(events))
+	for _, e := range events {
+		if e.Type == spec.EventTypeWorkflow {
+			out = append(out, "workflow "+string(e.State))
+			continue
+		}
+		out = append(out, "action "+e.Action.ID+" "+string(e.State))
+	}
+
+	return out
+}
+
+func actions(ids ...string) []spec.Action {
+	out := make([]spec.Action, 0, len(ids))
+	for _, id := range ids {
+		out = append(out, spec.Action{ID: id, Name: "action-" + id, Image: "image"})
+	}
+
+	return out
+}
+
+func TestRun(t *testing.T) {
+	tests := map[string]struct {
+		workflow spec.Workflow
+		outcomes map[string][]fake.Outcome
+		want     []string
+	}{
+		"success": {
+			workflow: spec.Workflow{ID: "wf", Actions: actions("a1", "a2")},
+			want: []string{
+				"workflow running",
+				"action a1 running", "action a1 success",
+				"action a2 running", "action a2 success",
+				"workflow success",
+			},
+		},
+		"failure stops the workflow": {
+			workflow: spec.Workflow{ID: "wf", Actions: actions("a1", "a2", "a3")},
+			outcomes: map[string][]fake.Outcome{"a2": {{ExitCode: 1}}},
+			want: []string{
+				"workflow running",
+				"action a1 running", "action a1 success",
+				"action a2 running", "action a2 failure",
+				"workflow failure",
+			},
+		},
+		"runtime error": {
+			workflow: spec.Workflow{ID: "wf", Actions: actions("a1")},
+			outcomes: map[string][]fake.Outcome{"a1": {{Err: errors.New("boom")}}},
+			want:     []string{"workflow running", "action a1 running", "action a1 failure", "workflow failure"},
+		},
+		"panic": {
+			workflow: spec.Workflow{ID: "wf", Actions: actions("a1", "a2")},
+			outcomes: map[string][]fake.Outcome{"a1": {{Panic: "boom"}}},
+			want:     []string{"workflow running", "action a1 running", "action a1 failure", "workflow failure"},
+		},
+		"retries without a policy": {
+			workflow: spec.Workflow{ID: "wf", Actions: []spec.Action{{ID: "a1", Retries: 3}}},
+			outcomes: map[string][]fake.Outcome{"a1": {{ExitCode: 1}, {ExitCode: 1}, {}}},
+			want: []string{
+				"workflow running",
+				"action a1 running", "action a1 retrying", "action a1 retrying", "action a1 success",
+				"workflow success",
+			},
+		},
+		"retries exhausted": {
+			workflow: spec.Workflow{ID: "wf", Actions: []spec.Action{{ID: "a1", RetryPolicy: &spec.RetryPolicy{MaxAttempts: 2, InitialDelaySeconds: 0.01}}}},
+			outcomes: map[string][]fake.Outcome{"a1": {{ExitCode: 1}}},
+			want: []string{
+				"workflow running",
+				"action a1 running", "action a1 retrying", "action a1 failure",
+				"workflow failure",
+			},
+		},
+		"failure class not retried": {
+			workflow: spec.Workflow{ID: "wf", Actions: []spec.Action{{ID: "a1", RetryPolicy: &spec.RetryPolicy{MaxAttempts: 3, RetryOn: []spec.FailureClass{spec.FailureClassImagePull}}}}},
+			outcomes: map[string][]fake.Outcome{"a1": {{ExitCode: 1}}},
+			want:     []string{"workflow running", "action a1 running", "action a1 failure", "workflow failure"},
+		},
+		"action timeout": {
+			workflow: spec.Workflow{ID: "wf", Actions: []spec.Action{{ID: "a1", TimeoutSeconds: 1}, {ID: "a2"}}},
+			outcomes: map[string][]fake.Outcome{"a1": {{Block: true}}},
+			want:     []string{"workflow running", "action a1 running", "action a1 timeout", "workflow timeout"},
+		},
+		"attempt timeout is retried": {
+			workflow: spec.Workflow{ID: "wf", Actions: []spec.Action{{ID: "a1", TimeoutSeconds: 1, RetryPolicy: &spec.RetryPolicy{MaxAttempts: 2, TimeoutScope: spec.TimeoutScopeAttempt}}}},
+			outcomes: map[string][]fake.Outcome{"a1": {{Block: true}, {}}},
+			want: []string{
+				"workflow running",
+				"action a1 running", "action a1 retrying", "action a1 success",
+				"workflow success",
+			},
+		},
+		"global timeout": {
+			workflow: spec.Workflow{ID: "wf", GlobalTimeoutSeconds: 1, Actions: actions("a1", "a2")},
+			outcomes: map[string][]fake.Outcome{"a2": {{Block: true}}},
+			want: []string{
+				"workflow running",
+				"action a1 running", "action a1 success",
+				"action a2 running", "action a2 timeout",
+				"workflow timeout",
+			},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			tr := memory.New()
+			start(t, &agent.Config{TransportReader: tr, TransportWriter: tr, RuntimeExecutor: &fake.Config{Outcomes: tt.outcomes}})
+
+			got := summarize(runWorkflow(t, tr, tt.workflow))
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("unexpected events (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRunEventDetails(t *testing.T) {
+	tr := memory.New()
+	re := &fake.Config{Outcomes: map[string][]fake.Outcome{
+		"a1": {{Output: []string{"hello", "world"}}},
+		"a2": {{ExitCode: 3, Reason: "DiskNotFound", Message: "no disk at /dev/sda"}},
+	}}
+	start(t, &agent.Config{TransportReader: tr, TransportWriter: tr, RuntimeExecutor: re})
+
+	events := runWorkflow(t, tr, spec.Workflow{ID: "wf", Actions: actions("a1", "a2")})
+	ids := map[string]bool{}
+	for _, e := range events {
+		if e.ID == "" || ids[e.ID] {
+			t.Errorf("event %v has ID %q, want a unique one", e, e.ID)
+		}
+		ids[e.ID] = true
+		if e.WorkflowID != "wf" {
+			t.Errorf("event %v has workflow ID %q, want %q", e, e.WorkflowID, "wf")
+		}
+		if e.Type == spec.EventTypeAction && e.Action.WorkflowID != "wf" {
+			t.Errorf("action %v has workflow ID %q, want %q", e.Action.ID, e.Action.WorkflowID, "wf")
+		}
+	}
+
+	success := events[2]
+	if got := len(success.Result.Output); got != 2 {
+		t.Errorf("got %d lines of output, want 2", got)
+	}
+	if success.Result.ExitCode != 0 || success.Result.Duration() < 0 {
+		t.Errorf("unexpected success result: %+v", success.Result)
+	}
+	var logs []string
+	for _, l := range tr.Logs() {
+		logs = append(logs, l.ActionID+": "+l.Text)
+	}
+	if diff := cmp.Diff([]string{"a1: hello", "a1: world"}, logs); diff != "" {
+		t.Errorf("unexpected logs (-want +got):\n%s", diff)
+	}
+
+	failure := events[4]
+	want := spec.Result{ExitCode: 3, Reason: "DiskNotFound", Message: "no disk at /dev/sda"}
+	got := spec.Result{ExitCode: failure.Result.ExitCode, Reason: failure.Result.Reason, Message: failure.Result.Message}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected failure result (-want +got):\n%s", diff)
+	}
+}
+
+func TestRunCancel(t *testing.T) {
+	tr := memory.New()
+	start(t, &agent.Config{TransportReader: tr, TransportWriter: tr, RuntimeExecutor: &fake.Config{Outcomes: map[string][]fake.Outcome{"a1": {{Block: true}}}}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := tr.Submit(ctx, spec.Workflow{ID: "wf", Actions: actions("a1", "a2")}); err != nil {
+		t.Fatal(err)
+	}
+	running := func(events []spec.Event) bool {
+		return slices.ContainsFunc(events, func(e spec.Event) bool { return e.Action.ID == "a1" && e.State == spec.StateRunning })
+	}
+	if _, err := tr.Wait(ctx, running); err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Stop(ctx, "wf"); err != nil {
+		t.Fatal(err)
+	}
+	events, err := tr.Wait(ctx, finished("wf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"workflow running", "action a1 running", "action a1 cancelled", "workflow cancelled"}
+	if diff := cmp.Diff(want, summarize(events)); diff != "" {
+		t.Errorf("unexpected events (-want +got):\n%s", diff)
+	}
+	if got := events[2].Result.Reason; got != "Cancelled" {
+		t.Errorf("got reason %q, want %q", got, "Cancelled")
+	}
+}
+
+func TestRunCancelBeforeRead(t *testing.T) {
+	tr := memory.New()
+	re := &fake.Config{}
+	start(t, &agent.Config{TransportReader: tr, TransportWriter: tr, RuntimeExecutor: re})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := tr.Stop(ctx, "cancelled"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Submit(ctx, spec.Workflow{ID: "cancelled", Actions: actions("a1")}); err != nil {
+		t.Fatal(err)
+	}
+	runWorkflow(t, tr, spec.Workflow{ID: "wf", Actions: actions("a2")})
+
+	for _, a := range re.Calls() {
+		if a.WorkflowID == "cancelled" {
+			t.Errorf("action %v of a cancelled workflow was run", a.ID)
+		}
+	}
+}
+
+// TestRunCancelExpired tests that a workflow cancelled before it was read is run when it is read after the
+// cancellation expired.
+func TestRunCancelExpired(t *testing.T) {
+	tr := memory.New()
+	re := &fake.Config{}
+	start(t, &agent.Config{TransportReader: tr, TransportWriter: tr, RuntimeExecutor: re, CancellationExpiry: 50 * time.Millisecond})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := tr.Stop(ctx, "wf"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	runWorkflow(t, tr, spec.Workflow{ID: "wf", Actions: actions("a1")})
+
+	if calls := re.Calls(); len(calls) != 1 || calls[0].ID != "a1" {
+		t.Errorf("got calls %v, want a1 run", calls)
+	}
+}
+
+func TestRunOutputs(t *testing.T) {
+	tr := memory.New()
+	re := &fake.Config{Outcomes: map[string][]fake.Outcome{
+		"a1": {{Outputs: map[string]string{"DEVICE": "/dev/sda1", "uuid": "1234"}}},
+	}}
+	start(t, &agent.Config{TransportReader: tr, TransportWriter: tr, RuntimeExecutor: re})
+
+	a2 := spec.Action{ID: "a2", Args: []string{"--uuid={{ .Outputs.uuid }}"}}
+	runWorkflow(t, tr, spec.Workflow{ID: "wf", Actions: []spec.Action{{ID: "a1"}, a2}})
+
+	calls := re.Calls()
+	if len(calls) != 2 {
+		t.Fatalf("got %d calls, want 2", len(calls))
+	}
+	got := calls[1]
+	if diff := cmp.Diff([]string{"--uuid=1234"}, got.Args); diff != "" {
+		t.Errorf("unexpected args (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]spec.Env{{Key: "DEVICE", Value: "/dev/sda1"}, {Key: "uuid", Value: "1234"}}, got.Env); diff != "" {
+		t.Errorf("unexpected env (-want +got):\n%s", diff)
+	}
+}
+
+func TestRunHooks(t *testing.T) {
+	tr := memory.New()
+	re := &fake.Config{Outcomes: map[string][]fake.Outcome{
+		"failure": {{ExitCode: 1}},
+		"timeout": {{Block: true}},
+	}}
+	start(t, &agent.Config{TransportReader: tr, TransportWriter: tr, RuntimeExecutor: re})
+
+	hooks := func(a spec.Action) spec.Action {
+		a.Image = "image"
+		a.OnFailure = []string{"/bin/on-failure", "-v"}
+		a.OnTimeout = []string{"/bin/on-timeout"}
+		return a
+	}
+	runWorkflow(t, tr, spec.Workflow{ID: "wf1", Actions: []spec.Action{hooks(spec.Action{ID: "success", Name: "s"}), hooks(spec.Action{ID: "failure", Name: "f"})}})
+	runWorkflow(t, tr, spec.Workflow{ID: "wf2", Actions: []spec.Action{hooks(spec.Action{ID: "timeout", Name: "t", TimeoutSeconds: 1})}})
+
+	var got []string
+	for _, c := range re.Calls() {
+		got = append(got, strings.Join(append([]string{c.ID, c.Name, c.Image, c.Cmd}, c.Args...), " "))
+	}
+	want := []string{
+		"success s image ",
+		"failure f image ",
+		"failure-on-failure f-on-failure image /bin/on-failure -v",
+		"timeout t image ",
+		"timeout-on-timeout t-on-timeout image /bin/on-timeout",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected calls (-want +got):\n%s", diff)
+	}
+}
+
+func TestRunResume(t *testing.T) {
+	// The saved state of an agent that stopped after a1 completed, before the event was written.
+	store := &statefile.Config{Dir: t.TempDir()}
+	a1 := spec.Action{ID: "a1", WorkflowID: "wf"}
+	saved := spec.WorkflowState{
+		WorkflowID:       "wf",
+		CompletedActions: []string{"a1"},
+		Outputs:          map[string]string{"key": "value"},
+		LastEvent:        spec.Event{ID: "saved", Type: spec.EventTypeAction, WorkflowID: "wf", Action: a1, State: spec.StateSuccess},
+	}
+	if err := store.Put(context.Background(), saved); err != nil {
+		t.Fatal(err)
+	}
+
+	tr := memory.New()
+	re := &fake.Config{}
+	start(t, &agent.Config{TransportReader: tr, TransportWriter: tr, RuntimeExecutor: re, StateStore: store})
+	events := runWorkflow(t, tr, spec.Workflow{ID: "wf", Actions: []spec.Action{{ID: "a1"}, {ID: "a2", Args: []string{"{{ .Outputs.key }}"}}}})
+
+	want := []string{"action a1 success", "workflow running", "action a2 running", "action a2 success", "workflow success"}
+	if diff := cmp.Diff(want, summarize(events)); diff != "" {
+		t.Errorf("unexpected events (-want +got):\n%s", diff)
+	}
+	if events[0].ID != "saved" {
+		t.Errorf("event reported after the restart has ID %q, want the saved one", events[0].ID)
+	}
+	calls := re.Calls()
+	if len(calls) != 1 {
+		t.Fatalf("got %d calls, want 1", len(calls))
+	}
+	if diff := cmp.Diff([]string{"value"}, calls[0].Args); diff != "" {
+		t.Errorf("unexpected args (-want +got):\n%s", diff)
+	}
+	states, err := store.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(states) != 0 {
+		t.Errorf("got %d saved states after the workflow completed, want 0", len(states))
+	}
+}
+
+// TestRunReportRunningFails tests that a workflow whose running event cannot be written is not run
+// but still gets a final event, so the transport knows it is over.
+func TestRunReportRunningFails(t *testing.T) {
+	tr := memory.New()
+	tr.WriteErr = func(e spec.Event) error {
+		if e.Type == spec.EventTypeWorkflow && e.State == spec.StateRunning {
+			return errors.New("write failed")
+		}
+		return nil
+	}
+	re := &fake.Config{}
+	start(t, &agent.Config{TransportReader: tr, TransportWriter: tr, RuntimeExecutor: re})
+	events := runWorkflow(t, tr, spec.Workflow{ID: "wf", Actions: actions("a1")})
+
+	if diff := cmp.Diff([]string{"workflow failure"}, summarize(events)); diff != "" {
+		t.Errorf("unexpected events (-want +got):\n%s", diff)
+	}
+	if !strings.Contains(events[0].Message, "write failed") {
+		t.Errorf("final event message %q does not contain the write error", events[0].Message)
+	}
+	if calls := re.Calls(); len(calls) != 0 {
+		t.Errorf("got %d calls, want 0", len(calls))
+	}
+}
+
+// TestRunReconcileRetry tests that an event not reported before a restart is written again until the
+// transport accepts it, as a transport that is still connecting does not.
+func TestRunReconcileRetry(t *testing.T) {
+	store := &statefile.Config{Dir: t.TempDir()}
+	saved := spec.WorkflowState{
+		WorkflowID: "wf",
+		LastEvent:  spec.Event{ID: "saved", Type: spec.EventTypeWorkflow, WorkflowID: "wf", State: spec.StateSuccess},
+	}
+	if err := store.Put(context.Background(), saved); err != nil {
+		t.Fatal(err)
+	}
+
+	tr := memory.New()
+	var mu sync.Mutex
+	attempts := 0
+	tr.WriteErr = func(spec.Event) error {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		if attempts == 1 {
+			return errors.New("not connected")
+		}
+		return nil
+	}
+	start(t, &agent.Config{TransportReader: tr, TransportWriter: tr, RuntimeExecutor: &fake.Config{}, StateStore: store})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	events, err := tr.Wait(ctx, finished("wf"))
+	if err != nil {
+		t.Fatalf("waiting for the saved event: %v", err)
+	}
+
+	if diff := cmp.Diff([]string{"workflow success"}, summarize(events)); diff != "" {
+		t.Errorf("unexpected events (-want +got):\n%s", diff)
+	}
+	if events[0].ID != "saved" {
+		t.Errorf("event reported after the restart has ID %q, want the saved one", events[0].ID)
+	}
+}
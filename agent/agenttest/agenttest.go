@@ -0,0 +1,67 @@
+// Package agenttest provides conformance tests for implementations of the agent interfaces.
+//
+// Every TransportReader, TransportWriter, and RuntimeExecutor is expected to pass them, so that the agent
+// behaves the same no matter which implementations it is configured with.
+package agenttest
+
+import (
+	"bytes"
+	"log/slog"
+	"runtime"
+	"runtime/pprof"
+	"testing"
+	"time"
+)
+
+// leakTimeout is how long goroutines started by an implementation are given to exit once a test ends.
+const leakTimeout = 5 * time.Second
+
+// checkGoroutines fails t if there are more goroutines once t and all of its cleanups have finished
+// than when checkGoroutines was called. It must be called before anything is started.
+func checkGoroutines(t *testing.T) {
+	t.Helper()
+	before := runtime.NumGoroutine()
+	t.Cleanup(func() {
+		deadline := time.Now().Add(leakTimeout)
+		for {
+			n := runtime.NumGoroutine()
+			if n <= before {
+				return
+			}
+			if time.Now().After(deadline) {
+				b := new(bytes.Buffer)
+				_ = pprof.Lookup("goroutine").WriteTo(b, 1)
+				t.Errorf("%d goroutines were started and not stopped:\n%s", n-before, b)
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	})
+}
+
+// within fails t if f does not return within d.
+func within(t *testing.T, d time.Duration, what string, f func()) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f()
+	}()
+	select {
+	case <-done:
+	case <-time.After(d):
+		t.Fatalf("%v did not return within %v", what, d)
+	}
+}
+
+// Logger returns a logger that writes to the log of t.
+func Logger(t *testing.T) *slog.Logger {
+	return slog.New(slog.NewTextHandler(testWriter{t}, &slog.HandlerOptions{Level: slog.LevelDebug}))
+}
+
+type testWriter struct{ t *testing.T }
+
+func (w testWriter) Write(p []byte) (int, error) {
+	w.t.Log(string(p))
+	return len(p), nil
+}
@@ -0,0 +1,129 @@
+package agenttest
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jacobweinstock/tink-agent/agent"
+	"github.com/jacobweinstock/tink-agent/pkg/output"
+	"github.com/jacobweinstock/tink-agent/spec"
+)
+
+// DefaultStopTimeout is how long an executor is given to return once the context of an action is done.
+// It allows for a runtime to ask an action to stop before killing it.
+const DefaultStopTimeout = 15 * time.Second
+
+// Runtime is a runtime executor under test along with actions that behave in known ways when executed by it.
+type Runtime struct {
+	Executor agent.RuntimeExecutor
+	// Success is an action that writes Output to stdout and exits with a zero status.
+	Success spec.Action
+	// Output is a line written to stdout by Success. It is not checked when empty.
+	Output string
+	// Failure is an action that exits with FailureExitCode.
+	Failure         spec.Action
+	FailureExitCode int
+	// Block is an action that runs until it is stopped.
+	Block spec.Action
+	// StopTimeout defaults to DefaultStopTimeout.
+	StopTimeout time.Duration
+}
+
+// TestRuntime tests the Runtime returned by newRuntime. newRuntime is called for every test
+// and must stop anything it starts with t.Cleanup.
+func TestRuntime(t *testing.T, newRuntime func(t *testing.T) Runtime) {
+	tests := []struct {
+		name string
+		test func(*testing.T, Runtime)
+	}{
+		{"Success", testSuccess},
+		{"Failure", testFailure},
+		{"Cancelled", testCancelled},
+		{"DeadlineExceeded", testDeadlineExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkGoroutines(t)
+			r := newRuntime(t)
+			if r.StopTimeout == 0 {
+				r.StopTimeout = DefaultStopTimeout
+			}
+			tt.test(t, r)
+		})
+	}
+}
+
+// execute runs a with r, returning the result, the error, and every line of output sent to the output sink.
+func execute(ctx context.Context, t *testing.T, r Runtime, a spec.Action, timeout time.Duration) (spec.Result, error, []string) {
+	t.Helper()
+	var mu sync.Mutex
+	var lines []string
+	ctx = output.WithSink(ctx, func(l spec.LogLine) {
+		mu.Lock()
+		defer mu.Unlock()
+		lines = append(lines, l.Text)
+	})
+	var res spec.Result
+	var err error
+	within(t, timeout, "Execute", func() { res, err = r.Executor.Execute(ctx, a) })
+	mu.Lock()
+	defer mu.Unlock()
+
+	return res, err, lines
+}
+
+func testSuccess(t *testing.T, r Runtime) {
+	start := time.Now()
+	res, err, lines := execute(context.Background(), t, r, r.Success, 2*time.Minute)
+	if err != nil {
+		t.Fatalf("executing action: %v", err)
+	}
+	if res.ExitCode != 0 {
+		t.Errorf("got exit code %d, want 0", res.ExitCode)
+	}
+	if res.Started.Before(start) || res.Finished.Before(res.Started) || res.Finished.After(time.Now()) {
+		t.Errorf("got start %v and finish %v, want them in order within the call", res.Started, res.Finished)
+	}
+	if r.Output == "" {
+		return
+	}
+	if !slices.ContainsFunc(res.Output, func(l spec.LogLine) bool { return l.Text == r.Output && l.Stream == spec.StreamStdout }) {
+		t.Errorf("result output %v does not contain %q on stdout", res.Output, r.Output)
+	}
+	if !slices.Contains(lines, r.Output) {
+		t.Errorf("output sent to the sink %q does not contain %q", lines, r.Output)
+	}
+}
+
+func testFailure(t *testing.T, r Runtime) {
+	res, err, _ := execute(context.Background(), t, r, r.Failure, 2*time.Minute)
+	if !errors.Is(err, spec.ErrNonZeroExit) {
+		t.Fatalf("got error %v, want %v", err, spec.ErrNonZeroExit)
+	}
+	if res.ExitCode != r.FailureExitCode {
+		t.Errorf("got exit code %d, want %d", res.ExitCode, r.FailureExitCode)
+	}
+}
+
+func testCancelled(t *testing.T, r Runtime) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	time.AfterFunc(time.Second, cancel)
+	_, err, _ := execute(ctx, t, r, r.Block, time.Second+r.StopTimeout)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+}
+
+func testDeadlineExceeded(t *testing.T, r Runtime) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err, _ := execute(ctx, t, r, r.Block, time.Second+r.StopTimeout)
+	if c := spec.Classify(err); c != spec.FailureClassTimeout {
+		t.Errorf("got failure class %v for error %v, want %v", c, err, spec.FailureClassTimeout)
+	}
+}
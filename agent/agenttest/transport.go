@@ -0,0 +1,248 @@
+package agenttest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/jacobweinstock/tink-agent/agent"
+	"github.com/jacobweinstock/tink-agent/spec"
+)
+
+// Transport is a transport under test along with the means to drive the server side of it.
+type Transport struct {
+	// Reader and Writer are the implementation under test.
+	Reader agent.TransportReader
+	Writer agent.TransportWriter
+	// Submit makes wf available to be read from Reader, the same as the server side of the transport would.
+	// It may block until wf is read.
+	Submit func(ctx context.Context, wf spec.Workflow) error
+	// Events returns the events the server side has received so far, in order. Workflow events are ignored.
+	// Events are compared by state, and by action ID and name when the server side knows them.
+	// It is nil for transports that do not report events, in which case the tests of Writer are skipped.
+	Events func() []spec.Event
+	// Fail has every request to the server side fail when called with true, until it is called with false.
+	// It is nil for transports whose server side cannot be made to fail, in which case the failure tests are skipped.
+	Fail func(fail bool)
+}
+
+// TestTransport tests the Transport returned by newTransport. newTransport is called for every test
+// and must stop anything it starts with t.Cleanup.
+func TestTransport(t *testing.T, newTransport func(t *testing.T) Transport) {
+	tests := []struct {
+		name string
+		test func(*testing.T, Transport)
+	}{
+		{"ReadCancelled", testReadCancelled},
+		{"ReadWorkflow", testReadWorkflow},
+		{"ReadOrder", testReadOrder},
+		{"WriteOrder", testWriteOrder},
+		{"WriteCancelled", testWriteCancelled},
+		{"WriteWorkflowEvent", testWriteWorkflowEvent},
+		{"WriteFailure", testWriteFailure},
+		{"ReadFailure", testReadFailure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkGoroutines(t)
+			tt.test(t, newTransport(t))
+		})
+	}
+}
+
+func testWorkflow(id string) spec.Workflow {
+	return spec.Workflow{
+		ID: id,
+		Actions: []spec.Action{
+			{ID: "a1", WorkflowID: id, Name: "first", Image: "registry.example.com/first:v1", TimeoutSeconds: 60},
+			{ID: "a2", WorkflowID: id, Name: "second", Image: "registry.example.com/second:v1", TimeoutSeconds: 60},
+		},
+	}
+}
+
+// submit calls tr.Submit in the background, failing t if it returns an error.
+func submit(ctx context.Context, t *testing.T, tr Transport, wf spec.Workflow) {
+	t.Helper()
+	errs := make(chan error, 1)
+	go func() { errs <- tr.Submit(ctx, wf) }()
+	t.Cleanup(func() {
+		if err := <-errs; err != nil && ctx.Err() == nil {
+			t.Errorf("submitting workflow %v: %v", wf.ID, err)
+		}
+	})
+}
+
+// read reads a workflow from tr, failing t if it does not have the ID want.
+func read(ctx context.Context, t *testing.T, tr Transport, want spec.Workflow) spec.Workflow {
+	t.Helper()
+	got, err := tr.Reader.Read(ctx)
+	if err != nil {
+		t.Fatalf("reading workflow %v: %v", want.ID, err)
+	}
+	if got.ID != want.ID {
+		t.Fatalf("read workflow %q, want %q", got.ID, want.ID)
+	}
+
+	return got
+}
+
+// finish writes the final event of wf so the transport accepts another workflow.
+func finish(ctx context.Context, t *testing.T, tr Transport, wf spec.Workflow) {
+	t.Helper()
+	if err := tr.Writer.Write(ctx, spec.Event{Type: spec.EventTypeWorkflow, WorkflowID: wf.ID, Message: "workflow completed", State: spec.StateSuccess}); err != nil {
+		t.Fatalf("writing final event of workflow %v: %v", wf.ID, err)
+	}
+}
+
+// testReadCancelled tests that Read returns context.Canceled once its context is cancelled.
+func testReadCancelled(t *testing.T, tr Transport) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	var err error
+	within(t, 5*time.Second, "Read with a cancelled context", func() { _, err = tr.Reader.Read(ctx) })
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+}
+
+// testReadWorkflow tests that a submitted workflow is read with its actions in order.
+func testReadWorkflow(t *testing.T, tr Transport) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	want := testWorkflow("wf-read")
+	submit(ctx, t, tr, want)
+	got := read(ctx, t, tr, want)
+
+	if len(got.Actions) != len(want.Actions) {
+		t.Fatalf("read %d actions, want %d", len(got.Actions), len(want.Actions))
+	}
+	for i, a := range got.Actions {
+		if a.Name != want.Actions[i].Name || a.Image != want.Actions[i].Image {
+			t.Errorf("action %d is %v with image %v, want %v with image %v", i, a.Name, a.Image, want.Actions[i].Name, want.Actions[i].Image)
+		}
+	}
+	finish(ctx, t, tr, want)
+}
+
+// testReadOrder tests that workflows are read in the order they are submitted.
+func testReadOrder(t *testing.T, tr Transport) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for i := range 3 {
+		wf := testWorkflow(fmt.Sprintf("wf-order-%d", i))
+		submit(ctx, t, tr, wf)
+		read(ctx, t, tr, wf)
+		finish(ctx, t, tr, wf)
+	}
+}
+
+// testWriteOrder tests that action events are reported in the order they are written.
+func testWriteOrder(t *testing.T, tr Transport) {
+	if tr.Events == nil {
+		t.Skip("transport does not report events")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	wf := testWorkflow("wf-write")
+	submit(ctx, t, tr, wf)
+	wf = read(ctx, t, tr, wf)
+
+	var want []spec.Event
+	for _, a := range wf.Actions {
+		for _, s := range []spec.State{spec.StateRunning, spec.StateSuccess} {
+			e := spec.Event{Type: spec.EventTypeAction, WorkflowID: wf.ID, Action: a, Message: "action " + string(s), State: s}
+			if s == spec.StateSuccess {
+				e.Result = spec.Result{Started: time.Now().Add(-time.Second), Finished: time.Now()}
+			}
+			if err := tr.Writer.Write(ctx, e); err != nil {
+				t.Fatalf("writing event: %v", err)
+			}
+			want = append(want, e)
+		}
+	}
+	finish(ctx, t, tr, wf)
+
+	var got []spec.Event
+	for len(got) < len(want) && ctx.Err() == nil {
+		got = slices.DeleteFunc(tr.Events(), func(e spec.Event) bool { return e.Type == spec.EventTypeWorkflow })
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d events, want %d", len(got), len(want))
+	}
+	for i := range want {
+		g, w := got[i], want[i]
+		if g.State != w.State || (g.Action.ID != "" && g.Action.ID != w.Action.ID) || (g.Action.Name != "" && g.Action.Name != w.Action.Name) {
+			t.Errorf("event %d is %v %v %v, want %v %v %v", i, g.Action.ID, g.Action.Name, g.State, w.Action.ID, w.Action.Name, w.State)
+		}
+	}
+}
+
+// testWriteCancelled tests that Write does not block once its context is cancelled.
+func testWriteCancelled(t *testing.T, tr Transport) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	e := spec.Event{Type: spec.EventTypeAction, WorkflowID: "wf-cancelled", Action: spec.Action{ID: "a1", Name: "first", WorkflowID: "wf-cancelled"}, State: spec.StateRunning}
+	within(t, 5*time.Second, "Write with a cancelled context", func() { _ = tr.Writer.Write(ctx, e) })
+}
+
+// testWriteWorkflowEvent tests that workflow events are accepted even for workflows that were not read.
+func testWriteWorkflowEvent(t *testing.T, tr Transport) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, s := range []spec.State{spec.StateRunning, spec.StateFailure} {
+		e := spec.Event{Type: spec.EventTypeWorkflow, WorkflowID: "wf-unknown", Message: "workflow " + string(s), State: s}
+		within(t, 5*time.Second, "Write of a workflow event", func() {
+			if err := tr.Writer.Write(ctx, e); err != nil {
+				t.Errorf("writing workflow event: %v", err)
+			}
+		})
+	}
+}
+
+// testWriteFailure tests that Write returns an error when the server side fails the event, and that later
+// events are written once it stops failing.
+func testWriteFailure(t *testing.T, tr Transport) {
+	if tr.Fail == nil {
+		t.Skip("transport server side cannot fail")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	wf := testWorkflow("wf-write-failure")
+	submit(ctx, t, tr, wf)
+	wf = read(ctx, t, tr, wf)
+
+	e := spec.Event{Type: spec.EventTypeAction, WorkflowID: wf.ID, Action: wf.Actions[0], Message: "action running", State: spec.StateRunning}
+	tr.Fail(true)
+	var err error
+	within(t, 5*time.Second, "Write to a failing server", func() { err = tr.Writer.Write(ctx, e) })
+	if err == nil {
+		t.Error("got no error writing an event the server failed")
+	}
+	tr.Fail(false)
+	if err := tr.Writer.Write(ctx, e); err != nil {
+		t.Errorf("writing event once the server recovered: %v", err)
+	}
+	finish(ctx, t, tr, wf)
+}
+
+// testReadFailure tests that a workflow submitted while the server side is failing is read once it recovers,
+// rather than Read giving up.
+func testReadFailure(t *testing.T, tr Transport) {
+	if tr.Fail == nil {
+		t.Skip("transport server side cannot fail")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	tr.Fail(true)
+	wf := testWorkflow("wf-read-failure")
+	submit(ctx, t, tr, wf)
+	// Long enough for the transport to have been failed while asking for it.
+	time.Sleep(200 * time.Millisecond)
+	tr.Fail(false)
+	read(ctx, t, tr, wf)
+	finish(ctx, t, tr, wf)
+}
@@ -0,0 +1,55 @@
+package agent
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/jacobweinstock/tink-agent/spec"
+)
+
+// hook returns the action that runs the OnTimeout or OnFailure command of action, given it ended in state.
+// It returns false when there is nothing to run.
+func hook(action spec.Action, state spec.State) (spec.Action, bool) {
+	var cmd []string
+	var suffix string
+	switch state {
+	case spec.StateTimeout:
+		cmd, suffix = action.OnTimeout, "on-timeout"
+	case spec.StateFailure:
+		cmd, suffix = action.OnFailure, "on-failure"
+	}
+	if len(cmd) == 0 || cmd[0] == "" {
+		return spec.Action{}, false
+	}
+
+	h := action
+	// The hook is a separate run of the image, it needs its own ID and name so runtimes do not mix them up.
+	h.ID, h.Name = action.ID+"-"+suffix, action.Name+"-"+suffix
+	h.Cmd, h.Args = cmd[0], cmd[1:]
+	h.Retries, h.RetryPolicy = 0, nil
+	h.OnTimeout, h.OnFailure = nil, nil
+
+	return h, true
+}
+
+// runHook runs the OnTimeout or OnFailure command of action once it ended in state. The outcome of the hook
+// is only logged, it does not change the state of the action. It is bounded by the timeout of the action.
+func (c *Config) runHook(ctx context.Context, log *slog.Logger, action spec.Action, state spec.State) {
+	h, ok := hook(action, state)
+	if !ok {
+		return
+	}
+	if action.TimeoutSeconds > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(action.TimeoutSeconds)*time.Second)
+		defer cancel()
+	}
+	log.Info("running action hook", "action", action.Name, "hook", h.Name, "cmd", h.Cmd, "args", h.Args)
+	res, err := c.execute(ctx, h)
+	if err != nil {
+		log.Info("error executing action hook", "hook", h.Name, "error", err, "exitCode", res.ExitCode)
+		return
+	}
+	log.Info("executed action hook", "hook", h.Name)
+}
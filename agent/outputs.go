@@ -0,0 +1,78 @@
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+	"text/template"
+
+	"github.com/jacobweinstock/tink-agent/spec"
+)
+
+// validEnvName matches the outputs that are also set as environment variables.
+var validEnvName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// withOutputs makes the outputs of earlier actions in a workflow available to action.
+// Args and Env values are templated, with outputs available as {{ .Outputs.KEY }}, and every output
+// that is a valid environment variable name is set as one, unless the action already sets it.
+func withOutputs(action spec.Action, outputs map[string]string) (spec.Action, error) {
+	data := struct{ Outputs map[string]string }{Outputs: outputs}
+	if data.Outputs == nil {
+		data.Outputs = map[string]string{}
+	}
+
+	args := make([]string, 0, len(action.Args))
+	for _, arg := range action.Args {
+		v, err := render(arg, data)
+		if err != nil {
+			return action, fmt.Errorf("error templating arg %q: %w", arg, err)
+		}
+		args = append(args, v)
+	}
+
+	env := make([]spec.Env, 0, len(action.Env)+len(outputs))
+	set := map[string]bool{}
+	for _, e := range action.Env {
+		v, err := render(e.Value, data)
+		if err != nil {
+			return action, fmt.Errorf("error templating env %v: %w", e.Key, err)
+		}
+		env = append(env, spec.Env{Key: e.Key, Value: v})
+		set[e.Key] = true
+	}
+	for _, k := range slices.Sorted(maps.Keys(outputs)) {
+		if set[k] || !validEnvName.MatchString(k) {
+			continue
+		}
+		env = append(env, spec.Env{Key: k, Value: outputs[k]})
+	}
+
+	if action.Args != nil {
+		action.Args = args
+	}
+	if len(env) > 0 {
+		action.Env = env
+	}
+
+	return action, nil
+}
+
+// render executes s as a template with data. Strings without template actions are returned as is.
+func render(s string, data any) (string, error) {
+	if !strings.Contains(s, "{{") {
+		return s, nil
+	}
+	t, err := template.New("").Option("missingkey=error").Parse(s)
+	if err != nil {
+		return "", err
+	}
+	b := new(bytes.Buffer)
+	if err := t.Execute(b, data); err != nil {
+		return "", err
+	}
+
+	return b.String(), nil
+}
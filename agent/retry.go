@@ -0,0 +1,51 @@
+package agent
+
+import (
+	"math"
+	"slices"
+	"time"
+
+	"github.com/jacobweinstock/tink-agent/pkg/rand"
+	"github.com/jacobweinstock/tink-agent/spec"
+)
+
+// retryPolicy returns the retry policy of action with defaults applied.
+// Actions without a retry policy keep the behavior of Action.Retries.
+func retryPolicy(action spec.Action) spec.RetryPolicy {
+	p := spec.RetryPolicy{}
+	if action.RetryPolicy != nil {
+		p = *action.RetryPolicy
+	}
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = max(action.Retries, 1)
+	}
+	if p.Multiplier < 1 {
+		p.Multiplier = 1
+	}
+	p.Jitter = min(max(p.Jitter, 0), 1)
+	if p.TimeoutScope != spec.TimeoutScopeAttempt {
+		p.TimeoutScope = spec.TimeoutScopeTotal
+	}
+
+	return p
+}
+
+// retryable reports whether a failure of class should be retried.
+func retryable(p spec.RetryPolicy, class spec.FailureClass) bool {
+	return len(p.RetryOn) == 0 || slices.Contains(p.RetryOn, class)
+}
+
+// retryDelay returns the delay before the retry that follows attempt, where the first attempt is 1.
+func retryDelay(p spec.RetryPolicy, attempt int) time.Duration {
+	delay := p.InitialDelaySeconds * math.Pow(p.Multiplier, float64(attempt-1))
+	if p.MaxDelaySeconds > 0 {
+		delay = min(delay, p.MaxDelaySeconds)
+	}
+	// Cap the delay so large multipliers or attempt counts cannot overflow a time.Duration.
+	d := time.Duration(min(delay*float64(time.Second), float64(math.MaxInt64/2)))
+	if j := int64(float64(d) * p.Jitter); j > 0 {
+		d += time.Duration(rand.Int63nRange(-j, j+1))
+	}
+
+	return max(d, 0)
+}
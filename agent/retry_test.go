@@ -0,0 +1,77 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/jacobweinstock/tink-agent/spec"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	tests := map[string]struct {
+		action spec.Action
+		want   spec.RetryPolicy
+	}{
+		"no policy or retries": {
+			want: spec.RetryPolicy{MaxAttempts: 1, Multiplier: 1, TimeoutScope: spec.TimeoutScopeTotal},
+		},
+		"retries without a policy": {
+			action: spec.Action{Retries: 3},
+			want:   spec.RetryPolicy{MaxAttempts: 3, Multiplier: 1, TimeoutScope: spec.TimeoutScopeTotal},
+		},
+		"out of range values": {
+			action: spec.Action{Retries: 3, RetryPolicy: &spec.RetryPolicy{MaxAttempts: 5, Multiplier: 0.5, Jitter: 2, TimeoutScope: "unknown"}},
+			want:   spec.RetryPolicy{MaxAttempts: 5, Multiplier: 1, Jitter: 1, TimeoutScope: spec.TimeoutScopeTotal},
+		},
+		"attempt scope": {
+			action: spec.Action{RetryPolicy: &spec.RetryPolicy{TimeoutScope: spec.TimeoutScopeAttempt}},
+			want:   spec.RetryPolicy{MaxAttempts: 1, Multiplier: 1, TimeoutScope: spec.TimeoutScopeAttempt},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if diff := cmp.Diff(tt.want, retryPolicy(tt.action)); diff != "" {
+				t.Errorf("unexpected policy (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	p := spec.RetryPolicy{InitialDelaySeconds: 1, Multiplier: 2, MaxDelaySeconds: 5}
+	var got []time.Duration
+	for attempt := 1; attempt <= 4; attempt++ {
+		got = append(got, retryDelay(p, attempt))
+	}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected delays (-want +got):\n%s", diff)
+	}
+
+	// Large values are capped instead of overflowing.
+	if d := retryDelay(spec.RetryPolicy{InitialDelaySeconds: 1, Multiplier: 10}, 1000); d <= 0 {
+		t.Errorf("got delay %v, want a positive delay", d)
+	}
+
+	// Jitter keeps the delay within the fraction of the delay in either direction.
+	p = spec.RetryPolicy{InitialDelaySeconds: 1, Multiplier: 1, Jitter: 0.5}
+	for range 100 {
+		if d := retryDelay(p, 1); d < 500*time.Millisecond || d > 1500*time.Millisecond {
+			t.Fatalf("got delay %v, want between 500ms and 1.5s", d)
+		}
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	if !retryable(spec.RetryPolicy{}, spec.FailureClassRuntime) {
+		t.Error("all failures should be retried when RetryOn is empty")
+	}
+	p := spec.RetryPolicy{RetryOn: []spec.FailureClass{spec.FailureClassImagePull}}
+	if !retryable(p, spec.FailureClassImagePull) {
+		t.Error("image pull failures should be retried")
+	}
+	if retryable(p, spec.FailureClassNonZeroExit) {
+		t.Error("non-zero exits should not be retried")
+	}
+}
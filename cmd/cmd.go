@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"flag"
+	"net/http"
 
 	"github.com/peterbourgon/ff/v3"
 	"github.com/peterbourgon/ff/v3/ffcli"
@@ -13,30 +14,56 @@ type TransportType string
 type RuntimeType string
 
 const (
-	GRPCTransportType TransportType = "grpc"
-	FileTransportType TransportType = "file"
-	NATSTransportType TransportType = "nats"
+	GRPCTransportType   TransportType = "grpc"
+	GRPCV2TransportType TransportType = "grpc-v2"
+	FileTransportType   TransportType = "file"
+	NATSTransportType   TransportType = "nats"
+	HTTPTransportType   TransportType = "http"
 
 	DockerRuntimeType     RuntimeType = "docker"
 	ContainerdRuntimeType RuntimeType = "containerd"
+	ProcessRuntimeType    RuntimeType = "process"
+	OCIRuntimeType        RuntimeType = "oci"
+	PodmanRuntimeType     RuntimeType = "podman"
+	WasmRuntimeType       RuntimeType = "wasm"
 )
 
 type Config struct {
-	ID        string
-	LogLevel  string
+	ID       string
+	LogLevel string
+	// GlobalTimeout is the default workflow global timeout in seconds.
+	GlobalTimeout int
+	// StateDir is the directory workflow progress is saved in. Progress is not saved when empty.
+	StateDir  string
 	Transport struct {
 		GRPC GRPCTransport
 		File FileTransport
 		NATS NATSTransport
+		HTTP HTTPTransport
 	}
 	Runtime struct {
 		Docker     DockerRuntime
 		Containerd ContainerdRuntime
+		Process    ProcessRuntime
+		OCI        OCIRuntime
+		Podman     PodmanRuntime
+		// ScratchDir is where a scratch directory is created for each action.
+		ScratchDir string
 	}
 	Registry          Registry
 	Proxy             Proxy
 	TransportSelected TransportType
 	RuntimeSelected   RuntimeType
+	// DevServer is set when the dev-server subcommand is run instead of the agent.
+	DevServer *DevServer
+}
+
+type DevServer struct {
+	Addr string
+	// HardwareMap renders Templates that no Workflow refers to.
+	HardwareMap map[string]string
+	// Files are the YAML files Templates and Workflows are loaded from.
+	Files []string
 }
 
 type Registry struct {
@@ -53,23 +80,101 @@ type Proxy struct {
 
 type GRPCTransport struct {
 	ServerAddrPort string
-	TLSEnabled     bool
-	TLSInsecure    bool
-	RetryInterval  int
+	// TLSEnabled connects with TLS. It is implied by TLSCA, TLSCert, TLSKey and TLSServerName.
+	TLSEnabled    bool
+	TLSInsecure   bool
+	TLSCA         string
+	TLSCert       string
+	TLSKey        string
+	TLSServerName string
+	// Token is a bearer token sent with every call. TokenFile is used instead when set.
+	Token string
+	// TokenFile is a file the bearer token is read from, it is read again when it changes.
+	TokenFile     string
+	RetryInterval int
+	// MaxRetryInterval caps in seconds the exponential backoff after errors.
+	MaxRetryInterval int
+	// KeepaliveTime is how long in seconds the connection can be idle before it is pinged, 0 disables keepalive.
+	KeepaliveTime int
+	// KeepaliveTimeout is how long in seconds to wait for a ping to be answered before the connection is closed.
+	KeepaliveTimeout int
 }
 type FileTransport struct {
+	// WorkflowPath is a workflow file or a directory of them.
 	WorkflowPath string
+	// Watch keeps checking WorkflowPath for new workflow files.
+	Watch bool
+	// PollInterval is how often in seconds WorkflowPath is checked in watch mode.
+	PollInterval int
+	// DoneDir and FailedDir are where workflow files are moved once they completed.
+	DoneDir   string
+	FailedDir string
+	// StatusDir is where status and log files are written, next to the workflow files when empty.
+	StatusDir string
 }
 type NATSTransport struct {
 	ServerAddrPort string
 	StreamName     string
 	EventsSubject  string
 	ActionsSubject string
+	LogsSubject    string
+	JetStream      bool
+	// AckWait is how long in seconds the server waits before redelivering a workflow in JetStream mode.
+	AckWait int
+	// EventEncoding is how events are encoded, json or protobuf.
+	EventEncoding string
+	User          string
+	Password      string
+	Token         string
+	NKeySeedFile  string
+	// CredentialsFile is a .creds file with a user JWT and NKey seed.
+	CredentialsFile string
+	// TLSEnabled connects with TLS. It is implied by any of the other TLS fields being set.
+	TLSEnabled    bool
+	TLSCA         string
+	TLSCert       string
+	TLSKey        string
+	TLSServerName string
 }
 
 type DockerRuntime struct {
 	SocketPath string
 }
+type PodmanRuntime struct {
+	SocketPath string
+}
+type OCIRuntime struct {
+	RuntimePath string
+	RuntimeRoot string
+	Root        string
+}
+type ProcessRuntime struct {
+	WorkingDir string
+}
+type HTTPTransport struct {
+	WorkflowURL string
+	EventsURL   string
+	// PollInterval is how long in seconds to wait between workflow requests.
+	PollInterval int
+	// LongPoll is the most seconds the server may hold a workflow request, long polling is not used when 0.
+	LongPoll int
+	// Timeout is how long in seconds a request can take, in addition to LongPoll.
+	Timeout int
+	// Retries is how many more times an event is sent after a temporary error.
+	Retries int
+	// RetryInterval is how long in seconds to wait before sending an event again, it doubles after every retry.
+	RetryInterval int
+	// MaxRetryInterval is the most seconds between workflow requests after errors.
+	MaxRetryInterval int
+	// Header is added to every request.
+	Header http.Header
+	// TLSInsecure skips verifying the server certificate. The TLS fields only apply to https URLs.
+	TLSInsecure   bool
+	TLSCA         string
+	TLSCert       string
+	TLSKey        string
+	TLSServerName string
+}
 type ContainerdRuntime struct {
 	Namespace  string
 	SocketPath string
@@ -84,7 +189,7 @@ func (c *Config) RootCommand(ctx context.Context, fs *flag.FlagSet) *ffcli.Comma
 		LongHelp:    "Tink Agent runs the workflows.",
 		FlagSet:     fs,
 		Options:     []ff.Option{ff.WithEnvVarNoPrefix()},
-		Subcommands: []*ffcli.Command{TransportCommand(c)},
+		Subcommands: []*ffcli.Command{TransportCommand(c), DevServerCommand(c)},
 		Exec: func(ctx context.Context, args []string) error {
 			// This is legacy mode. Only GRPC transport and Docker runtime are supported.
 			c.TransportSelected = GRPCTransportType
@@ -107,6 +212,10 @@ func TransportCommand(c *Config) *ffcli.Command {
 	RegisterRootFlags(c, g.FlagSet)
 	RegisterRuntimeFlags(c, g.FlagSet)
 
+	g2 := GRPCV2Command(c)
+	RegisterRootFlags(c, g2.FlagSet)
+	RegisterRuntimeFlags(c, g2.FlagSet)
+
 	f := FileCommand(c)
 	RegisterRootFlags(c, f.FlagSet)
 	RegisterRuntimeFlags(c, f.FlagSet)
@@ -115,13 +224,17 @@ func TransportCommand(c *Config) *ffcli.Command {
 	RegisterRootFlags(c, n.FlagSet)
 	RegisterRuntimeFlags(c, n.FlagSet)
 
+	h := HTTPCommand(c)
+	RegisterRootFlags(c, h.FlagSet)
+	RegisterRuntimeFlags(c, h.FlagSet)
+
 	cli := &ffcli.Command{
 		Name:        "transport",
 		ShortUsage:  "tink-agent [flags] transport [flags] <subcommand> [flags]",
 		LongHelp:    "Tink Agent runs the workflows.",
 		FlagSet:     fs,
 		Options:     []ff.Option{ff.WithEnvVarPrefix("tink-agent")},
-		Subcommands: []*ffcli.Command{g, f, n},
+		Subcommands: []*ffcli.Command{g, g2, f, n, h},
 		Exec: func(ctx context.Context, args []string) error {
 			return errors.New("please call a subcommand")
 		},
@@ -148,6 +261,24 @@ func GRPCCommand(c *Config) *ffcli.Command {
 	return cli
 }
 
+func GRPCV2Command(c *Config) *ffcli.Command {
+	fs := flag.NewFlagSet("grpc-v2", flag.ExitOnError)
+	RegisterGRPCTransportFlags(c, fs)
+	cli := &ffcli.Command{
+		Name:       "grpc-v2",
+		ShortUsage: "tink-agent [flags] grpc-v2 [flags]",
+		LongHelp:   "grpc-v2 run the agent using the gRPC transport with the v2 workflow API.",
+		FlagSet:    fs,
+		Options:    []ff.Option{ff.WithEnvVarPrefix("tink-agent")},
+		Exec: func(ctx context.Context, args []string) error {
+			c.TransportSelected = GRPCV2TransportType
+			return nil
+		},
+	}
+
+	return cli
+}
+
 func FileCommand(c *Config) *ffcli.Command {
 	fs := flag.NewFlagSet("file", flag.ExitOnError)
 	RegisterFileTransportFlags(c, fs)
@@ -158,6 +289,9 @@ func FileCommand(c *Config) *ffcli.Command {
 		FlagSet:    fs,
 		Options:    []ff.Option{ff.WithEnvVarPrefix("tink-agent")},
 		Exec: func(ctx context.Context, args []string) error {
+			if c.Transport.File.WorkflowPath == "" {
+				return errors.New("--workflow-path is required")
+			}
 			c.TransportSelected = FileTransportType
 			return nil
 		},
@@ -183,3 +317,47 @@ func NATSCommand(c *Config) *ffcli.Command {
 
 	return cli
 }
+
+func DevServerCommand(c *Config) *ffcli.Command {
+	fs := flag.NewFlagSet("dev-server", flag.ExitOnError)
+	d := &DevServer{}
+	RegisterDevServerFlags(c, d, fs)
+	cli := &ffcli.Command{
+		Name:       "dev-server",
+		ShortUsage: "tink-agent dev-server [flags] <file>...",
+		LongHelp:   "dev-server runs a local Tink server that serves the Templates and Workflows in the YAML files to agents using the grpc or grpc-v2 transport.",
+		FlagSet:    fs,
+		Options:    []ff.Option{ff.WithEnvVarPrefix("tink-agent")},
+		Exec: func(ctx context.Context, args []string) error {
+			if len(args) == 0 {
+				return errors.New("at least one Template or Workflow file is required")
+			}
+			d.Files = args
+			c.DevServer = d
+			return nil
+		},
+	}
+
+	return cli
+}
+
+func HTTPCommand(c *Config) *ffcli.Command {
+	fs := flag.NewFlagSet("http", flag.ExitOnError)
+	RegisterHTTPTransportFlags(c, fs)
+	cli := &ffcli.Command{
+		Name:       "http",
+		ShortUsage: "tink-agent [flags] http [flags]",
+		LongHelp:   "http runs the agent polling an HTTP server for workflows and posting events to it.",
+		FlagSet:    fs,
+		Options:    []ff.Option{ff.WithEnvVarPrefix("tink-agent")},
+		Exec: func(ctx context.Context, args []string) error {
+			if c.Transport.HTTP.WorkflowURL == "" || c.Transport.HTTP.EventsURL == "" {
+				return errors.New("--http-workflow-url and --http-events-url are required")
+			}
+			c.TransportSelected = HTTPTransportType
+			return nil
+		},
+	}
+
+	return cli
+}
@@ -3,6 +3,7 @@ package cmd
 import (
 	"flag"
 	"fmt"
+	"net/http"
 	"strings"
 )
 
@@ -15,6 +16,9 @@ func RegisterFlagsLegacy(c *Config, fs *flag.FlagSet) {
 	fs.BoolVar(&c.Transport.GRPC.TLSInsecure, "tinkerbell-insecure-tls", false, "Tink server GRPC insecure TLS")
 	fs.BoolVar(&c.Transport.GRPC.TLSEnabled, "tinkerbell-tls", true, "Tink server GRPC use TLS")
 	fs.StringVar(&c.LogLevel, "log-level", "info", "Log level")
+	fs.IntVar(&c.GlobalTimeout, "global-timeout", 0, "Default workflow global timeout in seconds, used when a workflow does not define one. 0 means no timeout")
+	fs.StringVar(&c.StateDir, "state-dir", "", "Directory to save workflow progress in so it can be resumed after a restart. Progress is not saved when empty")
+	registerGRPCConnectionFlags(c, fs)
 }
 
 func RegisterRootFlags(c *Config, fs *flag.FlagSet) {
@@ -26,34 +30,69 @@ func RegisterRootFlags(c *Config, fs *flag.FlagSet) {
 	fs.StringVar(&c.Proxy.HTTPProxy, "http-proxy", "", "HTTP proxy")
 	fs.StringVar(&c.Proxy.HTTPSProxy, "https-proxy", "", "HTTPS proxy")
 	fs.StringVar(&c.Proxy.NoProxy, "no-proxy", "", "No proxy")
+	fs.IntVar(&c.GlobalTimeout, "global-timeout", 0, "Default workflow global timeout in seconds, used when a workflow does not define one. 0 means no timeout")
+	fs.StringVar(&c.StateDir, "state-dir", "", "Directory to save workflow progress in so it can be resumed after a restart. Progress is not saved when empty")
 }
 
 func RegisterRuntimeFlags(c *Config, fs *flag.FlagSet) {
-	fs.Func("runtime", fmt.Sprintf("Runtime, must be one of [%s, %s]", DockerRuntimeType, ContainerdRuntimeType), func(s string) error {
+	fs.Func("runtime", fmt.Sprintf("Runtime, must be one of [%s, %s, %s, %s, %s, %s]", DockerRuntimeType, ContainerdRuntimeType, ProcessRuntimeType, OCIRuntimeType, PodmanRuntimeType, WasmRuntimeType), func(s string) error {
 		switch strings.ToLower(s) {
 		case "docker":
 			c.RuntimeSelected = DockerRuntimeType
 		case "containerd":
 			c.RuntimeSelected = ContainerdRuntimeType
+		case "process":
+			c.RuntimeSelected = ProcessRuntimeType
+		case "oci":
+			c.RuntimeSelected = OCIRuntimeType
+		case "podman":
+			c.RuntimeSelected = PodmanRuntimeType
+		case "wasm":
+			c.RuntimeSelected = WasmRuntimeType
 		default:
 			c.RuntimeSelected = DockerRuntimeType
 			// return fmt.Errorf("invalid runtime, must be one of: [%s, %s]", DockerRuntimeType, ContainerdRuntimeType)
 		}
 		return nil
 	})
+	fs.StringVar(&c.Runtime.ScratchDir, "action-scratch-dir", "", "Directory in which a scratch directory is created for each action, where actions can write a failure reason, message, and outputs. Disabled when empty")
 	RegisterDockerRuntimeFlags(c, fs)
 	RegisterContainerdRuntimeFlags(c, fs)
+	RegisterProcessRuntimeFlags(c, fs)
+	RegisterOCIRuntimeFlags(c, fs)
+	RegisterPodmanRuntimeFlags(c, fs)
 }
 
 func RegisterGRPCTransportFlags(c *Config, fs *flag.FlagSet) {
 	fs.StringVar(&c.Transport.GRPC.ServerAddrPort, "grpc-server", "", "gRPC server address:port")
 	fs.BoolVar(&c.Transport.GRPC.TLSEnabled, "grpc-tls", false, "gRPC TLS enabled")
 	fs.BoolVar(&c.Transport.GRPC.TLSInsecure, "grpc-insecure-tls", false, "gRPC insecure TLS")
+	fs.StringVar(&c.Transport.GRPC.TLSCA, "grpc-tls-ca", "", "PEM file of the CAs the gRPC server certificate is verified with, the system CAs are used when empty")
+	fs.StringVar(&c.Transport.GRPC.TLSCert, "grpc-tls-cert", "", "PEM file of the client certificate to authenticate with")
+	fs.StringVar(&c.Transport.GRPC.TLSKey, "grpc-tls-key", "", "PEM file of the client certificate private key")
+	fs.StringVar(&c.Transport.GRPC.TLSServerName, "grpc-tls-server-name", "", "Name the gRPC server certificate is verified against, the server address is used when empty")
+	fs.StringVar(&c.Transport.GRPC.Token, "grpc-token", "", "Bearer token sent with every gRPC call, requires TLS")
+	fs.StringVar(&c.Transport.GRPC.TokenFile, "grpc-token-file", "", "File the bearer token sent with every gRPC call is read from, it is read again when it changes. Requires TLS")
+	registerGRPCConnectionFlags(c, fs)
+}
+
+// registerGRPCConnectionFlags registers the reconnection and keepalive flags, they are used by legacy mode as well.
+func registerGRPCConnectionFlags(c *Config, fs *flag.FlagSet) {
 	fs.IntVar(&c.Transport.GRPC.RetryInterval, "grpc-retry-interval", 5, "gRPC retry interval")
+	fs.IntVar(&c.Transport.GRPC.MaxRetryInterval, "grpc-max-retry-interval", 60, "Maximum seconds between gRPC reconnection attempts, the interval doubles from --grpc-retry-interval after each error")
+	fs.IntVar(&c.Transport.GRPC.KeepaliveTime, "grpc-keepalive-time", 300, "Seconds the gRPC connection can be idle before it is pinged, 0 disables keepalive. Servers reject pings more often than every 300 seconds by default")
+	fs.IntVar(&c.Transport.GRPC.KeepaliveTimeout, "grpc-keepalive-timeout", 20, "Seconds to wait for a gRPC keepalive ping to be answered before the connection is closed")
 }
 
 func RegisterFileTransportFlags(c *Config, fs *flag.FlagSet) {
-	fs.StringVar(&c.Transport.File.WorkflowPath, "workflow-pah", "", "Workflow file path")
+	fs.StringVar(&c.Transport.File.WorkflowPath, "workflow-path", "", "Workflow file, or directory of workflow files, to run. Files can hold multiple YAML documents or JSON values")
+	// workflow-pah is the misspelled name the flag was first added with, it is kept so existing setups keep working.
+	fs.StringVar(&c.Transport.File.WorkflowPath, "workflow-pah", "", "Deprecated: use --workflow-path")
+	fs.BoolVar(&c.Transport.File.Watch, "file-watch", true, "Keep checking --workflow-path for new workflow files, otherwise the files there at start are run once")
+	fs.IntVar(&c.Transport.File.PollInterval, "file-poll-interval", 2, "Seconds between checks of --workflow-path for new workflow files")
+	fs.StringVar(&c.Transport.File.DoneDir, "file-done-dir", "done", "Directory workflow files are moved to once all their workflows succeeded, relative to the workflow files directory. Files are not moved when empty")
+	fs.StringVar(&c.Transport.File.FailedDir, "file-failed-dir", "failed", "Directory workflow files are moved to once any of their workflows did not succeed, relative to the workflow files directory. Files are not moved when empty")
+	fs.StringVar(&c.Transport.File.StatusDir, "file-status-dir", "", "Directory status and log files are written to, next to the workflow files when empty. Set it for read-only media")
 }
 
 func RegisterNATSTransportFlags(c *Config, fs *flag.FlagSet) {
@@ -61,6 +100,47 @@ func RegisterNATSTransportFlags(c *Config, fs *flag.FlagSet) {
 	fs.StringVar(&c.Transport.NATS.StreamName, "nats-stream", "tinkerbell", "NATS stream name")
 	fs.StringVar(&c.Transport.NATS.EventsSubject, "nats-events", "workflow_status", "NATS events subject")
 	fs.StringVar(&c.Transport.NATS.ActionsSubject, "nats-actions", "workflow_actions", "NATS actions subject")
+	fs.StringVar(&c.Transport.NATS.LogsSubject, "nats-logs", "workflow_logs", "NATS action output subject, action output is not published when empty")
+	fs.BoolVar(&c.Transport.NATS.JetStream, "nats-jetstream", false, "Read actions from a durable JetStream consumer and publish events to the stream, actions published while the agent is down are not lost")
+	fs.IntVar(&c.Transport.NATS.AckWait, "nats-ack-wait", 60, "Seconds the NATS server waits before redelivering a workflow the agent stopped reporting progress on, JetStream only")
+	fs.StringVar(&c.Transport.NATS.EventEncoding, "nats-event-encoding", "json", "How events are encoded, json or protobuf")
+	fs.StringVar(&c.Transport.NATS.User, "nats-user", "", "NATS user, used with --nats-password")
+	fs.StringVar(&c.Transport.NATS.Password, "nats-password", "", "NATS password")
+	fs.StringVar(&c.Transport.NATS.Token, "nats-token", "", "NATS authentication token")
+	fs.StringVar(&c.Transport.NATS.NKeySeedFile, "nats-nkey-seed", "", "File with the NATS NKey seed to authenticate with")
+	fs.StringVar(&c.Transport.NATS.CredentialsFile, "nats-creds", "", "NATS .creds file with the user JWT and NKey seed to authenticate with")
+	fs.BoolVar(&c.Transport.NATS.TLSEnabled, "nats-tls", false, "Connect to the NATS server with TLS, implied by the other --nats-tls flags")
+	fs.StringVar(&c.Transport.NATS.TLSCA, "nats-tls-ca", "", "PEM file of the CAs the NATS server certificate is verified with, the system CAs are used when empty")
+	fs.StringVar(&c.Transport.NATS.TLSCert, "nats-tls-cert", "", "PEM file of the client certificate to authenticate with")
+	fs.StringVar(&c.Transport.NATS.TLSKey, "nats-tls-key", "", "PEM file of the client certificate private key")
+	fs.StringVar(&c.Transport.NATS.TLSServerName, "nats-tls-server-name", "", "Name the NATS server certificate is verified against, the server address is used when empty")
+}
+
+func RegisterHTTPTransportFlags(c *Config, fs *flag.FlagSet) {
+	fs.StringVar(&c.Transport.HTTP.WorkflowURL, "http-workflow-url", "", "URL polled for the next workflow of the agent, the agent ID is sent in the agentID query parameter")
+	fs.StringVar(&c.Transport.HTTP.EventsURL, "http-events-url", "", "URL events are posted to as JSON")
+	fs.IntVar(&c.Transport.HTTP.PollInterval, "http-poll-interval", 5, "Seconds between workflow requests")
+	fs.IntVar(&c.Transport.HTTP.LongPoll, "http-long-poll", 0, "Most seconds the server may hold a workflow request until there is a workflow, 0 disables long polling")
+	fs.IntVar(&c.Transport.HTTP.Timeout, "http-timeout", 30, "Seconds a request can take, in addition to --http-long-poll")
+	fs.IntVar(&c.Transport.HTTP.Retries, "http-retries", 5, "How many more times an event is sent after a network error, a 429, or a 5xx response")
+	fs.IntVar(&c.Transport.HTTP.RetryInterval, "http-retry-interval", 1, "Seconds to wait before sending an event again, it doubles after every retry")
+	fs.IntVar(&c.Transport.HTTP.MaxRetryInterval, "http-max-retry-interval", 60, "Maximum seconds between workflow requests after errors, the interval doubles from --http-poll-interval after each error")
+	fs.Func("http-header", "Header added to every request, in Name: value form, for example \"Authorization: Bearer <token>\". Can be repeated", func(s string) error {
+		k, v, ok := strings.Cut(s, ":")
+		if !ok || strings.TrimSpace(k) == "" {
+			return fmt.Errorf("%q is not in Name: value form", s)
+		}
+		if c.Transport.HTTP.Header == nil {
+			c.Transport.HTTP.Header = http.Header{}
+		}
+		c.Transport.HTTP.Header.Add(strings.TrimSpace(k), strings.TrimSpace(v))
+		return nil
+	})
+	fs.BoolVar(&c.Transport.HTTP.TLSInsecure, "http-insecure-tls", false, "Skip verifying the HTTP server certificate")
+	fs.StringVar(&c.Transport.HTTP.TLSCA, "http-tls-ca", "", "PEM file of the CAs the HTTP server certificate is verified with, the system CAs are used when empty")
+	fs.StringVar(&c.Transport.HTTP.TLSCert, "http-tls-cert", "", "PEM file of the client certificate to authenticate with")
+	fs.StringVar(&c.Transport.HTTP.TLSKey, "http-tls-key", "", "PEM file of the client certificate private key")
+	fs.StringVar(&c.Transport.HTTP.TLSServerName, "http-tls-server-name", "", "Name the HTTP server certificate is verified against, the URL host is used when empty")
 }
 
 func RegisterDockerRuntimeFlags(c *Config, fs *flag.FlagSet) {
@@ -70,3 +150,33 @@ func RegisterContainerdRuntimeFlags(c *Config, fs *flag.FlagSet) {
 	fs.StringVar(&c.Runtime.Containerd.Namespace, "containerd-namespace", "tinkerbell", "Containerd namespace")
 	fs.StringVar(&c.Runtime.Containerd.SocketPath, "containerd-socket", "/run/containerd/containerd.sock", "Containerd socket path")
 }
+
+func RegisterProcessRuntimeFlags(c *Config, fs *flag.FlagSet) {
+	fs.StringVar(&c.Runtime.Process.WorkingDir, "process-working-dir", "/", "Working directory of actions run by the process runtime")
+}
+
+func RegisterOCIRuntimeFlags(c *Config, fs *flag.FlagSet) {
+	fs.StringVar(&c.Runtime.OCI.RuntimePath, "oci-runtime", "runc", "OCI runtime binary, for example runc or crun")
+	fs.StringVar(&c.Runtime.OCI.RuntimeRoot, "oci-runtime-root", "", "Directory the OCI runtime stores container state in, the OCI runtime default is used when empty")
+	fs.StringVar(&c.Runtime.OCI.Root, "oci-root", "/var/lib/tink-agent/oci", "Directory unpacked images and action bundles are stored in")
+}
+
+func RegisterPodmanRuntimeFlags(c *Config, fs *flag.FlagSet) {
+	fs.StringVar(&c.Runtime.Podman.SocketPath, "podman-socket", "/run/podman/podman.sock", "Podman API socket path")
+}
+
+func RegisterDevServerFlags(c *Config, d *DevServer, fs *flag.FlagSet) {
+	fs.StringVar(&c.LogLevel, "log-level", "info", "Log level")
+	fs.StringVar(&d.Addr, "addr", "127.0.0.1:42113", "Address:port to serve the workflow APIs on")
+	fs.Func("hardware-map", "Values Templates that no Workflow refers to are rendered with, in key=value form, for example device_1=52:54:00:0f:2e:67. Can be repeated", func(s string) error {
+		k, v, ok := strings.Cut(s, "=")
+		if !ok {
+			return fmt.Errorf("%q is not in key=value form", s)
+		}
+		if d.HardwareMap == nil {
+			d.HardwareMap = map[string]string{}
+		}
+		d.HardwareMap[k] = v
+		return nil
+	})
+}
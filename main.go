@@ -1,10 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/netip"
 	"os"
 	"os/signal"
@@ -12,16 +16,30 @@ import (
 	"time"
 
 	"github.com/docker/docker/client"
+	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/jacobweinstock/tink-agent/agent"
 	"github.com/jacobweinstock/tink-agent/cmd"
+	"github.com/jacobweinstock/tink-agent/pkg/tlsconfig"
 	"github.com/jacobweinstock/tink-agent/runtime/containerd"
 	"github.com/jacobweinstock/tink-agent/runtime/docker"
+	"github.com/jacobweinstock/tink-agent/runtime/oci"
+	"github.com/jacobweinstock/tink-agent/runtime/podman"
+	"github.com/jacobweinstock/tink-agent/runtime/process"
+	"github.com/jacobweinstock/tink-agent/runtime/wasm"
 	"github.com/jacobweinstock/tink-agent/spec"
+	statefile "github.com/jacobweinstock/tink-agent/state/file"
 	"github.com/jacobweinstock/tink-agent/transport/file"
 	"github.com/jacobweinstock/tink-agent/transport/grpc"
+	"github.com/jacobweinstock/tink-agent/transport/grpc/devserver"
 	"github.com/jacobweinstock/tink-agent/transport/grpc/proto"
+	workflow "github.com/jacobweinstock/tink-agent/transport/grpc/proto/workflow/v2"
+	"github.com/jacobweinstock/tink-agent/transport/grpcv2"
+	thttp "github.com/jacobweinstock/tink-agent/transport/http"
 	"github.com/jacobweinstock/tink-agent/transport/nats"
 	"golang.org/x/sync/errgroup"
+	ggrpc "google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
 )
 
 const (
@@ -62,6 +80,14 @@ func main() {
 
 	log := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{AddSource: false, Level: l}))
 
+	if c.DevServer != nil {
+		if err := runDevServer(ctx, log, c.DevServer); err != nil {
+			log.Info("dev server failed", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	eg, ectx := errgroup.WithContext(ctx)
 	ctx = ectx
 	var tr agent.TransportReader
@@ -69,9 +95,14 @@ func main() {
 	switch c.TransportSelected {
 	case cmd.FileTransportType:
 		readWriter := &file.Config{
-			Log:     log,
-			Actions: make(chan spec.Action),
-			FileLoc: "./example/file_template.yaml",
+			Log:          log,
+			Workflows:    make(chan spec.Workflow),
+			FileLoc:      c.Transport.File.WorkflowPath,
+			Watch:        c.Transport.File.Watch,
+			PollInterval: time.Duration(c.Transport.File.PollInterval) * time.Second,
+			DoneDir:      c.Transport.File.DoneDir,
+			FailedDir:    c.Transport.File.FailedDir,
+			StatusDir:    c.Transport.File.StatusDir,
 		}
 		go func() {
 			if err := readWriter.Start(ctx); err != nil {
@@ -83,7 +114,7 @@ func main() {
 		tr = readWriter
 		tw = readWriter
 	case cmd.GRPCTransportType:
-		conn, err := grpc.NewClientConn(c.Transport.GRPC.ServerAddrPort, c.Transport.GRPC.TLSEnabled, c.Transport.GRPC.TLSInsecure)
+		conn, err := grpcClientConn(c.Transport.GRPC)
 		if err != nil {
 			log.Info("unable to create gRPC client", "error", err)
 			os.Exit(1)
@@ -92,8 +123,29 @@ func main() {
 			Log:              log,
 			TinkServerClient: proto.NewWorkflowServiceClient(conn),
 			WorkerID:         c.ID,
-			RetryInterval:    time.Second * 5,
-			Actions:          make(chan spec.Action),
+			RetryInterval:    time.Duration(c.Transport.GRPC.RetryInterval) * time.Second,
+			MaxRetryInterval: time.Duration(c.Transport.GRPC.MaxRetryInterval) * time.Second,
+			Workflows:        make(chan spec.Workflow),
+		}
+		eg.Go(func() error {
+			return readWriter.Start(ctx)
+		})
+		tr = readWriter
+		tw = readWriter
+	case cmd.GRPCV2TransportType:
+		conn, err := grpcClientConn(c.Transport.GRPC)
+		if err != nil {
+			log.Info("unable to create gRPC client", "error", err)
+			os.Exit(1)
+		}
+		readWriter := &grpcv2.Config{
+			Log:              log,
+			Client:           workflow.NewWorkflowServiceClient(conn),
+			AgentID:          c.ID,
+			RetryInterval:    time.Duration(c.Transport.GRPC.RetryInterval) * time.Second,
+			MaxRetryInterval: time.Duration(c.Transport.GRPC.MaxRetryInterval) * time.Second,
+			Workflows:        make(chan spec.Workflow),
+			Cancel:           make(chan string),
 		}
 		eg.Go(func() error {
 			return readWriter.Start(ctx)
@@ -101,14 +153,65 @@ func main() {
 		tr = readWriter
 		tw = readWriter
 	case cmd.NATSTransportType:
+		files := tlsconfig.Files{
+			CA:         c.Transport.NATS.TLSCA,
+			Cert:       c.Transport.NATS.TLSCert,
+			Key:        c.Transport.NATS.TLSKey,
+			ServerName: c.Transport.NATS.TLSServerName,
+		}
+		var tlsCfg *tls.Config
+		if c.Transport.NATS.TLSEnabled || !files.Empty() {
+			var err error
+			if tlsCfg, err = files.Client(); err != nil {
+				log.Info("unable to create NATS TLS config", "error", err)
+				os.Exit(1)
+			}
+		}
 		readWriter := &nats.Config{
-			StreamName:     c.Transport.NATS.StreamName,
-			EventsSubject:  c.Transport.NATS.EventsSubject,
-			ActionsSubject: c.Transport.NATS.ActionsSubject,
-			IPPort:         netip.MustParseAddrPort(c.Transport.NATS.ServerAddrPort),
-			Log:            log,
-			AgentID:        c.ID,
-			Actions:        make(chan spec.Action),
+			StreamName:      c.Transport.NATS.StreamName,
+			EventsSubject:   c.Transport.NATS.EventsSubject,
+			ActionsSubject:  c.Transport.NATS.ActionsSubject,
+			LogsSubject:     c.Transport.NATS.LogsSubject,
+			IPPort:          netip.MustParseAddrPort(c.Transport.NATS.ServerAddrPort),
+			Log:             log,
+			AgentID:         c.ID,
+			Workflows:       make(chan spec.Workflow),
+			JetStream:       c.Transport.NATS.JetStream,
+			AckWait:         time.Duration(c.Transport.NATS.AckWait) * time.Second,
+			Encoding:        nats.Encoding(c.Transport.NATS.EventEncoding),
+			User:            c.Transport.NATS.User,
+			Password:        c.Transport.NATS.Password,
+			Token:           c.Transport.NATS.Token,
+			NKeySeedFile:    c.Transport.NATS.NKeySeedFile,
+			CredentialsFile: c.Transport.NATS.CredentialsFile,
+			TLS:             tlsCfg,
+		}
+		eg.Go(func() error {
+			return readWriter.Start(ctx)
+		})
+		tr = readWriter
+		tw = readWriter
+	case cmd.HTTPTransportType:
+		h := c.Transport.HTTP
+		tlsCfg, err := tlsconfig.Files{CA: h.TLSCA, Cert: h.TLSCert, Key: h.TLSKey, ServerName: h.TLSServerName, Insecure: h.TLSInsecure}.Client()
+		if err != nil {
+			log.Info("unable to create HTTP TLS config", "error", err)
+			os.Exit(1)
+		}
+		readWriter := &thttp.Config{
+			Log:              log,
+			AgentID:          c.ID,
+			WorkflowURL:      h.WorkflowURL,
+			EventsURL:        h.EventsURL,
+			PollInterval:     time.Duration(h.PollInterval) * time.Second,
+			LongPoll:         time.Duration(h.LongPoll) * time.Second,
+			Timeout:          time.Duration(h.Timeout) * time.Second,
+			Retries:          h.Retries,
+			RetryInterval:    time.Duration(h.RetryInterval) * time.Second,
+			MaxRetryInterval: time.Duration(h.MaxRetryInterval) * time.Second,
+			TLS:              tlsCfg,
+			Header:           h.Header,
+			Workflows:        make(chan spec.Workflow),
 		}
 		eg.Go(func() error {
 			return readWriter.Start(ctx)
@@ -134,8 +237,9 @@ func main() {
 		}
 		// TODO(jacobweinstock): handle auth
 		dockerExecutor := &docker.Config{
-			Client: dclient,
-			Log:    log,
+			Client:     dclient,
+			Log:        log,
+			ScratchDir: c.Runtime.ScratchDir,
 		}
 		re = dockerExecutor
 		log.Info("using Docker runtime")
@@ -152,17 +256,60 @@ func main() {
 			log.Info("unable to create containerd config", "error", err)
 			os.Exit(1)
 		}
+		cd.ScratchDir = c.Runtime.ScratchDir
 		re = cd
 		log.Info("using containerd runtime")
+	case cmd.ProcessRuntimeType:
+		re = &process.Config{
+			Log:        log,
+			WorkingDir: c.Runtime.Process.WorkingDir,
+			ScratchDir: c.Runtime.ScratchDir,
+		}
+		log.Info("using process runtime")
+	case cmd.OCIRuntimeType:
+		oc := &oci.Config{
+			Log:         log,
+			RuntimePath: c.Runtime.OCI.RuntimePath,
+			RuntimeRoot: c.Runtime.OCI.RuntimeRoot,
+			Root:        c.Runtime.OCI.Root,
+			ScratchDir:  c.Runtime.ScratchDir,
+		}
+		if c.Registry.User != "" {
+			oc.Auth = &authn.Basic{Username: c.Registry.User, Password: c.Registry.Pass}
+		}
+		re = oc
+		log.Info("using OCI runtime", "runtime", oc.RuntimePath)
+	case cmd.PodmanRuntimeType:
+		re = &podman.Config{
+			Log:        log,
+			Client:     podman.NewClient(c.Runtime.Podman.SocketPath),
+			ScratchDir: c.Runtime.ScratchDir,
+		}
+		log.Info("using podman runtime")
+	case cmd.WasmRuntimeType:
+		wc := &wasm.Config{
+			Log:        log,
+			ScratchDir: c.Runtime.ScratchDir,
+		}
+		if c.Registry.User != "" {
+			wc.Auth = &authn.Basic{Username: c.Registry.User, Password: c.Registry.Pass}
+		}
+		re = wc
+		log.Info("using wasm runtime")
 	default:
 		log.Info("no runtime selected, defaulting to Docker")
 		c.RuntimeSelected = cmd.DockerRuntimeType
 	}
 
 	a := &agent.Config{
-		TransportReader: tr,
-		RuntimeExecutor: re,
-		TransportWriter: tw,
+		TransportReader:      tr,
+		RuntimeExecutor:      re,
+		TransportWriter:      tw,
+		DefaultGlobalTimeout: time.Duration(c.GlobalTimeout) * time.Second,
+	}
+	if c.StateDir != "" {
+		a.StateStore = &statefile.Config{Dir: c.StateDir, Log: log}
+		log.Info("saving workflow progress", "dir", c.StateDir)
 	}
 
 	eg.Go(func() error {
@@ -173,3 +320,62 @@ func main() {
 	_ = eg.Wait()
 
 }
+
+// grpcClientConn returns a connection to the Tink server configured by g.
+func grpcClientConn(g cmd.GRPCTransport) (*ggrpc.ClientConn, error) {
+	files := tlsconfig.Files{CA: g.TLSCA, Cert: g.TLSCert, Key: g.TLSKey, ServerName: g.TLSServerName}
+	var tlsCfg *tls.Config
+	if g.TLSEnabled || !files.Empty() {
+		files.Insecure = g.TLSInsecure
+		var err error
+		if tlsCfg, err = files.Client(); err != nil {
+			return nil, err
+		}
+	}
+	var perRPC credentials.PerRPCCredentials
+	if g.Token != "" || g.TokenFile != "" {
+		// Sent without TLS the token could be read by anyone on the network, and every call would fail.
+		if tlsCfg == nil {
+			return nil, errors.New("a gRPC bearer token requires TLS to be enabled")
+		}
+		perRPC = &grpc.Token{Value: g.Token, File: g.TokenFile}
+	}
+
+	var opts []ggrpc.DialOption
+	if g.KeepaliveTime > 0 {
+		opts = append(opts, ggrpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:    time.Duration(g.KeepaliveTime) * time.Second,
+			Timeout: time.Duration(g.KeepaliveTimeout) * time.Second,
+			// The workflow context stream is not always open, the connection is kept alive between streams as well.
+			PermitWithoutStream: true,
+		}))
+	}
+
+	return grpc.NewClientConn(g.ServerAddrPort, tlsCfg, perRPC, opts...)
+}
+
+// runDevServer serves the workflows in the files of d until ctx is done.
+func runDevServer(ctx context.Context, log *slog.Logger, d *cmd.DevServer) error {
+	srv := &devserver.Config{Log: log, HardwareMap: d.HardwareMap}
+	var data [][]byte
+	for _, f := range d.Files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		data = append(data, b)
+	}
+	// Templates and the Workflows that refer to them may be in different files, so they are loaded together.
+	if err := srv.Load(bytes.Join(data, []byte("\n---\n"))); err != nil {
+		return err
+	}
+	for _, wf := range srv.Workflows() {
+		log.Info("loaded workflow", "workflowID", wf.ID, "actions", wf.Actions)
+	}
+	l, err := net.Listen("tcp", d.Addr)
+	if err != nil {
+		return err
+	}
+
+	return srv.Serve(ctx, l)
+}
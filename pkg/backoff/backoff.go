@@ -0,0 +1,51 @@
+// Package backoff has the delays used between attempts, by the transports to reach their servers and by the
+// agent to retry actions.
+package backoff
+
+import (
+	"context"
+	"time"
+
+	"github.com/jacobweinstock/tink-agent/pkg/rand"
+)
+
+// Or returns d, or def when d is not positive. A zero delay would have a transport retry in a tight loop.
+func Or(d, def time.Duration) time.Duration {
+	if d <= 0 {
+		return def
+	}
+	return d
+}
+
+// Jitter returns d give or take up to a fifth, so agents that lose their server at the same time do not all
+// retry at once.
+func Jitter(d time.Duration) time.Duration {
+	if j := int64(d) / 5; j > 0 {
+		d += time.Duration(rand.Int63nRange(-j, j+1))
+	}
+
+	return d
+}
+
+// Exponential returns the jittered delay after failures errors in a row. It starts at initial and doubles
+// with every failure up to limit.
+func Exponential(initial, limit time.Duration, failures int) time.Duration {
+	d := initial
+	for i := 1; i < failures && d < limit; i++ {
+		d *= 2
+	}
+
+	return Jitter(min(d, limit))
+}
+
+// Wait blocks for d, returning false if ctx is done first.
+func Wait(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
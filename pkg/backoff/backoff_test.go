@@ -0,0 +1,52 @@
+package backoff_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jacobweinstock/tink-agent/pkg/backoff"
+)
+
+func TestExponential(t *testing.T) {
+	tests := map[string]struct {
+		failures int
+		want     time.Duration
+	}{
+		"first failure":  {failures: 1, want: time.Second},
+		"third failure":  {failures: 3, want: 4 * time.Second},
+		"capped":         {failures: 10, want: 10 * time.Second},
+		"many failures":  {failures: 1000, want: 10 * time.Second},
+		"before failing": {failures: 0, want: time.Second},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := backoff.Exponential(time.Second, 10*time.Second, tt.failures)
+			if lo, hi := tt.want-tt.want/5, tt.want+tt.want/5; got < lo || got > hi {
+				t.Errorf("got %v, want between %v and %v", got, lo, hi)
+			}
+		})
+	}
+}
+
+func TestOr(t *testing.T) {
+	for _, d := range []time.Duration{0, -time.Second} {
+		if got := backoff.Or(d, time.Minute); got != time.Minute {
+			t.Errorf("got %v for %v, want the default", got, d)
+		}
+	}
+	if got := backoff.Or(time.Second, time.Minute); got != time.Second {
+		t.Errorf("got %v, want %v", got, time.Second)
+	}
+}
+
+func TestWait(t *testing.T) {
+	if !backoff.Wait(context.Background(), time.Millisecond) {
+		t.Error("wait returned false without the context being done")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if backoff.Wait(ctx, time.Hour) {
+		t.Error("wait returned true with the context done")
+	}
+}
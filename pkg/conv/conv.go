@@ -1,11 +1,16 @@
 package conv
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"regexp"
 
 	"github.com/jacobweinstock/tink-agent/pkg/rand"
 	"github.com/jacobweinstock/tink-agent/spec"
+	"gopkg.in/yaml.v3"
 )
 
 // ParseName converts an action ID into a usable container name.
@@ -28,3 +33,95 @@ func ParseEnv(envs []spec.Env) []string {
 	}
 	return de
 }
+
+// ParseWorkflow converts YAML or JSON data into a workflow.
+// For backwards compatibility the data can also be a list of actions, in which case
+// the workflow is given the ID defaultID.
+func ParseWorkflow(data []byte, defaultID string) (spec.Workflow, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return spec.Workflow{}, err
+	}
+
+	return decodeWorkflow(&doc, defaultID)
+}
+
+// ParseWorkflows converts data holding any number of workflows into workflows. YAML data is split into
+// documents with "---", JSON data can be a stream of values, such as one workflow per line.
+// Each document is parsed the same as ParseWorkflow, documents without a workflow ID are given defaultID
+// when there is only one and defaultID-1, defaultID-2, and so on, otherwise. Empty documents are skipped.
+func ParseWorkflows(data []byte, defaultID string) ([]spec.Workflow, error) {
+	var docs []*yaml.Node
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+		// YAML does not allow more than one JSON value in a document, so JSON values are split first.
+		dec := json.NewDecoder(bytes.NewReader(trimmed))
+		for {
+			var raw json.RawMessage
+			if err := dec.Decode(&raw); errors.Is(err, io.EOF) {
+				break
+			} else if err != nil {
+				return nil, fmt.Errorf("document %d: %w", len(docs)+1, err)
+			}
+			doc := &yaml.Node{}
+			if err := yaml.Unmarshal(raw, doc); err != nil {
+				return nil, fmt.Errorf("document %d: %w", len(docs)+1, err)
+			}
+			docs = append(docs, doc)
+		}
+	} else {
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		for {
+			doc := &yaml.Node{}
+			if err := dec.Decode(doc); errors.Is(err, io.EOF) {
+				break
+			} else if err != nil {
+				return nil, fmt.Errorf("document %d: %w", len(docs)+1, err)
+			}
+			if len(doc.Content) == 0 || doc.Content[0].Tag == "!!null" {
+				continue
+			}
+			docs = append(docs, doc)
+		}
+	}
+
+	wfs := make([]spec.Workflow, 0, len(docs))
+	ids := map[string]bool{}
+	for i, doc := range docs {
+		id := defaultID
+		if len(docs) > 1 {
+			id = fmt.Sprintf("%v-%d", defaultID, i+1)
+		}
+		wf, err := decodeWorkflow(doc, id)
+		if err != nil {
+			return nil, fmt.Errorf("document %d: %w", i+1, err)
+		}
+		if ids[wf.ID] {
+			return nil, fmt.Errorf("document %d: workflow ID %v is used more than once", i+1, wf.ID)
+		}
+		ids[wf.ID] = true
+		wfs = append(wfs, wf)
+	}
+
+	return wfs, nil
+}
+
+// decodeWorkflow converts a parsed YAML or JSON document into a workflow, see ParseWorkflow.
+func decodeWorkflow(doc *yaml.Node, defaultID string) (spec.Workflow, error) {
+	if len(doc.Content) > 0 && doc.Content[0].Kind == yaml.SequenceNode {
+		actions := []spec.Action{}
+		if err := doc.Decode(&actions); err != nil {
+			return spec.Workflow{}, err
+		}
+		return spec.Workflow{ID: defaultID, Actions: actions}, nil
+	}
+
+	wf := spec.Workflow{}
+	if err := doc.Decode(&wf); err != nil {
+		return spec.Workflow{}, err
+	}
+	if wf.ID == "" {
+		wf.ID = defaultID
+	}
+
+	return wf, nil
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package conv
+
+// ParseSignal returns the name of the signal that terminated a process with exitCode.
+// Exit codes are not mapped to signals on this platform, so an empty string is always returned.
+func ParseSignal(_ int) string {
+	return ""
+}
@@ -0,0 +1,19 @@
+//go:build unix
+
+package conv
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// ParseSignal returns the name of the signal that terminated a process with exitCode.
+// Container runtimes report a process killed by signal n with an exit code of 128+n.
+// An empty string is returned when exitCode does not represent a signal.
+func ParseSignal(exitCode int) string {
+	if exitCode <= 128 || exitCode > 128+64 {
+		return ""
+	}
+	return unix.SignalName(syscall.Signal(exitCode - 128))
+}
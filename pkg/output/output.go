@@ -0,0 +1,148 @@
+// Package output captures the stdout and stderr of actions line by line.
+package output
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jacobweinstock/tink-agent/spec"
+)
+
+const (
+	// DefaultMaxLines is the number of most recent lines a Capture keeps.
+	DefaultMaxLines = 500
+	// maxLineBytes is the longest line kept. Longer lines are split.
+	maxLineBytes = 64 * 1024
+)
+
+// Sink receives every line of output as it is captured.
+type Sink func(spec.LogLine)
+
+type sinkKey struct{}
+
+// WithSink returns a copy of ctx that carries s. Runtime executors send the output of actions to it.
+func WithSink(ctx context.Context, s Sink) context.Context {
+	return context.WithValue(ctx, sinkKey{}, s)
+}
+
+// SinkFrom returns the Sink carried by ctx, or nil if there is none.
+func SinkFrom(ctx context.Context) Sink {
+	s, _ := ctx.Value(sinkKey{}).(Sink)
+	return s
+}
+
+// Capture records the output of an action. It keeps the most recent lines in a ring buffer
+// and sends every line to a Sink.
+type Capture struct {
+	action spec.Action
+	sink   Sink
+
+	mu    sync.Mutex
+	lines []spec.LogLine
+	// next is the index in lines the next line is written to once the buffer is full.
+	next int
+	max  int
+}
+
+// New returns a Capture for action that keeps up to maxLines lines and sends every line
+// to the Sink carried by ctx, if any.
+func New(ctx context.Context, action spec.Action, maxLines int) *Capture {
+	if maxLines <= 0 {
+		maxLines = DefaultMaxLines
+	}
+	return &Capture{action: action, sink: SinkFrom(ctx), max: maxLines}
+}
+
+// Stdout returns a writer for the stdout stream of the action.
+// The writer must be closed to flush a trailing line without a newline.
+func (c *Capture) Stdout() *Writer {
+	return &Writer{capture: c, stream: spec.StreamStdout}
+}
+
+// Stderr returns a writer for the stderr stream of the action.
+// The writer must be closed to flush a trailing line without a newline.
+func (c *Capture) Stderr() *Writer {
+	return &Writer{capture: c, stream: spec.StreamStderr}
+}
+
+// Lines returns the most recent lines, oldest first.
+func (c *Capture) Lines() []spec.LogLine {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make([]spec.LogLine, 0, len(c.lines))
+	out = append(out, c.lines[c.next:]...)
+	return append(out, c.lines[:c.next]...)
+}
+
+func (c *Capture) add(stream spec.Stream, text string) {
+	l := spec.LogLine{
+		WorkflowID: c.action.WorkflowID,
+		ActionID:   c.action.ID,
+		ActionName: c.action.Name,
+		Stream:     stream,
+		Time:       time.Now().UTC(),
+		Text:       text,
+	}
+	c.mu.Lock()
+	if len(c.lines) < c.max {
+		c.lines = append(c.lines, l)
+	} else {
+		c.lines[c.next] = l
+		c.next = (c.next + 1) % c.max
+	}
+	c.mu.Unlock()
+
+	if c.sink != nil {
+		c.sink(l)
+	}
+}
+
+// Writer splits the output of a single stream into lines.
+type Writer struct {
+	capture *Capture
+	stream  spec.Stream
+
+	mu      sync.Mutex
+	partial []byte
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			w.partial = append(w.partial, p...)
+			for len(w.partial) >= maxLineBytes {
+				w.capture.add(w.stream, string(w.partial[:maxLineBytes]))
+				w.partial = w.partial[maxLineBytes:]
+			}
+			break
+		}
+		line := bytes.TrimSuffix(append(w.partial, p[:i]...), []byte("\r"))
+		w.partial = nil
+		for len(line) > maxLineBytes {
+			w.capture.add(w.stream, string(line[:maxLineBytes]))
+			line = line[maxLineBytes:]
+		}
+		w.capture.add(w.stream, string(line))
+		p = p[i+1:]
+	}
+
+	return n, nil
+}
+
+// Close flushes any trailing output that did not end with a newline.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.partial) > 0 {
+		w.capture.add(w.stream, string(w.partial))
+		w.partial = nil
+	}
+
+	return nil
+}
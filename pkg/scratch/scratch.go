@@ -0,0 +1,147 @@
+// Package scratch manages the directory that is shared with an action while it runs.
+// Actions use it to report why they failed and to provide outputs, by writing to well-known files.
+package scratch
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/jacobweinstock/tink-agent/spec"
+)
+
+const (
+	// MountPath is where the scratch directory is made available to an action.
+	MountPath = "/tinkerbell"
+	// EnvVar is the environment variable set for an action to the path of the scratch directory.
+	EnvVar = "TINKERBELL_DIR"
+	// ReasonFile contains an UpperCamelCase word or phrase concisely describing why the action failed.
+	ReasonFile = "failure-reason"
+	// MessageFile contains a human readable description of why the action failed.
+	MessageFile = "failure-message"
+	// OutputsFile contains KEY=VALUE lines of outputs from the action.
+	OutputsFile = "outputs"
+
+	maxReasonBytes  = 256
+	maxMessageBytes = 4096
+	maxOutputsBytes = 64 * 1024
+)
+
+var (
+	validName = regexp.MustCompile(`[^a-zA-Z0-9_.-]`)
+	// validReason matches an UpperCamelCase reason.
+	validReason = regexp.MustCompile(`^[A-Z][a-zA-Z0-9]*$`)
+)
+
+// Dir is the scratch directory of a single action execution.
+type Dir struct {
+	// Path is the location of the directory on the host.
+	Path string
+}
+
+// New creates a scratch directory for action in base.
+func New(base string, action spec.Action) (*Dir, error) {
+	parent := filepath.Join(base, validName.ReplaceAllString(action.WorkflowID, "_"))
+	if err := os.MkdirAll(parent, 0o700); err != nil {
+		return nil, fmt.Errorf("error creating scratch directory: %w", err)
+	}
+	p, err := os.MkdirTemp(parent, validName.ReplaceAllString(action.ID+"_"+action.Name, "_")+"-")
+	if err != nil {
+		return nil, fmt.Errorf("error creating scratch directory: %w", err)
+	}
+
+	return &Dir{Path: p}, nil
+}
+
+// Bind returns the bind mount, in SRC:DST form, of the directory at MountPath.
+func (d *Dir) Bind() string {
+	return d.Path + ":" + MountPath
+}
+
+// Env returns the environment variable, in KEY=VALUE form, that tells an action where the directory is mounted.
+func (d *Dir) Env() string {
+	return EnvVar + "=" + MountPath
+}
+
+// Remove deletes the directory and everything in it.
+func (d *Dir) Remove() error {
+	if d == nil {
+		return nil
+	}
+	return os.RemoveAll(d.Path)
+}
+
+// Apply sets the failure reason, message, and outputs the action wrote to the directory on res.
+// Values written by the action take precedence over those already set. It is a no-op when d is nil.
+func (d *Dir) Apply(res *spec.Result) error {
+	if d == nil {
+		return nil
+	}
+	var errs []error
+	reason, err := d.read(ReasonFile, maxReasonBytes)
+	errs = append(errs, err)
+	if reason = strings.TrimSpace(reason); reason != "" {
+		if validReason.MatchString(reason) {
+			res.Reason = reason
+		} else {
+			errs = append(errs, fmt.Errorf("ignoring failure reason %q, it must be UpperCamelCase", reason))
+		}
+	}
+
+	msg, err := d.read(MessageFile, maxMessageBytes)
+	errs = append(errs, err)
+	if msg = strings.TrimSpace(msg); msg != "" {
+		res.Message = msg
+	}
+
+	outputs, err := d.read(OutputsFile, maxOutputsBytes)
+	errs = append(errs, err)
+	if o := ParseOutputs(outputs); len(o) > 0 {
+		res.Outputs = o
+	}
+
+	return errors.Join(errs...)
+}
+
+// read returns the contents of name in the directory, up to limit bytes. A missing file is not an error.
+func (d *Dir) read(name string, limit int64) (string, error) {
+	f, err := os.Open(filepath.Join(d.Path, name))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", nil
+		}
+		return "", err
+	}
+	defer f.Close()
+	b := new(bytes.Buffer)
+	if _, err := b.ReadFrom(io.LimitReader(f, limit)); err != nil {
+		return "", err
+	}
+
+	return b.String(), nil
+}
+
+// ParseOutputs parses KEY=VALUE lines. Blank lines, lines starting with '#', and lines without a key are ignored.
+func ParseOutputs(s string) map[string]string {
+	out := map[string]string{}
+	sc := bufio.NewScanner(strings.NewReader(s))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		k, v, _ := strings.Cut(line, "=")
+		if k = strings.TrimSpace(k); k == "" {
+			continue
+		}
+		out[k] = v
+	}
+
+	return out
+}
@@ -0,0 +1,63 @@
+// Package tlsconfig builds the TLS configuration transports use to connect to their server from certificate files.
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Files are the files and settings a TLS client configuration is built from.
+type Files struct {
+	// CA is a PEM file of the certificate authorities the server certificate is verified with.
+	// The system certificate pool is used when empty.
+	CA string
+	// Cert and Key are PEM files of the certificate and private key the client authenticates with, for mutual TLS.
+	// Both or neither must be set.
+	Cert string
+	Key  string
+	// ServerName is the name the server certificate is verified against. The host connected to is used when empty.
+	ServerName string
+	// Insecure skips verifying the server certificate.
+	Insecure bool
+}
+
+// Client returns the TLS client configuration f describes.
+func (f Files) Client() (*tls.Config, error) {
+	// #nosec G402 -- InsecureSkipVerify is only set when asked for.
+	cfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         f.ServerName,
+		InsecureSkipVerify: f.Insecure,
+	}
+	if f.CA != "" {
+		pem, err := os.ReadFile(f.CA)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %v", f.CA)
+		}
+		cfg.RootCAs = pool
+	}
+	if (f.Cert == "") != (f.Key == "") {
+		return nil, errors.New("a client certificate and key must be set together")
+	}
+	if f.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(f.Cert, f.Key)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
+
+// Empty reports whether f has nothing set, in which case TLS is not asked for.
+func (f Files) Empty() bool {
+	return f == Files{}
+}
@@ -0,0 +1,50 @@
+package tlsconfig_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jacobweinstock/tink-agent/pkg/tlsconfig"
+	"github.com/jacobweinstock/tink-agent/pkg/tlsconfig/tlsconfigtest"
+)
+
+func TestClient(t *testing.T) {
+	certs := tlsconfigtest.Generate(t)
+	notPEM := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]struct {
+		files     tlsconfig.Files
+		wantErr   bool
+		wantRoots bool
+		wantCerts int
+	}{
+		"system roots":       {files: tlsconfig.Files{}},
+		"CA":                 {files: tlsconfig.Files{CA: certs.CA}, wantRoots: true},
+		"client certificate": {files: tlsconfig.Files{CA: certs.CA, Cert: certs.ClientCert, Key: certs.ClientKey}, wantRoots: true, wantCerts: 1},
+		"missing CA":         {files: tlsconfig.Files{CA: filepath.Join(t.TempDir(), "missing.pem")}, wantErr: true},
+		"CA is not PEM":      {files: tlsconfig.Files{CA: notPEM}, wantErr: true},
+		"cert without key":   {files: tlsconfig.Files{Cert: certs.ClientCert}, wantErr: true},
+		"key without cert":   {files: tlsconfig.Files{Key: certs.ClientKey}, wantErr: true},
+		"mismatched key":     {files: tlsconfig.Files{Cert: certs.ClientCert, Key: certs.ServerKey}, wantErr: true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			cfg, err := tt.files.Client()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if (cfg.RootCAs != nil) != tt.wantRoots {
+				t.Errorf("got root CAs %v, want them set %v", cfg.RootCAs != nil, tt.wantRoots)
+			}
+			if len(cfg.Certificates) != tt.wantCerts {
+				t.Errorf("got %d client certificates, want %d", len(cfg.Certificates), tt.wantCerts)
+			}
+		})
+	}
+}
@@ -4,15 +4,21 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"syscall"
+	"time"
 
 	"github.com/containerd/containerd"
+	apievents "github.com/containerd/containerd/api/events"
 	"github.com/containerd/containerd/cio"
 	"github.com/containerd/containerd/namespaces"
 	"github.com/containerd/containerd/oci"
 	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/typeurl/v2"
 	"github.com/containers/image/v5/pkg/shortnames"
 	"github.com/containers/image/v5/types"
 	"github.com/jacobweinstock/tink-agent/pkg/conv"
+	"github.com/jacobweinstock/tink-agent/pkg/output"
+	"github.com/jacobweinstock/tink-agent/pkg/scratch"
 	"github.com/jacobweinstock/tink-agent/spec"
 	"github.com/opencontainers/runtime-spec/specs-go"
 )
@@ -22,9 +28,15 @@ type Config struct {
 	Client     *containerd.Client
 	Log        *slog.Logger
 	SocketPath string
+	// MaxOutputLines is the number of most recent lines of action output kept. Defaults to output.DefaultMaxLines.
+	MaxOutputLines int
+	// ScratchDir is the directory in which a scratch directory is created for each action and mounted at
+	// scratch.MountPath. Actions do not get a scratch directory when empty.
+	ScratchDir string
 }
 
-func (c *Config) Execute(ctx context.Context, a spec.Action) error {
+func (c *Config) Execute(ctx context.Context, a spec.Action) (spec.Result, error) {
+	res := spec.Result{ExitCode: -1}
 	ctx = namespaces.WithNamespace(ctx, c.Namespace)
 	// Pull the image
 	imageName := a.Image
@@ -42,45 +54,145 @@ func (c *Config) Execute(ctx context.Context, a spec.Action) error {
 		// if the image isn't already in our namespaced context, then pull it
 		image, err = c.Client.Pull(ctx, imageName, containerd.WithPullUnpack, containerd.WithResolver(docker.NewResolver(docker.ResolverOptions{})))
 		if err != nil {
-			return fmt.Errorf("error pulling image: %w", err)
+			return res, fmt.Errorf("%w: %w", spec.ErrImagePull, err)
 		}
 		c.Log.Info("image pulled", "image", image.Name())
 	}
 
+	var sd *scratch.Dir
+	var extra []oci.SpecOpts
+	if c.ScratchDir != "" {
+		if sd, err = scratch.New(c.ScratchDir, a); err != nil {
+			return res, err
+		}
+		defer func() { _ = sd.Remove() }()
+		extra = append(extra,
+			oci.WithMounts([]specs.Mount{{Type: "bind", Source: sd.Path, Destination: scratch.MountPath, Options: []string{"rbind", "rw"}}}),
+			oci.WithEnv([]string{sd.Env()}),
+		)
+	}
+
 	// create a container
-	tainer, err := c.createContainer(ctx, image, a)
+	tainer, err := c.createContainer(ctx, image, a, extra...)
 	if err != nil {
-		return fmt.Errorf("error creating container: %w", err)
+		return res, fmt.Errorf("error creating container: %w", err)
 	}
-	defer func() { _ = tainer.Delete(ctx, containerd.WithSnapshotCleanup) }()
+	// Clean up even if ctx has been cancelled.
+	cleanupCtx := context.WithoutCancel(ctx)
+	defer func() { _ = tainer.Delete(cleanupCtx, containerd.WithSnapshotCleanup) }()
 
-	// create the task
-	task, err := tainer.NewTask(ctx, cio.NewCreator(cio.WithStdio))
+	// create the task, capturing its output
+	capture := output.New(ctx, a, c.MaxOutputLines)
+	stdout, stderr := capture.Stdout(), capture.Stderr()
+	defer func() { _ = stdout.Close() }()
+	defer func() { _ = stderr.Close() }()
+	task, err := tainer.NewTask(ctx, cio.NewCreator(cio.WithStreams(nil, stdout, stderr)))
 	if err != nil {
-		return fmt.Errorf("error creating task: %w", err)
+		return res, fmt.Errorf("error creating task: %w", err)
 	}
-	defer func() { _, _ = task.Delete(ctx) }()
+	defer func() { _, _ = task.Delete(cleanupCtx) }()
 
+	oomCtx, oomDone := context.WithCancel(ctx)
+	defer oomDone()
+	oom := c.watchOOM(oomCtx, tainer.ID())
+
+	// The wait is not tied to ctx so that the exit status is still received after the task is killed.
 	var statusC <-chan containerd.ExitStatus
-	statusC, err = task.Wait(ctx)
+	statusC, err = task.Wait(cleanupCtx)
 	if err != nil {
-		return fmt.Errorf("error waiting on task: %w", err)
+		return res, fmt.Errorf("error waiting on task: %w", err)
 	}
 
 	// start the task
+	res.Started = time.Now()
 	if err := task.Start(ctx); err != nil {
-		_, _ = task.Delete(ctx)
-		return fmt.Errorf("error starting task: %w", err)
+		return res, fmt.Errorf("error starting task: %w", err)
+	}
+
+	var exitStatus containerd.ExitStatus
+	select {
+	case exitStatus = <-statusC:
+	case <-ctx.Done():
+		exitStatus = c.stop(cleanupCtx, task, statusC)
+	}
+	res.Finished = time.Now()
+	// Wait for the remaining output to be copied.
+	if tio := task.IO(); tio != nil {
+		tio.Wait()
+	}
+	res.Output = capture.Lines()
+	res.ExitCode = int(exitStatus.ExitCode())
+	res.Signal = conv.ParseSignal(res.ExitCode)
+	select {
+	case <-oom:
+		res.OOMKilled = true
+		res.Reason = "OOMKilled"
+	default:
+	}
+	if err := sd.Apply(&res); err != nil {
+		c.Log.Info("error reading action scratch directory", "error", err)
 	}
 
-	exitStatus := <-statusC
+	if ctx.Err() != nil {
+		return res, fmt.Errorf("context error: %w", ctx.Err())
+	}
+	if err := exitStatus.Error(); err != nil {
+		return res, fmt.Errorf("error waiting on task: %w", err)
+	}
 	if exitStatus.ExitCode() != 0 {
-		return fmt.Errorf("task exited with non-zero code: %d, error: %w", exitStatus.ExitCode(), exitStatus.Error())
+		return res, fmt.Errorf("%w %d, see the logs for more information", spec.ErrNonZeroExit, exitStatus.ExitCode())
+	}
+	return res, nil
+}
+
+// stop kills task, first with SIGTERM and then SIGKILL if it has not exited after 5 seconds,
+// and returns its exit status.
+func (c *Config) stop(ctx context.Context, task containerd.Task, statusC <-chan containerd.ExitStatus) containerd.ExitStatus {
+	if err := task.Kill(ctx, syscall.SIGTERM); err != nil {
+		c.Log.Info("Failed to gracefully stop task", "error", err)
+	}
+	select {
+	case s := <-statusC:
+		return s
+	case <-time.After(5 * time.Second):
 	}
-	return nil
+	if err := task.Kill(ctx, syscall.SIGKILL); err != nil {
+		c.Log.Info("Failed to kill task", "error", err)
+	}
+	return <-statusC
+}
+
+// watchOOM returns a channel that is closed if the container with id is killed because it ran out of memory.
+func (c *Config) watchOOM(ctx context.Context, id string) <-chan struct{} {
+	oom := make(chan struct{})
+	envelopes, errs := c.Client.EventService().Subscribe(ctx, `topic=="/tasks/oom"`)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-errs:
+				return
+			case e := <-envelopes:
+				if e == nil || e.Event == nil {
+					continue
+				}
+				v, err := typeurl.UnmarshalAny(e.Event)
+				if err != nil {
+					continue
+				}
+				if ev, ok := v.(*apievents.TaskOOM); ok && ev.ContainerID == id {
+					close(oom)
+					return
+				}
+			}
+		}
+	}()
+
+	return oom
 }
 
-func (c *Config) createContainer(ctx context.Context, image containerd.Image, action spec.Action) (containerd.Container, error) {
+func (c *Config) createContainer(ctx context.Context, image containerd.Image, action spec.Action, extra ...oci.SpecOpts) (containerd.Container, error) {
 	newOpts := []containerd.NewContainerOpts{}
 	args := []string{action.Cmd}
 	args = append(args, action.Args...)
@@ -93,6 +205,7 @@ func (c *Config) createContainer(ctx context.Context, image containerd.Image, ac
 	if action.Namespaces.PID == "host" {
 		specOpts = append(specOpts, oci.WithHostNamespace(specs.PIDNamespace))
 	}
+	specOpts = append(specOpts, extra...)
 	name := conv.ParseName(action.ID, action.Name)
 	newOpts = append(newOpts, containerd.WithNewSnapshot(name, image))
 	newOpts = append(newOpts, containerd.WithNewSpec(specOpts...))
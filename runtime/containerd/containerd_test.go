@@ -0,0 +1,39 @@
+package containerd_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/jacobweinstock/tink-agent/agent/agenttest"
+	"github.com/jacobweinstock/tink-agent/runtime/containerd"
+	"github.com/jacobweinstock/tink-agent/spec"
+)
+
+// socket is the containerd socket the tests run against.
+const socket = "/run/containerd/containerd.sock"
+
+func TestRuntime(t *testing.T) {
+	if _, err := os.Stat(socket); err != nil {
+		t.Skipf("containerd is not available: %v", err)
+	}
+	agenttest.TestRuntime(t, func(t *testing.T) agenttest.Runtime {
+		c, err := containerd.NewConfig(agenttest.Logger(t), containerd.WithNamespace("tink-agent-test"), containerd.WithSocketPath(socket))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = c.Client.Close() })
+		c.ScratchDir = t.TempDir()
+		sh := func(id, script string) spec.Action {
+			return spec.Action{ID: id, WorkflowID: "wf1", Name: id, Image: "docker.io/library/busybox:1.36", Cmd: "/bin/sh", Args: []string{"-c", script}}
+		}
+
+		return agenttest.Runtime{
+			Executor:        c,
+			Success:         sh("success", "echo hello"),
+			Output:          "hello",
+			Failure:         sh("failure", "exit 3"),
+			FailureExitCode: 3,
+			Block:           sh("block", "while true; do sleep 1; done"),
+		}
+	})
+}
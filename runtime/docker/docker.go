@@ -15,7 +15,10 @@ import (
 	"github.com/docker/docker/api/types/image"
 	"github.com/docker/docker/api/types/registry"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/jacobweinstock/tink-agent/pkg/conv"
+	"github.com/jacobweinstock/tink-agent/pkg/output"
+	"github.com/jacobweinstock/tink-agent/pkg/scratch"
 	"github.com/jacobweinstock/tink-agent/spec"
 )
 
@@ -23,9 +26,16 @@ type Config struct {
 	Log          *slog.Logger
 	Client       *client.Client
 	RegistryAuth *registry.AuthConfig
+	// MaxOutputLines is the number of most recent lines of action output kept. Defaults to output.DefaultMaxLines.
+	MaxOutputLines int
+	// ScratchDir is the directory in which a scratch directory is created for each action and mounted at
+	// scratch.MountPath. It must be at the same path for the agent and the Docker daemon.
+	// Actions do not get a scratch directory when empty.
+	ScratchDir string
 }
 
-func (c *Config) Execute(ctx context.Context, a spec.Action) error {
+func (c *Config) Execute(ctx context.Context, a spec.Action) (spec.Result, error) {
+	res := spec.Result{ExitCode: -1}
 	pullImage := func() error {
 		pullOpts := image.PullOptions{}
 
@@ -61,7 +71,7 @@ func (c *Config) Execute(ctx context.Context, a spec.Action) error {
 
 	err := retry.Do(pullImage, retry.Attempts(5), retry.DelayType(retry.BackOffDelay))
 	if err != nil {
-		return err
+		return res, fmt.Errorf("%w: %w", spec.ErrImagePull, err)
 	}
 
 	// TODO: Support all the other things on the action such as volumes.
@@ -83,6 +93,16 @@ func (c *Config) Execute(ctx context.Context, a spec.Action) error {
 
 	containerName := conv.ParseName(a.ID, a.Name)
 
+	var sd *scratch.Dir
+	if c.ScratchDir != "" {
+		if sd, err = scratch.New(c.ScratchDir, a); err != nil {
+			return res, err
+		}
+		defer func() { _ = sd.Remove() }()
+		hostCfg.Binds = append(hostCfg.Binds, sd.Bind())
+		cfg.Env = append(cfg.Env, sd.Env())
+	}
+
 	// Docker uses the entrypoint as the default command. The Tink Action Cmd property is modeled
 	// as being the command launched in the container hence it is used as the entrypoint. Args
 	// on the action are therefore the command portion in Docker.
@@ -93,11 +113,9 @@ func (c *Config) Execute(ctx context.Context, a spec.Action) error {
 		cfg.Cmd = append(cfg.Cmd, a.Args...)
 	}
 
-	// TODO: Figure out container logging. We probably want to save it somewhere for debug-ability.
-
 	create, err := c.Client.ContainerCreate(ctx, &cfg, &hostCfg, nil, nil, containerName)
 	if err != nil {
-		return fmt.Errorf("error creating container: %w", err)
+		return res, fmt.Errorf("error creating container: %w", err)
 	}
 
 	// Always try to remove the container on exit.
@@ -117,32 +135,88 @@ func (c *Config) Execute(ctx context.Context, a spec.Action) error {
 		}
 	}()
 
+	// Attach before starting the container so that no output is missed.
+	capture := output.New(ctx, a, c.MaxOutputLines)
+	attach, err := c.Client.ContainerAttach(ctx, create.ID, container.AttachOptions{Stream: true, Stdout: true, Stderr: true})
+	if err != nil {
+		return res, fmt.Errorf("error attaching to container: %w", err)
+	}
+	defer attach.Close()
+	outputDone := make(chan struct{})
+	go func() {
+		defer close(outputDone)
+		stdout, stderr := capture.Stdout(), capture.Stderr()
+		defer func() { _ = stdout.Close() }()
+		defer func() { _ = stderr.Close() }()
+		// The container is created without a TTY so stdout and stderr are multiplexed.
+		if _, err := stdcopy.StdCopy(stdout, stderr, attach.Reader); err != nil {
+			c.Log.Debug("error reading container output", "container_name", containerName, "error", err)
+		}
+	}()
+	// Wait for the remaining output to be read once the container has exited.
+	waitOutput := func() {
+		select {
+		case <-outputDone:
+		case <-time.After(5 * time.Second):
+		}
+		res.Output = capture.Lines()
+	}
+
 	// Issue the wait with a 'next-exit' condition so we can await a response originating from
 	// ContainerStart().
 	waitBody, waitErr := c.Client.ContainerWait(ctx, create.ID, container.WaitConditionNextExit)
 
+	res.Started = time.Now()
 	if err := c.Client.ContainerStart(ctx, create.ID, container.StartOptions{}); err != nil {
-		return fmt.Errorf("error starting container: %w", err)
+		return res, fmt.Errorf("error starting container: %w", err)
+	}
+
+	// stop stops the container once ctx is done.
+	stop := func() (spec.Result, error) {
+		// We can't use the context passed to Run() as its been cancelled.
+		err := c.Client.ContainerStop(context.Background(), create.ID, container.StopOptions{
+			Timeout: ptr.Int(5),
+		})
+		if err != nil {
+			c.Log.Info("Failed to gracefully stop container", "error", err)
+		}
+		res.Finished = time.Now()
+		waitOutput()
+		if err := sd.Apply(&res); err != nil {
+			c.Log.Info("error reading action scratch directory", "container_name", containerName, "error", err)
+		}
+		return res, fmt.Errorf("context error: %w", ctx.Err())
 	}
 
 	select {
 	case result := <-waitBody:
+		res.Finished = time.Now()
+		waitOutput()
+		res.ExitCode = int(result.StatusCode)
+		res.Signal = conv.ParseSignal(res.ExitCode)
+		if info, err := c.Client.ContainerInspect(context.WithoutCancel(ctx), create.ID); err == nil && info.State != nil {
+			res.OOMKilled = info.State.OOMKilled
+		}
+		if res.OOMKilled {
+			res.Reason = "OOMKilled"
+		}
+		if err := sd.Apply(&res); err != nil {
+			c.Log.Info("error reading action scratch directory", "container_name", containerName, "error", err)
+		}
 		if result.StatusCode == 0 {
-			return nil
+			return res, nil
 		}
-		return fmt.Errorf("got non 0 exit status, see the logs for more information")
+		return res, fmt.Errorf("%w %v, see the logs for more information", spec.ErrNonZeroExit, result.StatusCode)
 
 	case err := <-waitErr:
-		return fmt.Errorf("error while waiting for container: %w", err)
+		// The wait is also ended by ctx, in which case the container is still running.
+		if ctx.Err() != nil {
+			return stop()
+		}
+		res.Finished = time.Now()
+		return res, fmt.Errorf("error while waiting for container: %w", err)
 
 	case <-ctx.Done():
-		// We can't use the context passed to Run() as its been cancelled.
-		err := c.Client.ContainerStop(context.Background(), create.ID, container.StopOptions{
-			Timeout: ptr.Int(5),
-		})
-		if err != nil {
-			c.Log.Info("Failed to gracefully stop container", "error", err)
-		}
-		return fmt.Errorf("context error: %w", ctx.Err())
+		return stop()
 	}
 }
@@ -0,0 +1,155 @@
+package docker_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/jacobweinstock/tink-agent/agent/agenttest"
+	"github.com/jacobweinstock/tink-agent/runtime/docker"
+	"github.com/jacobweinstock/tink-agent/spec"
+)
+
+func TestRuntime(t *testing.T) {
+	agenttest.TestRuntime(t, func(t *testing.T) agenttest.Runtime {
+		d := &daemon{containers: map[string]*fakeContainer{}}
+		srv := httptest.NewServer(d.handler())
+		t.Cleanup(srv.Close)
+		cl, err := client.NewClientWithOpts(client.WithHost("tcp://"+srv.Listener.Addr().String()), client.WithVersion("1.45"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = cl.Close() })
+
+		return agenttest.Runtime{
+			Executor:        &docker.Config{Log: agenttest.Logger(t), Client: cl, ScratchDir: t.TempDir()},
+			Success:         spec.Action{ID: "a1", WorkflowID: "wf1", Name: "success", Image: "success"},
+			Output:          "hello",
+			Failure:         spec.Action{ID: "a2", WorkflowID: "wf1", Name: "failure", Image: "failure"},
+			FailureExitCode: 3,
+			Block:           spec.Action{ID: "a3", WorkflowID: "wf1", Name: "block", Image: "block"},
+		}
+	})
+}
+
+// daemon is a fake of the parts of the Docker Engine API used by the runtime. Containers run
+// according to their image: "success" writes hello to stdout and exits 0, "failure" exits 3, and
+// "block" runs until stopped.
+type daemon struct {
+	mu         sync.Mutex
+	containers map[string]*fakeContainer
+}
+
+type fakeContainer struct {
+	image string
+	// attached is closed once the output stream is attached.
+	attached chan struct{}
+	out      net.Conn
+	stop     chan struct{}
+	stopOnce sync.Once
+	// exited is closed once exitCode is set.
+	exited   chan struct{}
+	exitCode int
+}
+
+func (d *daemon) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /{version}/images/create", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = fmt.Fprintln(w, `{"status":"Downloaded newer image"}`)
+	})
+	mux.HandleFunc("POST /{version}/containers/create", func(w http.ResponseWriter, r *http.Request) {
+		var cfg container.Config
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		id := r.URL.Query().Get("name")
+		d.mu.Lock()
+		d.containers[id] = &fakeContainer{image: cfg.Image, attached: make(chan struct{}), stop: make(chan struct{}), exited: make(chan struct{})}
+		d.mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(container.CreateResponse{ID: id})
+	})
+	mux.HandleFunc("POST /{version}/containers/{id}/attach", d.withContainer(func(w http.ResponseWriter, _ *http.Request, c *fakeContainer) {
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		_, _ = buf.WriteString("HTTP/1.1 101 UPGRADED\r\nContent-Type: application/vnd.docker.raw-stream\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n")
+		_ = buf.Flush()
+		c.out = conn
+		close(c.attached)
+	}))
+	mux.HandleFunc("POST /{version}/containers/{id}/wait", d.withContainer(func(w http.ResponseWriter, r *http.Request, c *fakeContainer) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+		case <-c.exited:
+			_ = json.NewEncoder(w).Encode(container.WaitResponse{StatusCode: int64(c.exitCode)})
+		}
+	}))
+	mux.HandleFunc("POST /{version}/containers/{id}/start", d.withContainer(func(w http.ResponseWriter, _ *http.Request, c *fakeContainer) {
+		go c.run()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	mux.HandleFunc("POST /{version}/containers/{id}/stop", d.withContainer(func(w http.ResponseWriter, _ *http.Request, c *fakeContainer) {
+		c.stopOnce.Do(func() { close(c.stop) })
+		<-c.exited
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	mux.HandleFunc("GET /{version}/containers/{id}/json", d.withContainer(func(w http.ResponseWriter, _ *http.Request, _ *fakeContainer) {
+		_ = json.NewEncoder(w).Encode(map[string]any{"State": map[string]any{"OOMKilled": false}})
+	}))
+	mux.HandleFunc("DELETE /{version}/containers/{id}", func(w http.ResponseWriter, r *http.Request) {
+		d.mu.Lock()
+		c := d.containers[r.PathValue("id")]
+		delete(d.containers, r.PathValue("id"))
+		d.mu.Unlock()
+		if c != nil {
+			c.stopOnce.Do(func() { close(c.stop) })
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	return mux
+}
+
+func (d *daemon) withContainer(h func(http.ResponseWriter, *http.Request, *fakeContainer)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		d.mu.Lock()
+		c, ok := d.containers[r.PathValue("id")]
+		d.mu.Unlock()
+		if !ok {
+			http.Error(w, `{"message":"no such container"}`, http.StatusNotFound)
+			return
+		}
+		h(w, r, c)
+	}
+}
+
+// run runs the container until it exits or is stopped, then closes its output stream.
+func (c *fakeContainer) run() {
+	<-c.attached
+	defer func() { _ = c.out.Close() }()
+	defer close(c.exited)
+	switch c.image {
+	case "success":
+		w := bufio.NewWriter(stdcopy.NewStdWriter(c.out, stdcopy.Stdout))
+		_, _ = w.WriteString("hello\n")
+		_ = w.Flush()
+	case "failure":
+		c.exitCode = 3
+	default:
+		<-c.stop
+		c.exitCode = 143
+	}
+}
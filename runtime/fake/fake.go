@@ -0,0 +1,107 @@
+// Package fake is an in-memory runtime with scriptable outcomes, for testing.
+package fake
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jacobweinstock/tink-agent/pkg/output"
+	"github.com/jacobweinstock/tink-agent/spec"
+)
+
+// Outcome is the scripted result of a single attempt to execute an action.
+// The zero value succeeds immediately.
+type Outcome struct {
+	// ExitCode is the exit status of the action. A non-zero value fails the action with spec.ErrNonZeroExit.
+	ExitCode int
+	// Delay is how long the action runs for. The action is stopped early if its context is done.
+	Delay time.Duration
+	// Block runs the action until its context is done, as if it never completes.
+	Block bool
+	// Panic makes Execute panic with this value when it is not nil.
+	Panic any
+	// Err is returned by Execute, after Delay, when it is not nil.
+	Err error
+	// Output is written to stdout, one line per element.
+	Output []string
+	// Reason, Message, and Outputs are set on the result, as if reported by the action.
+	Reason  string
+	Message string
+	Outputs map[string]string
+}
+
+// Config is a runtime executor that returns scripted outcomes instead of running actions.
+type Config struct {
+	// Outcomes are the outcomes of each attempt to execute an action, keyed by action ID.
+	// The last outcome is repeated for any further attempts.
+	Outcomes map[string][]Outcome
+	// Default is the outcome of actions without any Outcomes.
+	Default Outcome
+
+	mu    sync.Mutex
+	calls []spec.Action
+}
+
+func (c *Config) Execute(ctx context.Context, a spec.Action) (spec.Result, error) {
+	c.mu.Lock()
+	attempt := 0
+	for _, call := range c.calls {
+		if call.WorkflowID == a.WorkflowID && call.ID == a.ID {
+			attempt++
+		}
+	}
+	c.calls = append(c.calls, a)
+	o := c.Default
+	if outcomes := c.Outcomes[a.ID]; len(outcomes) > 0 {
+		o = outcomes[min(attempt, len(outcomes)-1)]
+	}
+	c.mu.Unlock()
+
+	if o.Panic != nil {
+		panic(o.Panic)
+	}
+
+	res := spec.Result{ExitCode: -1, Started: time.Now()}
+	capture := output.New(ctx, a, 0)
+	stdout := capture.Stdout()
+	for _, l := range o.Output {
+		_, _ = stdout.Write([]byte(l + "\n"))
+	}
+	_ = stdout.Close()
+
+	var done <-chan time.Time
+	if !o.Block {
+		t := time.NewTimer(o.Delay)
+		defer t.Stop()
+		done = t.C
+	}
+	select {
+	case <-ctx.Done():
+		res.Finished = time.Now()
+		res.Output = capture.Lines()
+		return res, fmt.Errorf("context error: %w", ctx.Err())
+	case <-done:
+	}
+	res.Finished = time.Now()
+	res.Output = capture.Lines()
+	res.Reason, res.Message, res.Outputs = o.Reason, o.Message, o.Outputs
+	if o.Err != nil {
+		return res, o.Err
+	}
+	res.ExitCode = o.ExitCode
+	if o.ExitCode != 0 {
+		return res, fmt.Errorf("%w %d", spec.ErrNonZeroExit, o.ExitCode)
+	}
+
+	return res, nil
+}
+
+// Calls returns every action Execute was called with, in order.
+func (c *Config) Calls() []spec.Action {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]spec.Action(nil), c.calls...)
+}
@@ -0,0 +1,26 @@
+package fake_test
+
+import (
+	"testing"
+
+	"github.com/jacobweinstock/tink-agent/agent/agenttest"
+	"github.com/jacobweinstock/tink-agent/runtime/fake"
+	"github.com/jacobweinstock/tink-agent/spec"
+)
+
+func TestRuntime(t *testing.T) {
+	agenttest.TestRuntime(t, func(*testing.T) agenttest.Runtime {
+		return agenttest.Runtime{
+			Executor: &fake.Config{Outcomes: map[string][]fake.Outcome{
+				"success": {{Output: []string{"hello"}}},
+				"failure": {{ExitCode: 3}},
+				"block":   {{Block: true}},
+			}},
+			Success:         spec.Action{ID: "success", Name: "success"},
+			Output:          "hello",
+			Failure:         spec.Action{ID: "failure", Name: "failure"},
+			FailureExitCode: 3,
+			Block:           spec.Action{ID: "block", Name: "block"},
+		}
+	})
+}
@@ -0,0 +1,138 @@
+//go:build linux
+
+package oci
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	retry "github.com/avast/retry-go"
+	"github.com/containerd/containerd/archive"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/jacobweinstock/tink-agent/spec"
+)
+
+const (
+	imageRootfs = "rootfs"
+	imageConfig = "config.json"
+)
+
+// image returns the directory image is unpacked in and its configuration, pulling and unpacking it first
+// if it is not already. A previously unpacked image is used if the registry cannot be reached.
+func (c *Config) image(ctx context.Context, image string) (string, *v1.ConfigFile, error) {
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: %w", spec.ErrImagePull, err)
+	}
+	refFile := filepath.Join(c.root(), "refs", url.PathEscape(ref.Name()))
+
+	opts := []remote.Option{
+		remote.WithContext(ctx),
+		remote.WithPlatform(v1.Platform{OS: "linux", Architecture: runtime.GOARCH}),
+	}
+	if c.Auth != nil {
+		opts = append(opts, remote.WithAuth(c.Auth))
+	}
+	var img v1.Image
+	pull := func() error {
+		var err error
+		img, err = remote.Image(ref, opts...)
+		return err
+	}
+	if err := retry.Do(pull, retry.Attempts(5), retry.DelayType(retry.BackOffDelay), retry.Context(ctx)); err != nil {
+		// The image might already be unpacked and the environment not have access to the registry.
+		if digest, rerr := os.ReadFile(refFile); rerr == nil {
+			dir := filepath.Join(c.root(), "images", strings.TrimSpace(string(digest)))
+			if cfg, cerr := readImageConfig(dir); cerr == nil {
+				c.Log.Info("unable to pull image, using the previously unpacked image", "image", image, "error", err)
+				return dir, cfg, nil
+			}
+		}
+		return "", nil, fmt.Errorf("%w: %w", spec.ErrImagePull, err)
+	}
+
+	digest, err := img.Digest()
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: %w", spec.ErrImagePull, err)
+	}
+	dir := filepath.Join(c.root(), "images", digest.Hex)
+	cfg, err := readImageConfig(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		if err = c.unpack(ctx, img, dir); err == nil {
+			cfg, err = readImageConfig(dir)
+		}
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: %w", spec.ErrImagePull, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(refFile), 0o700); err == nil {
+		_ = os.WriteFile(refFile, []byte(digest.Hex), 0o600)
+	}
+
+	return dir, cfg, nil
+}
+
+// unpack applies the layers of img, in order, to a root filesystem in dir.
+// dir is only created once the image is fully unpacked.
+func (c *Config) unpack(ctx context.Context, img v1.Image, dir string) error {
+	if err := os.MkdirAll(filepath.Dir(dir), 0o700); err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp(filepath.Dir(dir), ".unpack-")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.RemoveAll(tmp) }()
+
+	rootfs := filepath.Join(tmp, imageRootfs)
+	if err := os.Mkdir(rootfs, 0o755); err != nil {
+		return err
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		return err
+	}
+	for _, l := range layers {
+		rc, err := l.Uncompressed()
+		if err != nil {
+			return err
+		}
+		_, err = archive.Apply(ctx, rootfs, rc)
+		_ = rc.Close()
+		if err != nil {
+			return fmt.Errorf("error applying layer: %w", err)
+		}
+	}
+	cfg, err := img.RawConfigFile()
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(tmp, imageConfig), cfg, 0o600); err != nil {
+		return err
+	}
+	c.Log.Info("image unpacked", "dir", dir, "layers", len(layers))
+
+	return os.Rename(tmp, dir)
+}
+
+func readImageConfig(dir string) (*v1.ConfigFile, error) {
+	b, err := os.ReadFile(filepath.Join(dir, imageConfig))
+	if err != nil {
+		return nil, err
+	}
+	cfg := &v1.ConfigFile{}
+	if err := json.Unmarshal(b, cfg); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,47 @@
+// Package oci is a runtime that runs actions with an OCI runtime binary, such as runc or crun, without a
+// container engine. Images are pulled and unpacked on local disk and every action is run from its own bundle.
+package oci
+
+import (
+	"log/slog"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+)
+
+const (
+	// DefaultRuntimePath is the OCI runtime binary used when none is configured.
+	DefaultRuntimePath = "runc"
+	// DefaultRoot is the directory images and bundles are stored in when none is configured.
+	DefaultRoot = "/var/lib/tink-agent/oci"
+)
+
+type Config struct {
+	Log *slog.Logger
+	// RuntimePath is the path of the OCI runtime binary. Defaults to DefaultRuntimePath.
+	RuntimePath string
+	// RuntimeRoot is the directory the OCI runtime stores container state in. The runtime default is used when empty.
+	RuntimeRoot string
+	// Root is the directory unpacked images and action bundles are stored in. Defaults to DefaultRoot.
+	Root string
+	// Auth is used to authenticate with registries. Images are pulled anonymously when nil.
+	Auth authn.Authenticator
+	// MaxOutputLines is the number of most recent lines of action output kept. Defaults to output.DefaultMaxLines.
+	MaxOutputLines int
+	// ScratchDir is the directory in which a scratch directory is created for each action and mounted at
+	// scratch.MountPath. Actions do not get a scratch directory when empty.
+	ScratchDir string
+}
+
+func (c *Config) runtimePath() string {
+	if c.RuntimePath == "" {
+		return DefaultRuntimePath
+	}
+	return c.RuntimePath
+}
+
+func (c *Config) root() string {
+	if c.Root == "" {
+		return DefaultRoot
+	}
+	return c.Root
+}
@@ -0,0 +1,156 @@
+//go:build linux
+
+package oci
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jacobweinstock/tink-agent/pkg/conv"
+	"github.com/jacobweinstock/tink-agent/pkg/output"
+	"github.com/jacobweinstock/tink-agent/pkg/scratch"
+	"github.com/jacobweinstock/tink-agent/spec"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+func (c *Config) Execute(ctx context.Context, a spec.Action) (spec.Result, error) {
+	res := spec.Result{ExitCode: -1}
+	imageDir, img, err := c.image(ctx, a.Image)
+	if err != nil {
+		return res, err
+	}
+
+	id := conv.ParseName(a.ID, a.Name)
+	bundle := filepath.Join(c.root(), "bundles", id)
+	if err := os.MkdirAll(bundle, 0o700); err != nil {
+		return res, fmt.Errorf("error creating bundle: %w", err)
+	}
+	defer func() { _ = os.RemoveAll(bundle) }()
+
+	// Every action gets a writable copy of the image root filesystem.
+	rootfs := filepath.Join(bundle, "rootfs")
+	if err := overlay(filepath.Join(imageDir, imageRootfs), bundle, rootfs); err != nil {
+		return res, fmt.Errorf("error mounting root filesystem: %w", err)
+	}
+	defer func() {
+		if err := unix.Unmount(rootfs, unix.MNT_DETACH); err != nil {
+			c.Log.Info("error unmounting root filesystem", "container_name", id, "error", err)
+		}
+	}()
+
+	var mounts []specs.Mount
+	var env []string
+	var sd *scratch.Dir
+	if c.ScratchDir != "" {
+		if sd, err = scratch.New(c.ScratchDir, a); err != nil {
+			return res, err
+		}
+		defer func() { _ = sd.Remove() }()
+		mounts = append(mounts, specs.Mount{Destination: scratch.MountPath, Type: "bind", Source: sd.Path, Options: []string{"rbind", "rw"}})
+		env = append(env, sd.Env())
+	}
+
+	s, err := runtimeSpec(a, img, hostname(id), mounts, env)
+	if err != nil {
+		return res, fmt.Errorf("error creating container config: %w", err)
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		return res, fmt.Errorf("error creating container config: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), b, 0o600); err != nil {
+		return res, fmt.Errorf("error writing container config: %w", err)
+	}
+
+	capture := output.New(ctx, a, c.MaxOutputLines)
+	stdout, stderr := capture.Stdout(), capture.Stderr()
+	cmd := exec.Command(c.runtimePath(), c.runtimeArgs("run", "--bundle", bundle, id)...)
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	// The container is removed even if it was not cleaned up by the runtime.
+	defer func() {
+		if out, err := exec.Command(c.runtimePath(), c.runtimeArgs("delete", "--force", id)...).CombinedOutput(); err != nil && !strings.Contains(string(out), "does not exist") {
+			c.Log.Info("Couldn't remove container", "container_name", id, "error", err, "output", string(out))
+		}
+	}()
+
+	res.Started = time.Now()
+	if err := cmd.Start(); err != nil {
+		return res, fmt.Errorf("error starting OCI runtime: %w", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	var werr error
+	select {
+	case werr = <-done:
+	case <-ctx.Done():
+		werr = c.stop(id, done)
+	}
+	res.Finished = time.Now()
+	_ = stdout.Close()
+	_ = stderr.Close()
+	res.Output = capture.Lines()
+	// The runtime exits with the exit status of the container.
+	res.ExitCode = cmd.ProcessState.ExitCode()
+	res.Signal = conv.ParseSignal(res.ExitCode)
+	if err := sd.Apply(&res); err != nil {
+		c.Log.Info("error reading action scratch directory", "container_name", id, "error", err)
+	}
+
+	if ctx.Err() != nil {
+		return res, fmt.Errorf("context error: %w", ctx.Err())
+	}
+	var exitErr *exec.ExitError
+	if errors.As(werr, &exitErr) {
+		return res, fmt.Errorf("%w %d, see the logs for more information", spec.ErrNonZeroExit, res.ExitCode)
+	}
+	if werr != nil {
+		return res, fmt.Errorf("error waiting on container: %w", werr)
+	}
+
+	return res, nil
+}
+
+// stop kills the container with id, first with SIGTERM and then SIGKILL if it has not exited after 5 seconds,
+// and returns the result of waiting on the runtime.
+func (c *Config) stop(id string, done <-chan error) error {
+	if out, err := exec.Command(c.runtimePath(), c.runtimeArgs("kill", id, "TERM")...).CombinedOutput(); err != nil {
+		c.Log.Info("Failed to gracefully stop container", "container_name", id, "error", err, "output", string(out))
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(5 * time.Second):
+	}
+	if out, err := exec.Command(c.runtimePath(), c.runtimeArgs("kill", id, "KILL")...).CombinedOutput(); err != nil {
+		c.Log.Info("Failed to kill container", "container_name", id, "error", err, "output", string(out))
+	}
+	return <-done
+}
+
+// runtimeArgs prepends the global options of the OCI runtime to args.
+func (c *Config) runtimeArgs(args ...string) []string {
+	if c.RuntimeRoot == "" {
+		return args
+	}
+	return append([]string{"--root", c.RuntimeRoot}, args...)
+}
+
+// overlay mounts a writable overlay of lower at target, keeping changes in dir.
+func overlay(lower, dir, target string) error {
+	upper, work := filepath.Join(dir, "upper"), filepath.Join(dir, "work")
+	for _, d := range []string{upper, work, target} {
+		if err := os.MkdirAll(d, 0o755); err != nil {
+			return err
+		}
+	}
+
+	return unix.Mount("overlay", target, "overlay", 0, fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lower, upper, work))
+}
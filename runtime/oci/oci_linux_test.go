@@ -0,0 +1,36 @@
+package oci_test
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/jacobweinstock/tink-agent/agent/agenttest"
+	"github.com/jacobweinstock/tink-agent/runtime/oci"
+	"github.com/jacobweinstock/tink-agent/spec"
+)
+
+func TestRuntime(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("running containers requires root")
+	}
+	if _, err := exec.LookPath(oci.DefaultRuntimePath); err != nil {
+		t.Skipf("%v is not available: %v", oci.DefaultRuntimePath, err)
+	}
+	// Images are unpacked once and shared by every test.
+	root := t.TempDir()
+	agenttest.TestRuntime(t, func(t *testing.T) agenttest.Runtime {
+		sh := func(id, script string) spec.Action {
+			return spec.Action{ID: id, WorkflowID: "wf1", Name: id, Image: "docker.io/library/busybox:1.36", Cmd: "/bin/sh", Args: []string{"-c", script}}
+		}
+
+		return agenttest.Runtime{
+			Executor:        &oci.Config{Log: agenttest.Logger(t), Root: root, ScratchDir: t.TempDir()},
+			Success:         sh("success", "echo hello"),
+			Output:          "hello",
+			Failure:         sh("failure", "exit 3"),
+			FailureExitCode: 3,
+			Block:           sh("block", "while true; do sleep 1; done"),
+		}
+	})
+}
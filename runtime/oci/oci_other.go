@@ -0,0 +1,14 @@
+//go:build !linux
+
+package oci
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jacobweinstock/tink-agent/spec"
+)
+
+func (c *Config) Execute(_ context.Context, _ spec.Action) (spec.Result, error) {
+	return spec.Result{ExitCode: -1}, errors.New("the OCI runtime is only supported on Linux")
+}
@@ -0,0 +1,149 @@
+//go:build linux
+
+package oci
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/containerd/containerd/pkg/cap"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/jacobweinstock/tink-agent/pkg/conv"
+	"github.com/jacobweinstock/tink-agent/spec"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// defaultPath is the PATH given to actions whose image does not set one.
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// maxHostname is the longest hostname the kernel accepts, and the longest DNS label.
+const maxHostname = 63
+
+// runtimeSpec returns the configuration of a privileged container that runs action a from an image with configuration img.
+// The root filesystem of the container is the rootfs directory of the bundle.
+func runtimeSpec(a spec.Action, img *v1.ConfigFile, hostname string, extraMounts []specs.Mount, extraEnv []string) (*specs.Spec, error) {
+	// The action Cmd replaces the image entrypoint, and Args the image command, the same as the Docker runtime.
+	var args []string
+	switch {
+	case a.Cmd != "":
+		args = append([]string{a.Cmd}, a.Args...)
+	case len(a.Args) > 0:
+		args = append(slices.Clone(img.Config.Entrypoint), a.Args...)
+	default:
+		args = append(slices.Clone(img.Config.Entrypoint), img.Config.Cmd...)
+	}
+	if len(args) == 0 {
+		return nil, errors.New("action has no command to run")
+	}
+
+	env := slices.Clone(img.Config.Env)
+	if !slices.ContainsFunc(env, func(e string) bool { return strings.HasPrefix(e, "PATH=") }) {
+		env = append(env, "PATH="+defaultPath)
+	}
+	env = append(env, conv.ParseEnv(a.Env)...)
+	env = append(env, extraEnv...)
+
+	cwd := img.Config.WorkingDir
+	if cwd == "" {
+		cwd = "/"
+	}
+
+	// Actions run privileged, so they get every capability the agent has.
+	caps, err := cap.Current()
+	if err != nil {
+		return nil, err
+	}
+
+	mounts := []specs.Mount{
+		{Destination: "/proc", Type: "proc", Source: "proc", Options: []string{"nosuid", "noexec", "nodev"}},
+		{Destination: "/dev", Type: "bind", Source: "/dev", Options: []string{"rbind", "rw"}},
+		{Destination: "/sys", Type: "bind", Source: "/sys", Options: []string{"rbind", "rw"}},
+		{Destination: "/run", Type: "tmpfs", Source: "tmpfs", Options: []string{"nosuid", "nodev", "mode=755"}},
+	}
+	namespaces := []specs.LinuxNamespace{
+		{Type: specs.MountNamespace},
+		{Type: specs.UTSNamespace},
+		{Type: specs.IPCNamespace},
+	}
+	if a.Namespaces.PID != "host" {
+		namespaces = append(namespaces, specs.LinuxNamespace{Type: specs.PIDNamespace})
+	}
+	// There is no container network, so actions share the network of the host unless they ask for none.
+	if a.Namespaces.Network == "none" {
+		namespaces = append(namespaces, specs.LinuxNamespace{Type: specs.NetworkNamespace})
+	} else if _, err := os.Stat("/etc/resolv.conf"); err == nil {
+		mounts = append(mounts, specs.Mount{Destination: "/etc/resolv.conf", Type: "bind", Source: "/etc/resolv.conf", Options: []string{"rbind", "ro"}})
+	}
+	for _, v := range a.Volumes {
+		m, err := bindMount(string(v))
+		if err != nil {
+			return nil, err
+		}
+		mounts = append(mounts, m)
+	}
+	mounts = append(mounts, extraMounts...)
+
+	return &specs.Spec{
+		Version: specs.Version,
+		Process: &specs.Process{
+			Args: args,
+			Env:  env,
+			Cwd:  cwd,
+			Capabilities: &specs.LinuxCapabilities{
+				Bounding:  caps,
+				Effective: caps,
+				Permitted: caps,
+			},
+		},
+		Root:     &specs.Root{Path: "rootfs"},
+		Hostname: hostname,
+		Mounts:   mounts,
+		Linux: &specs.Linux{
+			Namespaces: namespaces,
+		},
+	}, nil
+}
+
+// bindMount converts a volume, in SRC:DST[:OPTIONS] form, to a bind mount. Only host paths are supported as sources.
+func bindMount(volume string) (specs.Mount, error) {
+	parts := strings.Split(volume, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return specs.Mount{}, fmt.Errorf("volume %v must be in SRC:DST[:OPTIONS] form", volume)
+	}
+	if !filepath.IsAbs(parts[0]) {
+		return specs.Mount{}, fmt.Errorf("volume %v must have a host path as its source", volume)
+	}
+	opts := []string{"rbind", "rw"}
+	if len(parts) == 3 && slices.Contains(strings.Split(parts[2], ","), "ro") {
+		opts = []string{"rbind", "ro"}
+	}
+
+	return specs.Mount{Destination: parts[1], Type: "bind", Source: parts[0], Options: opts}, nil
+}
+
+// hostname returns a hostname for the container with id. Container IDs include the action name, which can make
+// them longer than a hostname can be, so long IDs are shortened and end in a hash of the ID to keep them apart.
+func hostname(id string) string {
+	h := strings.Trim(strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		}
+		return '-'
+	}, id), "-")
+	if len(h) <= maxHostname {
+		return h
+	}
+	sum := sha256.Sum256([]byte(id))
+	suffix := hex.EncodeToString(sum[:4])
+
+	return strings.TrimRight(h[:maxHostname-len(suffix)-1], "-") + "-" + suffix
+}
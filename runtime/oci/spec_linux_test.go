@@ -0,0 +1,40 @@
+//go:build linux
+
+package oci
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/jacobweinstock/tink-agent/pkg/conv"
+	"github.com/jacobweinstock/tink-agent/spec"
+)
+
+// label matches a DNS label, which is always a valid hostname.
+var label = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+func TestHostname(t *testing.T) {
+	tests := map[string]spec.Action{
+		"short": {ID: "a1", Name: "write image", Cmd: "/bin/true"},
+		"long":  {ID: "0b3a4d1e-8c4f-4f6e-9f61-2c0f7c5d9e10", Name: strings.Repeat("stream-ubuntu-image-to-disk-", 4), Cmd: "/bin/true"},
+	}
+	for name, a := range tests {
+		t.Run(name, func(t *testing.T) {
+			s, err := runtimeSpec(a, &v1.ConfigFile{}, hostname(conv.ParseName(a.ID, a.Name)), nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !label.MatchString(s.Hostname) {
+				t.Errorf("hostname %q is not a valid DNS label of at most 63 characters", s.Hostname)
+			}
+		})
+	}
+
+	// Long IDs that only differ at the end get different hostnames.
+	long := strings.Repeat("x", 100)
+	if a, b := hostname(long+"_1"), hostname(long+"_2"); a == b {
+		t.Errorf("different IDs got the same hostname %q", a)
+	}
+}
@@ -0,0 +1,259 @@
+package podman
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// apiVersion is the version of the libpod REST API used.
+const apiVersion = "v4.0.0"
+
+// Client is a minimal client for the libpod REST API.
+// See https://docs.podman.io/en/latest/_static/api.html.
+type Client struct {
+	http *http.Client
+	base string
+}
+
+// NewClient returns a client that connects to the podman API on the unix socket at socketPath.
+func NewClient(socketPath string) *Client {
+	t := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socketPath)
+		},
+	}
+
+	return &Client{http: &http.Client{Transport: t}, base: "http://podman/" + apiVersion + "/libpod"}
+}
+
+// APIError is an error response from the podman API.
+type APIError struct {
+	StatusCode int
+	Message    string `json:"message"`
+	Cause      string `json:"cause"`
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("podman: %v (status %d)", e.Message, e.StatusCode)
+}
+
+// SpecGenerator is the subset of the libpod container specification used to create action containers.
+type SpecGenerator struct {
+	Name       string            `json:"name,omitempty"`
+	Image      string            `json:"image"`
+	Entrypoint []string          `json:"entrypoint,omitempty"`
+	Command    []string          `json:"command,omitempty"`
+	Env        map[string]string `json:"env,omitempty"`
+	Privileged bool              `json:"privileged,omitempty"`
+	PidNS      *Namespace        `json:"pidns,omitempty"`
+	Mounts     []Mount           `json:"mounts,omitempty"`
+	Volumes    []NamedVolume     `json:"volumes,omitempty"`
+}
+
+// Namespace is a Linux namespace configuration, for example {"nsmode": "host"}.
+type Namespace struct {
+	NSMode string `json:"nsmode"`
+	Value  string `json:"value,omitempty"`
+}
+
+// Mount is a bind mount of a host path.
+type Mount struct {
+	Destination string   `json:"destination"`
+	Source      string   `json:"source"`
+	Type        string   `json:"type"`
+	Options     []string `json:"options,omitempty"`
+}
+
+// NamedVolume is a mount of a named volume, which is created if it does not exist.
+type NamedVolume struct {
+	Name    string   `json:"Name"`
+	Dest    string   `json:"Dest"`
+	Options []string `json:"Options,omitempty"`
+}
+
+// ContainerState is the state of a container returned by ContainerInspect.
+type ContainerState struct {
+	ExitCode  int  `json:"ExitCode"`
+	OOMKilled bool `json:"OOMKilled"`
+}
+
+// ImagePull pulls ref. auth is the base64 encoded registry credentials, or empty.
+func (c *Client) ImagePull(ctx context.Context, ref, auth string) error {
+	h := http.Header{}
+	if auth != "" {
+		h.Set("X-Registry-Auth", auth)
+	}
+	resp, err := c.do(ctx, http.MethodPost, "/images/pull", url.Values{"reference": {ref}}, nil, h)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// The pull progress is streamed, with any error reported in the stream.
+	dec := json.NewDecoder(bufio.NewReader(resp.Body))
+	for {
+		var report struct {
+			Error string `json:"error"`
+		}
+		if err := dec.Decode(&report); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if report.Error != "" {
+			return errors.New(report.Error)
+		}
+	}
+}
+
+// ImageExists reports whether ref is in local storage.
+func (c *Client) ImageExists(ctx context.Context, ref string) (bool, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/images/"+ref+"/exists", nil, nil, nil)
+	if err != nil {
+		var apiErr *APIError
+		if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	resp.Body.Close()
+
+	return true, nil
+}
+
+// ContainerCreate creates a container and returns its ID.
+func (c *Client) ContainerCreate(ctx context.Context, s SpecGenerator) (string, error) {
+	resp, err := c.do(ctx, http.MethodPost, "/containers/create", nil, s, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var created struct {
+		ID string `json:"Id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		return "", err
+	}
+
+	return created.ID, nil
+}
+
+// ContainerStart starts the container with id.
+func (c *Client) ContainerStart(ctx context.Context, id string) error {
+	return c.discard(c.do(ctx, http.MethodPost, "/containers/"+id+"/start", nil, nil, nil))
+}
+
+// ContainerWait waits for the container with id to exit and returns its exit code.
+func (c *Client) ContainerWait(ctx context.Context, id string) (int, error) {
+	resp, err := c.do(ctx, http.MethodPost, "/containers/"+id+"/wait", url.Values{"condition": {"exited"}}, nil, nil)
+	if err != nil {
+		return -1, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return -1, err
+	}
+
+	return strconv.Atoi(string(bytes.TrimSpace(b)))
+}
+
+// ContainerLogs follows the stdout and stderr of the container with id. The output is multiplexed
+// the same way as the Docker API and ends when the container exits.
+func (c *Client) ContainerLogs(ctx context.Context, id string) (io.ReadCloser, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/containers/"+id+"/logs", url.Values{"follow": {"true"}, "stdout": {"true"}, "stderr": {"true"}}, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+// ContainerInspect returns the state of the container with id.
+func (c *Client) ContainerInspect(ctx context.Context, id string) (ContainerState, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/containers/"+id+"/json", nil, nil, nil)
+	if err != nil {
+		return ContainerState{}, err
+	}
+	defer resp.Body.Close()
+	var info struct {
+		State ContainerState `json:"State"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return ContainerState{}, err
+	}
+
+	return info.State, nil
+}
+
+// ContainerStop stops the container with id, killing it if it has not exited after timeout seconds.
+func (c *Client) ContainerStop(ctx context.Context, id string, timeout int) error {
+	return c.discard(c.do(ctx, http.MethodPost, "/containers/"+id+"/stop", url.Values{"timeout": {strconv.Itoa(timeout)}}, nil, nil))
+}
+
+// ContainerRemove removes the container with id, killing it first if it is running.
+func (c *Client) ContainerRemove(ctx context.Context, id string) error {
+	return c.discard(c.do(ctx, http.MethodDelete, "/containers/"+id, url.Values{"force": {"true"}}, nil, nil))
+}
+
+// do sends a request to the API, encoding body as JSON if it is not nil.
+// Responses with an error status are returned as an *APIError.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body any, header http.Header) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(b)
+	}
+	u := c.base + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, r)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		defer resp.Body.Close()
+		apiErr := &APIError{StatusCode: resp.StatusCode}
+		if err := json.NewDecoder(resp.Body).Decode(apiErr); err != nil || apiErr.Message == "" {
+			apiErr.Message = http.StatusText(resp.StatusCode)
+		}
+		return nil, apiErr
+	}
+
+	return resp, nil
+}
+
+func (c *Client) discard(resp *http.Response, err error) error {
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	return resp.Body.Close()
+}
@@ -0,0 +1,234 @@
+// Package podman is a runtime that runs actions as podman containers using the libpod REST API.
+package podman
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"time"
+
+	retry "github.com/avast/retry-go"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/jacobweinstock/tink-agent/pkg/conv"
+	"github.com/jacobweinstock/tink-agent/pkg/output"
+	"github.com/jacobweinstock/tink-agent/pkg/scratch"
+	"github.com/jacobweinstock/tink-agent/spec"
+)
+
+// DefaultSocketPath is the location of the rootful podman API socket.
+const DefaultSocketPath = "/run/podman/podman.sock"
+
+type Config struct {
+	Log          *slog.Logger
+	Client       *Client
+	RegistryAuth *registry.AuthConfig
+	// MaxOutputLines is the number of most recent lines of action output kept. Defaults to output.DefaultMaxLines.
+	MaxOutputLines int
+	// ScratchDir is the directory in which a scratch directory is created for each action and mounted at
+	// scratch.MountPath. It must be at the same path for the agent and podman.
+	// Actions do not get a scratch directory when empty.
+	ScratchDir string
+}
+
+func (c *Config) Execute(ctx context.Context, a spec.Action) (spec.Result, error) {
+	res := spec.Result{ExitCode: -1}
+	var auth string
+	if c.RegistryAuth != nil {
+		encodedJSON, err := json.Marshal(c.RegistryAuth)
+		if err != nil {
+			return res, fmt.Errorf("unable to encode auth config: %w", err)
+		}
+		auth = base64.URLEncoding.EncodeToString(encodedJSON)
+	}
+	pullImage := func() error {
+		if err := c.Client.ImagePull(ctx, a.Image, auth); err != nil {
+			// If the image is already present, we can ignore the error.
+			if ok, _ := c.Client.ImageExists(ctx, a.Image); ok {
+				return nil
+			}
+			return err
+		}
+		return nil
+	}
+	if err := retry.Do(pullImage, retry.Attempts(5), retry.DelayType(retry.BackOffDelay), retry.Context(ctx)); err != nil {
+		return res, fmt.Errorf("%w: %w", spec.ErrImagePull, err)
+	}
+
+	containerName := conv.ParseName(a.ID, a.Name)
+	s := SpecGenerator{
+		Name:       containerName,
+		Image:      a.Image,
+		Env:        map[string]string{},
+		Privileged: true,
+	}
+	for _, e := range a.Env {
+		s.Env[e.Key] = e.Value
+	}
+	if a.Namespaces.PID != "" {
+		s.PidNS = namespace(a.Namespaces.PID)
+	}
+	for _, v := range a.Volumes {
+		if err := addVolume(&s, string(v)); err != nil {
+			return res, err
+		}
+	}
+
+	var sd *scratch.Dir
+	if c.ScratchDir != "" {
+		var err error
+		if sd, err = scratch.New(c.ScratchDir, a); err != nil {
+			return res, err
+		}
+		defer func() { _ = sd.Remove() }()
+		s.Mounts = append(s.Mounts, Mount{Destination: scratch.MountPath, Source: sd.Path, Type: "bind", Options: []string{"rbind", "rw"}})
+		s.Env[scratch.EnvVar] = scratch.MountPath
+	}
+
+	// The same as the Docker runtime, Cmd is used as the entrypoint and Args as the command.
+	if a.Cmd != "" {
+		s.Entrypoint = []string{a.Cmd}
+	}
+	if len(a.Args) > 0 {
+		s.Command = a.Args
+	}
+
+	id, err := c.Client.ContainerCreate(ctx, s)
+	if err != nil {
+		return res, fmt.Errorf("error creating container: %w", err)
+	}
+
+	// Always try to remove the container on exit, even if ctx has been cancelled.
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := c.Client.ContainerRemove(ctx, id); err != nil {
+			c.Log.Info("Couldn't remove container", "container_name", containerName, "error", err)
+		}
+	}()
+
+	res.Started = time.Now()
+	if err := c.Client.ContainerStart(ctx, id); err != nil {
+		return res, fmt.Errorf("error starting container: %w", err)
+	}
+
+	// The logs of the container are kept by podman, so no output is missed by following them after it has started.
+	capture := output.New(ctx, a, c.MaxOutputLines)
+	logsCtx, cancelLogs := context.WithCancel(context.WithoutCancel(ctx))
+	outputDone := make(chan struct{})
+	// The logs are followed until the container exits, which it may not have when Execute returns.
+	defer func() {
+		cancelLogs()
+		<-outputDone
+	}()
+	go func() {
+		defer close(outputDone)
+		logs, err := c.Client.ContainerLogs(logsCtx, id)
+		if err != nil {
+			c.Log.Debug("error reading container output", "container_name", containerName, "error", err)
+			return
+		}
+		defer logs.Close()
+		stdout, stderr := capture.Stdout(), capture.Stderr()
+		defer func() { _ = stdout.Close() }()
+		defer func() { _ = stderr.Close() }()
+		// The container is created without a TTY so stdout and stderr are multiplexed.
+		if _, err := stdcopy.StdCopy(stdout, stderr, logs); err != nil {
+			c.Log.Debug("error reading container output", "container_name", containerName, "error", err)
+		}
+	}()
+	// Wait for the remaining output to be read once the container has exited.
+	waitOutput := func() {
+		select {
+		case <-outputDone:
+		case <-time.After(5 * time.Second):
+			cancelLogs()
+			<-outputDone
+		}
+		res.Output = capture.Lines()
+	}
+
+	type waitResult struct {
+		code int
+		err  error
+	}
+	waitC := make(chan waitResult, 1)
+	go func() {
+		code, err := c.Client.ContainerWait(context.WithoutCancel(ctx), id)
+		waitC <- waitResult{code: code, err: err}
+	}()
+
+	select {
+	case result := <-waitC:
+		res.Finished = time.Now()
+		if result.err != nil {
+			return res, fmt.Errorf("error while waiting for container: %w", result.err)
+		}
+		waitOutput()
+		res.ExitCode = result.code
+		res.Signal = conv.ParseSignal(res.ExitCode)
+		if state, err := c.Client.ContainerInspect(context.WithoutCancel(ctx), id); err == nil {
+			res.OOMKilled = state.OOMKilled
+		}
+		if res.OOMKilled {
+			res.Reason = "OOMKilled"
+		}
+		if err := sd.Apply(&res); err != nil {
+			c.Log.Info("error reading action scratch directory", "container_name", containerName, "error", err)
+		}
+		if result.code == 0 {
+			return res, nil
+		}
+		return res, fmt.Errorf("%w %v, see the logs for more information", spec.ErrNonZeroExit, result.code)
+
+	case <-ctx.Done():
+		// We can't use the context passed to Execute() as its been cancelled.
+		if err := c.Client.ContainerStop(context.Background(), id, 5); err != nil {
+			c.Log.Info("Failed to gracefully stop container", "error", err)
+		}
+		select {
+		case result := <-waitC:
+			if result.err == nil {
+				res.ExitCode = result.code
+				res.Signal = conv.ParseSignal(res.ExitCode)
+			}
+		case <-time.After(5 * time.Second):
+		}
+		res.Finished = time.Now()
+		waitOutput()
+		if err := sd.Apply(&res); err != nil {
+			c.Log.Info("error reading action scratch directory", "container_name", containerName, "error", err)
+		}
+		return res, fmt.Errorf("context error: %w", ctx.Err())
+	}
+}
+
+// namespace returns the libpod form of a namespace mode in the form the Docker runtime uses, such as host or
+// container:<id>. Libpod takes the ID of the container separately from the mode.
+func namespace(mode string) *Namespace {
+	nsMode, value, _ := strings.Cut(mode, ":")
+	return &Namespace{NSMode: nsMode, Value: value}
+}
+
+// addVolume adds a volume, in {SRC-VOLUME-NAME | SRC-HOST-DIR}:TGT-CONTAINER-DIR[:OPTIONS] form, to s.
+func addVolume(s *SpecGenerator, volume string) error {
+	parts := strings.Split(volume, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return fmt.Errorf("volume %v must be in SRC:DST[:OPTIONS] form", volume)
+	}
+	var opts []string
+	if len(parts) == 3 {
+		opts = strings.Split(parts[2], ",")
+	}
+	if filepath.IsAbs(parts[0]) {
+		s.Mounts = append(s.Mounts, Mount{Destination: parts[1], Source: parts[0], Type: "bind", Options: append([]string{"rbind"}, opts...)})
+		return nil
+	}
+	s.Volumes = append(s.Volumes, NamedVolume{Name: parts[0], Dest: parts[1], Options: opts})
+
+	return nil
+}
@@ -0,0 +1,229 @@
+package podman_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/google/go-cmp/cmp"
+	"github.com/jacobweinstock/tink-agent/agent/agenttest"
+	"github.com/jacobweinstock/tink-agent/runtime/podman"
+	"github.com/jacobweinstock/tink-agent/spec"
+)
+
+func TestRuntime(t *testing.T) {
+	agenttest.TestRuntime(t, func(t *testing.T) agenttest.Runtime {
+		_, socket := newService(t)
+		return agenttest.Runtime{
+			Executor:        &podman.Config{Log: agenttest.Logger(t), Client: podman.NewClient(socket), ScratchDir: t.TempDir()},
+			Success:         spec.Action{ID: "a1", WorkflowID: "wf1", Name: "success", Image: "success"},
+			Output:          "hello",
+			Failure:         spec.Action{ID: "a2", WorkflowID: "wf1", Name: "failure", Image: "failure"},
+			FailureExitCode: 3,
+			Block:           spec.Action{ID: "a3", WorkflowID: "wf1", Name: "block", Image: "block"},
+		}
+	})
+}
+
+// TestNamespaces tests that PID namespaces in the form the Docker runtime uses are created in the libpod form.
+func TestNamespaces(t *testing.T) {
+	tests := map[string]podman.Namespace{
+		"host":          {NSMode: "host"},
+		"container:abc": {NSMode: "container", Value: "abc"},
+		"private":       {NSMode: "private"},
+	}
+	for pid, want := range tests {
+		t.Run(pid, func(t *testing.T) {
+			s, socket := newService(t)
+			r := &podman.Config{Log: agenttest.Logger(t), Client: podman.NewClient(socket)}
+			a := spec.Action{ID: "a1", WorkflowID: "wf1", Name: "success", Image: "success", Namespaces: spec.Namespaces{PID: pid}}
+			if _, err := r.Execute(context.Background(), a); err != nil {
+				t.Fatal(err)
+			}
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if len(s.specs) != 1 || s.specs[0].PidNS == nil {
+				t.Fatalf("got container specs %+v, want one with a PID namespace", s.specs)
+			}
+			if diff := cmp.Diff(want, *s.specs[0].PidNS); diff != "" {
+				t.Errorf("unexpected PID namespace (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// TestWaitError tests that the logs of a container are no longer followed once waiting for it has failed.
+func TestWaitError(t *testing.T) {
+	s, socket := newService(t)
+	r := &podman.Config{Log: agenttest.Logger(t), Client: podman.NewClient(socket)}
+	a := spec.Action{ID: "a1", WorkflowID: "wf1", Name: "waitfails", Image: "waitfails"}
+	if _, err := r.Execute(context.Background(), a); err == nil {
+		t.Fatal("got no error when waiting for the container failed")
+	}
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		s.mu.Lock()
+		following := s.followingLogs
+		s.mu.Unlock()
+		if following == 0 {
+			return
+		}
+	}
+	t.Error("logs of the container are still being followed")
+}
+
+// newService starts a fake libpod API until the test ends, returning it and the socket it listens on.
+func newService(t *testing.T) (*service, string) {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "podman.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &service{containers: map[string]*fakeContainer{}, closed: make(chan struct{})}
+	srv := httptest.NewUnstartedServer(s.handler())
+	srv.Listener = l
+	srv.Start()
+	t.Cleanup(srv.Close)
+	// Cleanups run last to first, so requests that would never return are ended before the server waits for them.
+	t.Cleanup(func() { close(s.closed) })
+
+	return s, socket
+}
+
+// service is a fake of the parts of the libpod API used by the runtime. Containers run according to
+// their image: "success" writes hello to stdout and exits 0, "failure" exits 3, and "block" runs
+// until stopped. Waiting for a "waitfails" container fails, and its logs are followed until the
+// request is cancelled.
+type service struct {
+	mu         sync.Mutex
+	containers map[string]*fakeContainer
+	// specs are the specifications of every container created.
+	specs []podman.SpecGenerator
+	// followingLogs is the number of logs requests that have not yet returned.
+	followingLogs int
+	// closed is closed when the test ends.
+	closed chan struct{}
+}
+
+type fakeContainer struct {
+	image    string
+	stop     chan struct{}
+	stopOnce sync.Once
+	// exited is closed once exitCode and output are set.
+	exited   chan struct{}
+	exitCode int
+	output   string
+}
+
+func (s *service) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /{version}/libpod/images/pull", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = fmt.Fprintln(w, `{"stream":"Copying blob"}`)
+	})
+	mux.HandleFunc("POST /{version}/libpod/containers/create", func(w http.ResponseWriter, r *http.Request) {
+		var sg podman.SpecGenerator
+		if err := json.NewDecoder(r.Body).Decode(&sg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.mu.Lock()
+		s.containers[sg.Name] = &fakeContainer{image: sg.Image, stop: make(chan struct{}), exited: make(chan struct{})}
+		s.specs = append(s.specs, sg)
+		s.mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+		_, _ = fmt.Fprintf(w, `{"Id":%q}`, sg.Name)
+	})
+	mux.HandleFunc("POST /{version}/libpod/containers/{id}/start", s.withContainer(func(w http.ResponseWriter, _ *http.Request, c *fakeContainer) {
+		go c.run()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	mux.HandleFunc("POST /{version}/libpod/containers/{id}/wait", s.withContainer(func(w http.ResponseWriter, r *http.Request, c *fakeContainer) {
+		if c.image == "waitfails" {
+			http.Error(w, `{"message":"wait failed"}`, http.StatusInternalServerError)
+			return
+		}
+		select {
+		case <-r.Context().Done():
+		case <-c.exited:
+			_, _ = fmt.Fprintln(w, c.exitCode)
+		}
+	}))
+	mux.HandleFunc("GET /{version}/libpod/containers/{id}/logs", s.withContainer(func(w http.ResponseWriter, r *http.Request, c *fakeContainer) {
+		s.mu.Lock()
+		s.followingLogs++
+		s.mu.Unlock()
+		defer func() {
+			s.mu.Lock()
+			s.followingLogs--
+			s.mu.Unlock()
+		}()
+		if c.image == "waitfails" {
+			select {
+			case <-r.Context().Done():
+			case <-s.closed:
+			}
+			return
+		}
+		select {
+		case <-r.Context().Done():
+		case <-c.exited:
+			_, _ = stdcopy.NewStdWriter(w, stdcopy.Stdout).Write([]byte(c.output))
+		}
+	}))
+	mux.HandleFunc("GET /{version}/libpod/containers/{id}/json", s.withContainer(func(w http.ResponseWriter, _ *http.Request, c *fakeContainer) {
+		<-c.exited
+		_ = json.NewEncoder(w).Encode(map[string]any{"State": podman.ContainerState{ExitCode: c.exitCode}})
+	}))
+	mux.HandleFunc("POST /{version}/libpod/containers/{id}/stop", s.withContainer(func(w http.ResponseWriter, _ *http.Request, c *fakeContainer) {
+		c.stopOnce.Do(func() { close(c.stop) })
+		<-c.exited
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	mux.HandleFunc("DELETE /{version}/libpod/containers/{id}", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		c := s.containers[r.PathValue("id")]
+		delete(s.containers, r.PathValue("id"))
+		s.mu.Unlock()
+		if c != nil {
+			c.stopOnce.Do(func() { close(c.stop) })
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	return mux
+}
+
+func (s *service) withContainer(h func(http.ResponseWriter, *http.Request, *fakeContainer)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		c, ok := s.containers[r.PathValue("id")]
+		s.mu.Unlock()
+		if !ok {
+			http.Error(w, `{"message":"no such container"}`, http.StatusNotFound)
+			return
+		}
+		h(w, r, c)
+	}
+}
+
+// run runs the container until it exits or is stopped.
+func (c *fakeContainer) run() {
+	defer close(c.exited)
+	switch c.image {
+	case "success":
+		c.output = "hello\n"
+	case "failure":
+		c.exitCode = 3
+	default:
+		<-c.stop
+		c.exitCode = 143
+	}
+}
@@ -0,0 +1,57 @@
+//go:build linux
+
+package process
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// TestBindMountSymlink tests that a volume whose destination is a symlink in the root filesystem is mounted
+// within the root filesystem and not where the symlink points on the host.
+func TestBindMountSymlink(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("mounting requires root")
+	}
+	src := t.TempDir()
+	tests := map[string]struct {
+		link  string
+		isDir bool
+	}{
+		"absolute dir":  {link: "/", isDir: true},
+		"relative dir":  {link: "../../..", isDir: true},
+		"absolute file": {link: "/"},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			// The symlink points at outside when followed on the host.
+			root, outside := t.TempDir(), t.TempDir()
+			if err := os.Symlink(filepath.Join(tt.link, outside), filepath.Join(root, "link")); err != nil {
+				t.Fatal(err)
+			}
+			volSrc := src
+			if !tt.isDir {
+				volSrc = filepath.Join(src, "file")
+				if err := os.WriteFile(volSrc, []byte("data"), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			target, err := bindMount(root, volSrc+":/link/target")
+			if err != nil {
+				t.Fatalf("mounting volume: %v", err)
+			}
+			t.Cleanup(func() { _ = unix.Unmount(target, unix.MNT_DETACH) })
+			if !strings.HasPrefix(target, root+"/") {
+				t.Errorf("volume mounted at %v, want it within %v", target, root)
+			}
+			if _, err := os.Lstat(filepath.Join(outside, "target")); !os.IsNotExist(err) {
+				t.Errorf("volume target was created outside of the root filesystem")
+			}
+		})
+	}
+}
@@ -0,0 +1,26 @@
+// Package process is a runtime that runs actions directly on the host, without a container engine.
+//
+// Action.Cmd and Action.Args are run as a process with Action.Env. When Action.Image is the absolute path of a
+// directory, such as an unpacked root filesystem, the process is chrooted into it and Action.Volumes are bind mounted
+// into it. The process gets its own PID namespace unless Action.Namespaces.PID is "host", and its own network
+// namespace only when Action.Namespaces.Network is "none".
+package process
+
+import (
+	"log/slog"
+)
+
+// defaultPath is the PATH given to actions that do not set one.
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+type Config struct {
+	Log *slog.Logger
+	// WorkingDir is the working directory of actions. When an action is chrooted it is relative to the root
+	// filesystem of the action. Defaults to "/".
+	WorkingDir string
+	// MaxOutputLines is the number of most recent lines of action output kept. Defaults to output.DefaultMaxLines.
+	MaxOutputLines int
+	// ScratchDir is the directory in which a scratch directory is created for each action.
+	// Actions do not get a scratch directory when empty.
+	ScratchDir string
+}
@@ -0,0 +1,337 @@
+//go:build linux
+
+package process
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jacobweinstock/tink-agent/pkg/conv"
+	"github.com/jacobweinstock/tink-agent/pkg/output"
+	"github.com/jacobweinstock/tink-agent/pkg/scratch"
+	"github.com/jacobweinstock/tink-agent/spec"
+	"golang.org/x/sys/unix"
+)
+
+func (c *Config) Execute(ctx context.Context, a spec.Action) (spec.Result, error) {
+	res := spec.Result{ExitCode: -1}
+	name, args := a.Cmd, a.Args
+	if name == "" {
+		if len(args) == 0 {
+			return res, errors.New("action has no command to run")
+		}
+		name, args = args[0], args[1:]
+	}
+	root, err := rootfs(a.Image)
+	if err != nil {
+		return res, err
+	}
+
+	env := conv.ParseEnv(a.Env)
+	path := defaultPath
+	if i := slices.IndexFunc(a.Env, func(e spec.Env) bool { return e.Key == "PATH" }); i >= 0 {
+		path = a.Env[i].Value
+	} else {
+		env = append(env, "PATH="+path)
+	}
+
+	var sd *scratch.Dir
+	if c.ScratchDir != "" {
+		if sd, err = scratch.New(c.ScratchDir, a); err != nil {
+			return res, err
+		}
+		defer func() { _ = sd.Remove() }()
+	}
+
+	// Everything mounted into the root filesystem is unmounted once the action exits.
+	var mounts []string
+	defer func() {
+		for _, m := range slices.Backward(mounts) {
+			if err := unix.Unmount(m, unix.MNT_DETACH); err != nil {
+				c.Log.Info("error unmounting", "target", m, "error", err)
+			}
+		}
+	}()
+	if root != "" {
+		for _, v := range a.Volumes {
+			target, err := bindMount(root, string(v))
+			if target != "" {
+				mounts = append(mounts, target)
+			}
+			if err != nil {
+				return res, fmt.Errorf("error mounting volume %q: %w", v, err)
+			}
+		}
+		if sd != nil {
+			target, err := bindMount(root, sd.Bind())
+			if target != "" {
+				mounts = append(mounts, target)
+			}
+			if err != nil {
+				return res, fmt.Errorf("error mounting scratch directory: %w", err)
+			}
+			env = append(env, sd.Env())
+		}
+	} else {
+		if len(a.Volumes) > 0 {
+			c.Log.Info("ignoring volumes, they are only mounted when the action image is a root filesystem directory", "volumes", a.Volumes)
+		}
+		if sd != nil {
+			env = append(env, scratch.EnvVar+"="+sd.Path)
+		}
+	}
+
+	bin, err := lookPath(root, name, path)
+	if err != nil {
+		return res, err
+	}
+	capture := output.New(ctx, a, c.MaxOutputLines)
+	stdout, stderr := capture.Stdout(), capture.Stderr()
+	cmd := exec.CommandContext(ctx, bin)
+	cmd.Args = append([]string{name}, args...)
+	cmd.Env = env
+	cmd.Dir = c.WorkingDir
+	if cmd.Dir == "" {
+		cmd.Dir = "/"
+	}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Chroot: root, Cloneflags: cloneFlags(a.Namespaces), Pdeathsig: syscall.SIGKILL}
+	// When ctx is done the process is asked to stop and then killed if it has not exited after 5 seconds.
+	cmd.Cancel = func() error { return cmd.Process.Signal(syscall.SIGTERM) }
+	cmd.WaitDelay = 5 * time.Second
+
+	res.Started = time.Now()
+	if err := cmd.Start(); err != nil {
+		return res, fmt.Errorf("error starting process: %w", err)
+	}
+	werr := cmd.Wait()
+	res.Finished = time.Now()
+	_ = stdout.Close()
+	_ = stderr.Close()
+	res.Output = capture.Lines()
+	if ws, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok {
+		res.ExitCode = ws.ExitStatus()
+		if ws.Signaled() {
+			// Report signals the same way container runtimes do.
+			res.ExitCode = 128 + int(ws.Signal())
+		}
+		res.Signal = conv.ParseSignal(res.ExitCode)
+	}
+	if err := sd.Apply(&res); err != nil {
+		c.Log.Info("error reading action scratch directory", "error", err)
+	}
+
+	if ctx.Err() != nil {
+		return res, fmt.Errorf("context error: %w", ctx.Err())
+	}
+	var exitErr *exec.ExitError
+	if errors.As(werr, &exitErr) {
+		return res, fmt.Errorf("%w %d, see the logs for more information", spec.ErrNonZeroExit, res.ExitCode)
+	}
+	if werr != nil {
+		return res, fmt.Errorf("error waiting on process: %w", werr)
+	}
+
+	return res, nil
+}
+
+// rootfs returns the directory to chroot into for image, or an empty string if the action is not chrooted.
+func rootfs(image string) (string, error) {
+	if !filepath.IsAbs(image) {
+		return "", nil
+	}
+	info, err := os.Stat(image)
+	if err != nil {
+		return "", fmt.Errorf("error reading root filesystem: %w", err)
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("root filesystem %v is not a directory", image)
+	}
+
+	return filepath.Clean(image), nil
+}
+
+// cloneFlags returns the namespaces to create for the process.
+func cloneFlags(ns spec.Namespaces) uintptr {
+	var flags uintptr
+	if ns.PID != "host" {
+		flags |= syscall.CLONE_NEWPID
+	}
+	if ns.Network == "none" {
+		flags |= syscall.CLONE_NEWNET
+	}
+
+	return flags
+}
+
+// lookPath finds the executable name in the directories of path, relative to root.
+// The returned path is relative to root.
+func lookPath(root, name, path string) (string, error) {
+	if strings.Contains(name, "/") {
+		return name, nil
+	}
+	for _, dir := range filepath.SplitList(path) {
+		if dir == "" {
+			continue
+		}
+		p := filepath.Join(dir, name)
+		if info, err := os.Stat(filepath.Join(root, p)); err == nil && !info.IsDir() && info.Mode()&0o111 != 0 {
+			return p, nil
+		}
+	}
+
+	return "", fmt.Errorf("executable %q not found in PATH %v: %w", name, path, exec.ErrNotFound)
+}
+
+// bindMount bind mounts a volume, in SRC:DST[:OPTIONS] form, into root. Only host paths are supported as sources.
+// It returns the mount target, if it was mounted, so that it can be unmounted.
+func bindMount(root, volume string) (string, error) {
+	parts := strings.Split(volume, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return "", errors.New("volume must be in SRC:DST[:OPTIONS] form")
+	}
+	src, dst := parts[0], parts[1]
+	if !filepath.IsAbs(src) {
+		return "", errors.New("only host paths are supported as volume sources")
+	}
+	info, err := os.Stat(src)
+	if err != nil {
+		return "", err
+	}
+	// DST is resolved within root, symlinks in the root filesystem cannot point the mount outside of it.
+	f, err := openInRoot(root, dst, info.IsDir())
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = f.Close() }()
+	// The mount is made through the opened file so that the path cannot be changed after it was resolved.
+	fdPath := fmt.Sprintf("/proc/self/fd/%d", f.Fd())
+	target, err := os.Readlink(fdPath)
+	if err != nil {
+		return "", err
+	}
+	if err := unix.Mount(src, fdPath, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+		return "", err
+	}
+	if len(parts) == 3 && slices.Contains(strings.Split(parts[2], ","), "ro") {
+		if err := unix.Mount("", target, "", unix.MS_REMOUNT|unix.MS_BIND|unix.MS_RDONLY, ""); err != nil {
+			return target, err
+		}
+	}
+
+	return target, nil
+}
+
+// maxSymlinks is the most symlinks openInRoot follows, the same as the kernel allows.
+const maxSymlinks = 40
+
+// openInRoot opens path as if root were "/", so that neither ".." nor symlinks resolve to outside of root.
+// Missing directories are created, even where a symlink points, and so is the last element of path, as a
+// directory when dir is true and as an empty file otherwise.
+func openInRoot(root, path string, dir bool) (*os.File, error) {
+	rootFd, err := unix.Open(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: root, Err: err}
+	}
+	defer func() { _ = unix.Close(rootFd) }()
+	// open opens name, relative to root, as a path that is already known to have no symlinks. The kernel
+	// still keeps it within root in case the root filesystem changes in the meantime.
+	open := func(name string) (int, error) {
+		fd, err := unix.Openat2(rootFd, name, &unix.OpenHow{Flags: unix.O_PATH | unix.O_CLOEXEC, Resolve: unix.RESOLVE_IN_ROOT | unix.RESOLVE_NO_MAGICLINKS})
+		if err != nil {
+			return -1, &os.PathError{Op: "openat2", Path: filepath.Join(root, name), Err: err}
+		}
+		return fd, nil
+	}
+
+	// resolved are the elements of path resolved so far, none of which are symlinks.
+	var resolved []string
+	remaining := splitPath(path)
+	links := 0
+	for len(remaining) > 0 {
+		elem := remaining[0]
+		remaining = remaining[1:]
+		if elem == ".." {
+			if len(resolved) > 0 {
+				resolved = resolved[:len(resolved)-1]
+			}
+			continue
+		}
+		parent, err := open(filepath.Join(append([]string{"."}, resolved...)...))
+		if err != nil {
+			return nil, err
+		}
+		target, err := readlinkat(parent, elem)
+		if err == nil {
+			_ = unix.Close(parent)
+			if links++; links > maxSymlinks {
+				return nil, &os.PathError{Op: "open", Path: path, Err: unix.ELOOP}
+			}
+			if filepath.IsAbs(target) {
+				resolved = nil
+			}
+			remaining = append(splitPath(target), remaining...)
+			continue
+		}
+		switch {
+		case errors.Is(err, unix.ENOENT):
+			err = create(parent, elem, dir || len(remaining) > 0)
+		case errors.Is(err, unix.EINVAL):
+			// elem exists and is not a symlink.
+			err = nil
+		}
+		_ = unix.Close(parent)
+		if err != nil {
+			return nil, &os.PathError{Op: "open", Path: filepath.Join(append(append([]string{root}, resolved...), elem)...), Err: err}
+		}
+		resolved = append(resolved, elem)
+	}
+
+	name := filepath.Join(append([]string{"."}, resolved...)...)
+	fd, err := open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.NewFile(uintptr(fd), filepath.Join(root, name)), nil
+}
+
+// readlinkat returns the target of the symlink name in the directory dirfd.
+func readlinkat(dirfd int, name string) (string, error) {
+	buf := make([]byte, unix.PathMax)
+	n, err := unix.Readlinkat(dirfd, name, buf)
+	if err != nil {
+		return "", err
+	}
+
+	return string(buf[:n]), nil
+}
+
+// create creates name in the directory dirfd, as a directory when dir is true and as an empty file otherwise.
+func create(dirfd int, name string, dir bool) error {
+	if dir {
+		if err := unix.Mkdirat(dirfd, name, 0o755); err != nil && !errors.Is(err, unix.EEXIST) {
+			return err
+		}
+		return nil
+	}
+	fd, err := unix.Openat(dirfd, name, unix.O_CREAT|unix.O_RDONLY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0o644)
+	if err != nil {
+		return err
+	}
+
+	return unix.Close(fd)
+}
+
+// splitPath returns the elements of path, without any empty or "." elements.
+func splitPath(path string) []string {
+	return slices.DeleteFunc(strings.Split(path, "/"), func(s string) bool { return s == "" || s == "." })
+}
@@ -0,0 +1,32 @@
+package process_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jacobweinstock/tink-agent/agent/agenttest"
+	"github.com/jacobweinstock/tink-agent/runtime/process"
+	"github.com/jacobweinstock/tink-agent/spec"
+)
+
+func TestRuntime(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("creating namespaces requires root")
+	}
+	agenttest.TestRuntime(t, func(t *testing.T) agenttest.Runtime {
+		sh := func(script string) spec.Action {
+			return spec.Action{ID: "a1", WorkflowID: "wf1", Name: "sh", Cmd: "/bin/sh", Args: []string{"-c", script}}
+		}
+		return agenttest.Runtime{
+			Executor:        &process.Config{Log: agenttest.Logger(t), ScratchDir: t.TempDir()},
+			Success:         sh("echo hello"),
+			Output:          "hello",
+			Failure:         sh("exit 3"),
+			FailureExitCode: 3,
+			// The shell is PID 1 of its namespace and ignores SIGTERM, so it is killed.
+			Block:       sh("while true; do sleep 1; done"),
+			StopTimeout: 10 * time.Second,
+		}
+	})
+}
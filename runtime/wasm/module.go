@@ -0,0 +1,149 @@
+package wasm
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	retry "github.com/avast/retry-go"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// maxModuleBytes is the largest module that is loaded.
+const maxModuleBytes = 256 << 20
+
+// module returns the WebAssembly binary referenced by image, either the path of a local file or an OCI artifact.
+func (c *Config) module(ctx context.Context, image string) ([]byte, error) {
+	if filepath.IsAbs(image) || strings.HasPrefix(image, ".") {
+		return os.ReadFile(image)
+	}
+
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return nil, err
+	}
+	opts := []remote.Option{remote.WithContext(ctx)}
+	if c.Auth != nil {
+		opts = append(opts, remote.WithAuth(c.Auth))
+	}
+	var img v1.Image
+	pull := func() error {
+		var err error
+		img, err = fetch(ref, opts...)
+		return err
+	}
+	if err := retry.Do(pull, retry.Attempts(5), retry.DelayType(retry.BackOffDelay), retry.Context(ctx)); err != nil {
+		return nil, err
+	}
+
+	return fromImage(img)
+}
+
+// fetch returns the image ref refers to. For an index the image for the wasm architecture is used,
+// or the first image if there is none.
+func fetch(ref name.Reference, opts ...remote.Option) (v1.Image, error) {
+	desc, err := remote.Get(ref, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if !desc.MediaType.IsIndex() {
+		return desc.Image()
+	}
+	idx, err := desc.ImageIndex()
+	if err != nil {
+		return nil, err
+	}
+	m, err := idx.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	if len(m.Manifests) == 0 {
+		return nil, errors.New("image index has no images")
+	}
+	d := m.Manifests[0]
+	for _, md := range m.Manifests {
+		if md.Platform != nil && md.Platform.Architecture == "wasm" {
+			d = md
+			break
+		}
+	}
+
+	return idx.Image(d.Digest)
+}
+
+// fromImage returns the module in img. Artifacts with a WebAssembly layer, such as those described by
+// https://tag-runtime.cncf.io/wgs/wasm/deliverables/wasm-oci-artifact/, use that layer. Otherwise img is treated
+// as a container image and the module is the file at its entrypoint, or its only .wasm file.
+func fromImage(img v1.Image) ([]byte, error) {
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range layers {
+		mt, err := l.MediaType()
+		if err != nil {
+			return nil, err
+		}
+		if strings.Contains(string(mt), "wasm") {
+			rc, err := l.Uncompressed()
+			if err != nil {
+				return nil, err
+			}
+			defer rc.Close()
+			return io.ReadAll(io.LimitReader(rc, maxModuleBytes))
+		}
+	}
+
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	var entrypoint string
+	if len(cfg.Config.Entrypoint) > 0 {
+		entrypoint = path.Clean("/" + cfg.Config.Entrypoint[0])
+	}
+	rc := mutate.Extract(img)
+	defer rc.Close()
+	tr := tar.NewReader(rc)
+	var found []byte
+	var count int
+	for {
+		h, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+		p := path.Clean("/" + h.Name)
+		if p != entrypoint && !strings.HasSuffix(p, ".wasm") {
+			continue
+		}
+		b, err := io.ReadAll(io.LimitReader(tr, maxModuleBytes))
+		if err != nil {
+			return nil, err
+		}
+		if p == entrypoint {
+			return b, nil
+		}
+		found = b
+		count++
+	}
+	if count != 1 {
+		return nil, fmt.Errorf("image has %d .wasm files and no entrypoint, expected exactly one module", count)
+	}
+
+	return found, nil
+}
@@ -0,0 +1,138 @@
+// Package wasm is a runtime that runs actions as WASI modules with the pure Go wazero engine.
+//
+// Action.Image is either the path of a local module or an OCI artifact containing one. The module is run with
+// Action.Args and Action.Env, and Action.Volumes, in SRC:DST[:OPTIONS] form, are preopened as directories. They are
+// read-only when OPTIONS has ro.
+package wasm
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/jacobweinstock/tink-agent/pkg/output"
+	"github.com/jacobweinstock/tink-agent/pkg/scratch"
+	"github.com/jacobweinstock/tink-agent/spec"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+type Config struct {
+	Log *slog.Logger
+	// Auth is used to authenticate with registries. Modules are pulled anonymously when nil.
+	Auth authn.Authenticator
+	// MaxOutputLines is the number of most recent lines of action output kept. Defaults to output.DefaultMaxLines.
+	MaxOutputLines int
+	// ScratchDir is the directory in which a scratch directory is created for each action and preopened at
+	// scratch.MountPath. Actions do not get a scratch directory when empty.
+	ScratchDir string
+}
+
+func (c *Config) Execute(ctx context.Context, a spec.Action) (spec.Result, error) {
+	res := spec.Result{ExitCode: -1}
+	bin, err := c.module(ctx, a.Image)
+	if err != nil {
+		return res, fmt.Errorf("%w: %w", spec.ErrImagePull, err)
+	}
+
+	// The module is closed when ctx is done, which stops it.
+	r := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithCloseOnContextDone(true))
+	defer func() { _ = r.Close(context.WithoutCancel(ctx)) }()
+	wasi_snapshot_preview1.MustInstantiate(ctx, r)
+	compiled, err := r.CompileModule(ctx, bin)
+	if err != nil {
+		return res, fmt.Errorf("error compiling module: %w", err)
+	}
+
+	fs := wazero.NewFSConfig()
+	for _, v := range a.Volumes {
+		if fs, err = addVolume(fs, string(v)); err != nil {
+			return res, err
+		}
+	}
+
+	// argv[0] is the name of the program.
+	argv0 := a.Cmd
+	if argv0 == "" {
+		argv0 = a.Name
+	}
+	capture := output.New(ctx, a, c.MaxOutputLines)
+	stdout, stderr := capture.Stdout(), capture.Stderr()
+	cfg := wazero.NewModuleConfig().
+		WithName("").
+		WithArgs(append([]string{argv0}, a.Args...)...).
+		WithStdout(stdout).
+		WithStderr(stderr).
+		WithRandSource(rand.Reader).
+		WithSysWalltime().
+		WithSysNanotime().
+		WithSysNanosleep()
+	for _, e := range a.Env {
+		cfg = cfg.WithEnv(e.Key, e.Value)
+	}
+
+	var sd *scratch.Dir
+	if c.ScratchDir != "" {
+		if sd, err = scratch.New(c.ScratchDir, a); err != nil {
+			return res, err
+		}
+		defer func() { _ = sd.Remove() }()
+		fs = fs.WithDirMount(sd.Path, scratch.MountPath)
+		cfg = cfg.WithEnv(scratch.EnvVar, scratch.MountPath)
+	}
+	cfg = cfg.WithFSConfig(fs)
+
+	res.Started = time.Now()
+	mod, err := r.InstantiateModule(ctx, compiled, cfg)
+	res.Finished = time.Now()
+	if mod != nil {
+		_ = mod.Close(context.WithoutCancel(ctx))
+	}
+	_ = stdout.Close()
+	_ = stderr.Close()
+	res.Output = capture.Lines()
+	if err := sd.Apply(&res); err != nil {
+		c.Log.Info("error reading action scratch directory", "error", err)
+	}
+
+	var exitErr *sys.ExitError
+	isExit := errors.As(err, &exitErr)
+	// A module closed because ctx is done did not exit normally.
+	if isExit && exitErr.ExitCode() != sys.ExitCodeContextCanceled && exitErr.ExitCode() != sys.ExitCodeDeadlineExceeded {
+		res.ExitCode = int(exitErr.ExitCode())
+	} else if err == nil {
+		res.ExitCode = 0
+	}
+	if ctx.Err() != nil {
+		return res, fmt.Errorf("context error: %w", ctx.Err())
+	}
+	if isExit && res.ExitCode != 0 {
+		return res, fmt.Errorf("%w %d, see the logs for more information", spec.ErrNonZeroExit, res.ExitCode)
+	}
+	if err != nil && !isExit {
+		return res, fmt.Errorf("error running module: %w", err)
+	}
+
+	return res, nil
+}
+
+// addVolume adds a volume, in SRC:DST[:OPTIONS] form, to fs. OPTIONS is a comma separated list, the directory
+// is read-only when it has ro. Other options, such as those only meaningful to container runtimes, are ignored.
+func addVolume(fs wazero.FSConfig, volume string) (wazero.FSConfig, error) {
+	parts := strings.Split(volume, ":")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return fs, fmt.Errorf("volume %v must be in SRC:DST[:OPTIONS] form", volume)
+	}
+	if len(parts) == 3 && slices.Contains(strings.Split(parts[2], ","), "ro") {
+		return fs.WithReadOnlyDirMount(parts[0], parts[1]), nil
+	}
+
+	return fs.WithDirMount(parts[0], parts[1]), nil
+}
@@ -0,0 +1,96 @@
+package wasm_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jacobweinstock/tink-agent/agent/agenttest"
+	"github.com/jacobweinstock/tink-agent/runtime/wasm"
+	"github.com/jacobweinstock/tink-agent/spec"
+)
+
+func TestRuntime(t *testing.T) {
+	agenttest.TestRuntime(t, func(t *testing.T) agenttest.Runtime {
+		dir := t.TempDir()
+		action := func(name string, body ...byte) spec.Action {
+			p := filepath.Join(dir, name+".wasm")
+			if err := os.WriteFile(p, module(body), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			return spec.Action{ID: name, WorkflowID: "wf1", Name: name, Image: p}
+		}
+		return agenttest.Runtime{
+			Executor: &wasm.Config{Log: agenttest.Logger(t), ScratchDir: t.TempDir()},
+			// fd_write(1, iovs=0, 1, nwritten=8)
+			Success: action("success", 0x41, 1, 0x41, 0, 0x41, 1, 0x41, 8, 0x10, 0, 0x1a),
+			Output:  "hello",
+			// proc_exit(3)
+			Failure:         action("failure", 0x41, 3, 0x10, 1),
+			FailureExitCode: 3,
+			// loop br 0 end
+			Block: action("block", 0x03, 0x40, 0x0c, 0, 0x0b),
+		}
+	})
+}
+
+// TestVolumes tests that volumes not in SRC:DST[:OPTIONS] form are rejected.
+func TestVolumes(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "success.wasm")
+	if err := os.WriteFile(p, module(nil), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	src := t.TempDir()
+	tests := map[string]struct {
+		volume  spec.Volume
+		wantErr bool
+	}{
+		"read-write":        {volume: spec.Volume(src + ":/data")},
+		"read-only":         {volume: spec.Volume(src + ":/data:ro")},
+		"read-only options": {volume: spec.Volume(src + ":/data:z,ro")},
+		"no destination":    {volume: spec.Volume(src), wantErr: true},
+		"empty destination": {volume: spec.Volume(src + ":"), wantErr: true},
+		"too many parts":    {volume: spec.Volume(src + ":/data:ro:z"), wantErr: true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := &wasm.Config{Log: agenttest.Logger(t)}
+			a := spec.Action{ID: "a1", WorkflowID: "wf1", Name: "volumes", Image: p, Volumes: []spec.Volume{tt.volume}}
+			if _, err := r.Execute(context.Background(), a); (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// module returns a WASI module whose _start function runs the instructions in body.
+// It imports fd_write as function 0 and proc_exit as function 1, and has a memory holding
+// an iovec at 0 for the line "hello\n" at 16.
+func module(body []byte) []byte {
+	section := func(id byte, content ...byte) []byte {
+		return append([]byte{id, byte(len(content))}, content...)
+	}
+	name := func(s string) []byte { return append([]byte{byte(len(s))}, s...) }
+	wasi := name("wasi_snapshot_preview1")
+
+	m := []byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00}
+	// (i32 i32 i32 i32) -> i32, (i32) -> (), () -> ()
+	m = append(m, section(1, 3, 0x60, 4, 0x7f, 0x7f, 0x7f, 0x7f, 1, 0x7f, 0x60, 1, 0x7f, 0, 0x60, 0, 0)...)
+	imports := []byte{2}
+	imports = append(append(append(imports, wasi...), name("fd_write")...), 0x00, 0)
+	imports = append(append(append(imports, wasi...), name("proc_exit")...), 0x00, 1)
+	m = append(m, section(2, imports...)...)
+	m = append(m, section(3, 1, 2)...)
+	m = append(m, section(5, 1, 0, 1)...)
+	exports := []byte{2}
+	exports = append(append(exports, name("memory")...), 0x02, 0)
+	exports = append(append(exports, name("_start")...), 0x00, 2)
+	m = append(m, section(7, exports...)...)
+	fn := append(append([]byte{0}, body...), 0x0b)
+	m = append(m, section(10, append([]byte{1, byte(len(fn))}, fn...)...)...)
+	data := append([]byte{16, 0, 0, 0, 6, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, "hello\n"...)
+	m = append(m, section(11, append([]byte{1, 0, 0x41, 0, 0x0b, byte(len(data))}, data...)...)...)
+
+	return m
+}
@@ -1,11 +1,38 @@
 package spec
 
-import "fmt"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Workflow is an ordered set of actions to run.
+type Workflow struct {
+	// ID is a unique identifier for the workflow.
+	ID string `json:"id" yaml:"id"`
+
+	// Actions are run in order. An action is only run once all actions before it have succeeded.
+	Actions []Action `json:"actions" yaml:"actions"`
+
+	// GlobalTimeoutSeconds is the maximum amount of time the whole workflow can run.
+	// +optional
+	GlobalTimeoutSeconds int `json:"globalTimeoutSeconds,omitempty" yaml:"globalTimeoutSeconds,omitempty"`
+
+	// Metadata is arbitrary information about the workflow provided by the transport.
+	// +optional
+	Metadata map[string]string `json:"metadata,omitempty" yaml:"metadata,omitempty"`
+}
 
 // Action holds the configuration used to create and run an Action container.
 type Action struct {
 	TaskName string
-	ID       string `json:"id" yaml:"id"`
+	// WorkflowID is the ID of the workflow the action belongs to.
+	// +optional
+	WorkflowID string `json:"workflowID,omitempty" yaml:"workflowID,omitempty"`
+	ID         string `json:"id" yaml:"id"`
 	// Name is a name for the action.
 	Name string `json:"name" yaml:"name"`
 
@@ -36,6 +63,141 @@ type Action struct {
 	Namespaces     Namespaces `json:"namespaces,omitempty" yaml:"namespaces,omitempty"`
 	Retries        int        `json:"retries" yaml:"retries"`
 	TimeoutSeconds int        `json:"timeoutSeconds" yaml:"timeoutSeconds"`
+
+	// RetryPolicy controls how the action is retried when it fails. When not set the action is run
+	// up to Retries times, without a delay, and TimeoutSeconds applies to all attempts together.
+	// +optional
+	RetryPolicy *RetryPolicy `json:"retryPolicy,omitempty" yaml:"retryPolicy,omitempty"`
+
+	// OnTimeout is a command run in the image of the action once the action times out, for example to
+	// collect diagnostics. The first element is the command and the rest its arguments.
+	// +optional
+	OnTimeout []string `json:"onTimeout,omitempty" yaml:"onTimeout,omitempty"`
+
+	// OnFailure is a command run in the image of the action once the action fails for any other reason.
+	// +optional
+	OnFailure []string `json:"onFailure,omitempty" yaml:"onFailure,omitempty"`
+}
+
+// RetryPolicy defines when and how often a failed action is run again.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of times the action is run, including the first attempt.
+	// Defaults to the action's Retries.
+	// +optional
+	MaxAttempts int `json:"maxAttempts,omitempty" yaml:"maxAttempts,omitempty"`
+
+	// InitialDelaySeconds is the delay before the first retry.
+	// +optional
+	InitialDelaySeconds float64 `json:"initialDelaySeconds,omitempty" yaml:"initialDelaySeconds,omitempty"`
+
+	// Multiplier is applied to the delay after every retry. Values less than 1 are treated as 1.
+	// +optional
+	Multiplier float64 `json:"multiplier,omitempty" yaml:"multiplier,omitempty"`
+
+	// MaxDelaySeconds caps the delay between retries. 0 means no cap.
+	// +optional
+	MaxDelaySeconds float64 `json:"maxDelaySeconds,omitempty" yaml:"maxDelaySeconds,omitempty"`
+
+	// Jitter randomizes each delay by up to this fraction of it, in either direction. It must be between 0 and 1.
+	// +optional
+	Jitter float64 `json:"jitter,omitempty" yaml:"jitter,omitempty"`
+
+	// TimeoutScope is whether the action's TimeoutSeconds applies to each attempt or to all attempts together.
+	// Defaults to TimeoutScopeTotal.
+	// +optional
+	TimeoutScope TimeoutScope `json:"timeoutScope,omitempty" yaml:"timeoutScope,omitempty"`
+
+	// RetryOn are the classes of failure that are retried. All failures are retried when empty.
+	// +optional
+	RetryOn []FailureClass `json:"retryOn,omitempty" yaml:"retryOn,omitempty"`
+}
+
+type TimeoutScope string
+
+const (
+	// TimeoutScopeAttempt gives every attempt the full action timeout.
+	TimeoutScopeAttempt TimeoutScope = "attempt"
+	// TimeoutScopeTotal bounds all attempts, and the delays between them, by the action timeout.
+	TimeoutScopeTotal TimeoutScope = "total"
+)
+
+// FailureClass is a broad category of action failure.
+type FailureClass string
+
+const (
+	// FailureClassImagePull is a failure to pull the action image.
+	FailureClassImagePull FailureClass = "image-pull"
+	// FailureClassNonZeroExit is an action that exited with a non-zero status.
+	FailureClassNonZeroExit FailureClass = "non-zero-exit"
+	// FailureClassTimeout is an action that did not complete within its timeout.
+	FailureClassTimeout FailureClass = "timeout"
+	// FailureClassRuntime is any other failure of the runtime to run the action.
+	FailureClassRuntime FailureClass = "runtime"
+)
+
+var (
+	// ErrImagePull is wrapped by runtime executors when the image of an action cannot be pulled.
+	ErrImagePull = errors.New("unable to pull image")
+	// ErrNonZeroExit is wrapped by runtime executors when an action exits with a non-zero status.
+	ErrNonZeroExit = errors.New("non-zero exit status")
+)
+
+// Classify returns the failure class of an error returned by a runtime executor.
+func Classify(err error) FailureClass {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return FailureClassTimeout
+	case errors.Is(err, ErrImagePull):
+		return FailureClassImagePull
+	case errors.Is(err, ErrNonZeroExit):
+		return FailureClassNonZeroExit
+	}
+
+	return FailureClassRuntime
+}
+
+// Reason returns the UpperCamelCase failure reason for f.
+func (f FailureClass) Reason() string {
+	switch f {
+	case FailureClassImagePull:
+		return "ImagePullFailed"
+	case FailureClassNonZeroExit:
+		return "NonZeroExit"
+	case FailureClassTimeout:
+		return "Timeout"
+	}
+
+	return "RuntimeError"
+}
+
+// Result is the outcome of executing an action.
+type Result struct {
+	// ExitCode is the exit status of the action. It is -1 when the action did not exit normally.
+	ExitCode int `json:"exitCode"`
+	// Started is when the action started running.
+	Started time.Time `json:"started"`
+	// Finished is when the action stopped running.
+	Finished time.Time `json:"finished"`
+	// Signal is the name of the signal that terminated the action, if any.
+	Signal string `json:"signal,omitempty"`
+	// OOMKilled is whether the action was killed because it ran out of memory.
+	OOMKilled bool `json:"oomKilled,omitempty"`
+	// Output is the most recent lines of output of the action.
+	Output []LogLine `json:"output,omitempty"`
+	// Reason is an UpperCamelCase word or phrase concisely describing why the action failed.
+	Reason string `json:"reason,omitempty"`
+	// Message is a human readable description of why the action failed.
+	Message string `json:"message,omitempty"`
+	// Outputs are key/value pairs provided by the action.
+	Outputs map[string]string `json:"outputs,omitempty"`
+}
+
+// Duration returns how long the action ran.
+func (r Result) Duration() time.Duration {
+	if r.Started.IsZero() || r.Finished.Before(r.Started) {
+		return 0
+	}
+	return r.Finished.Sub(r.Started)
 }
 
 type Env struct {
@@ -71,12 +233,30 @@ type Namespaces struct {
 	PID string `json:"pid,omitempty" yaml:"pid,omitempty"`
 }
 
+// Event is a change in the state of a workflow or one of its actions.
 type Event struct {
-	Action  Action
-	Message string
-	State   State
+	// ID is unique to the event. The agent sets it once, when the event is created, so every attempt to report
+	// the same event has the same ID.
+	ID         string    `json:"id,omitempty"`
+	Type       EventType `json:"type"`
+	WorkflowID string    `json:"workflowID"`
+	// Action is the action the event is about. It is empty for workflow events.
+	Action  Action `json:"action"`
+	Message string `json:"message,omitempty"`
+	State   State  `json:"state"`
+	// Result is the outcome of the action. It is only set for action events in a final state.
+	Result Result `json:"result"`
 }
 
+type EventType string
+
+const (
+	// EventTypeAction is the type of events about a single action.
+	EventTypeAction EventType = "action"
+	// EventTypeWorkflow is the type of events about a workflow as a whole.
+	EventTypeWorkflow EventType = "workflow"
+)
+
 type State string
 
 const (
@@ -84,8 +264,69 @@ const (
 	StateFailure State = "failure"
 	StateRunning State = "running"
 	StateTimeout State = "timeout"
+	// StateCancelled is the state of an action that was stopped because its workflow was cancelled.
+	StateCancelled State = "cancelled"
+	// StateRetrying is the state of an action that failed and will be run again.
+	StateRetrying State = "retrying"
 )
 
+// Key identifies e so that transports can drop duplicates of it, such as when it is reported again after a
+// restart. It is ID when set. Otherwise it is made from what e is about, which cannot tell apart events of
+// actions that have neither an ID nor a name of their own.
+func (e Event) Key() string {
+	if e.ID != "" {
+		return e.ID
+	}
+	key := []string{e.WorkflowID, string(e.Type), e.Action.ID, e.Action.Name, string(e.State)}
+	if !e.Result.Started.IsZero() {
+		key = append(key, strconv.FormatInt(e.Result.Started.UnixNano(), 10))
+	}
+
+	return strings.Join(key, ".")
+}
+
 func (e Event) String() string {
+	if e.Type == EventTypeWorkflow {
+		return fmt.Sprintf("workflow: %v, message: %v, state: %v", e.WorkflowID, e.Message, e.State)
+	}
+	if e.Result.Reason != "" {
+		return fmt.Sprintf("action: %v, message: %v, state: %v, reason: %v", e.Action, e.Message, e.State, e.Result.Reason)
+	}
 	return fmt.Sprintf("action: %v, message: %v, state: %v", e.Action, e.Message, e.State)
 }
+
+// IsFinal reports whether s is a terminal state.
+func (s State) IsFinal() bool {
+	return s != StateRunning && s != StateRetrying
+}
+
+// LogLine is a single line of output from an action.
+type LogLine struct {
+	WorkflowID string    `json:"workflowID"`
+	ActionID   string    `json:"actionID"`
+	ActionName string    `json:"actionName"`
+	Stream     Stream    `json:"stream"`
+	Time       time.Time `json:"time"`
+	Text       string    `json:"text"`
+}
+
+// Stream is the output stream a LogLine originated from.
+type Stream string
+
+const (
+	StreamStdout Stream = "stdout"
+	StreamStderr Stream = "stderr"
+)
+
+// WorkflowState is the progress of a workflow, persisted so that it can be resumed after the agent restarts.
+type WorkflowState struct {
+	WorkflowID string `json:"workflowID"`
+	// CompletedActions are the IDs of the actions that have succeeded.
+	CompletedActions []string `json:"completedActions"`
+	// Outputs are the outputs of the completed actions, later ones overriding earlier ones.
+	Outputs map[string]string `json:"outputs,omitempty"`
+	// LastEvent is the most recent event for the workflow.
+	LastEvent Event `json:"lastEvent"`
+	// Reported is whether LastEvent was written to the transport.
+	Reported bool `json:"reported"`
+}
@@ -0,0 +1,152 @@
+package file
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/jacobweinstock/tink-agent/spec"
+)
+
+// ext is the file extension of saved workflow state.
+const ext = ".json"
+
+// CorruptSuffix is added to the name of a state file that cannot be decoded, so that it is kept for inspection
+// but no longer listed.
+const CorruptSuffix = ".corrupt"
+
+// Config is a state store that saves the state of each workflow as a JSON file in Dir.
+type Config struct {
+	Dir string
+	// Log, when set, is where state files that cannot be read are reported.
+	Log *slog.Logger
+
+	mu sync.Mutex
+}
+
+func (c *Config) Get(_ context.Context, workflowID string) (spec.WorkflowState, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st, err := c.read(c.path(workflowID))
+	if errors.Is(err, os.ErrNotExist) {
+		return spec.WorkflowState{}, nil
+	}
+
+	return st, err
+}
+
+func (c *Config) Put(_ context.Context, state spec.WorkflowState) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := os.MkdirAll(c.Dir, 0o700); err != nil {
+		return fmt.Errorf("error creating state directory: %w", err)
+	}
+	b, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("error encoding workflow state: %w", err)
+	}
+
+	// Write to a temporary file and rename it so a crash never leaves a partially written file behind.
+	tmp, err := os.CreateTemp(c.Dir, ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("error creating workflow state file: %w", err)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	if _, err := tmp.Write(b); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("error writing workflow state file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("error syncing workflow state file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error closing workflow state file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), c.path(state.WorkflowID)); err != nil {
+		return fmt.Errorf("error saving workflow state file: %w", err)
+	}
+
+	return nil
+}
+
+func (c *Config) Delete(_ context.Context, workflowID string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := os.Remove(c.path(workflowID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("error deleting workflow state file: %w", err)
+	}
+
+	return nil
+}
+
+func (c *Config) List(_ context.Context) ([]spec.WorkflowState, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entries, err := os.ReadDir(c.Dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error reading state directory: %w", err)
+	}
+
+	states := []spec.WorkflowState{}
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ext {
+			continue
+		}
+		name := filepath.Join(c.Dir, e.Name())
+		st, err := c.read(name)
+		if err != nil {
+			// One bad file must not stop the state of every other workflow from being resumed.
+			c.quarantine(name, err)
+			continue
+		}
+		states = append(states, st)
+	}
+
+	return states, nil
+}
+
+// quarantine renames the state file name that could not be read so that it is not listed again.
+func (c *Config) quarantine(name string, err error) {
+	// A file deleted since the directory was read is not a problem.
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	attrs := []any{"file", name, "error", err}
+	if rerr := os.Rename(name, name+CorruptSuffix); rerr != nil {
+		attrs = append(attrs, "renameError", rerr)
+	} else {
+		attrs = append(attrs, "renamedTo", name+CorruptSuffix)
+	}
+	if c.Log != nil {
+		c.Log.Info("skipping workflow state file that cannot be read", attrs...)
+	}
+}
+
+func (c *Config) read(name string) (spec.WorkflowState, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return spec.WorkflowState{}, err
+	}
+	st := spec.WorkflowState{}
+	if err := json.Unmarshal(b, &st); err != nil {
+		return spec.WorkflowState{}, fmt.Errorf("error decoding workflow state file %v: %w", name, err)
+	}
+
+	return st, nil
+}
+
+// path returns the file the state of workflowID is saved in.
+// Workflow IDs can contain characters such as '/' so they are escaped.
+func (c *Config) path(workflowID string) string {
+	return filepath.Join(c.Dir, url.PathEscape(workflowID)+ext)
+}
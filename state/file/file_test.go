@@ -0,0 +1,101 @@
+package file_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/jacobweinstock/tink-agent/agent/agenttest"
+	"github.com/jacobweinstock/tink-agent/spec"
+	"github.com/jacobweinstock/tink-agent/state/file"
+)
+
+func TestPutGet(t *testing.T) {
+	ctx := context.Background()
+	s := &file.Config{Dir: filepath.Join(t.TempDir(), "state"), Log: agenttest.Logger(t)}
+	got, err := s.Get(ctx, "wf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(spec.WorkflowState{}, got); diff != "" {
+		t.Errorf("unexpected state of an unknown workflow (-want +got):\n%s", diff)
+	}
+
+	// Workflow IDs can have characters that are not valid in file names.
+	want := spec.WorkflowState{
+		WorkflowID:       "ns/wf",
+		CompletedActions: []string{"a1"},
+		Outputs:          map[string]string{"key": "value"},
+		LastEvent:        spec.Event{ID: "e1", Type: spec.EventTypeAction, WorkflowID: "ns/wf", Action: spec.Action{ID: "a1"}, State: spec.StateSuccess},
+		Reported:         true,
+	}
+	for _, st := range []spec.WorkflowState{{WorkflowID: "ns/wf"}, want} {
+		if err := s.Put(ctx, st); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, err = s.Get(ctx, "ns/wf"); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected state (-want +got):\n%s", diff)
+	}
+}
+
+func TestListDelete(t *testing.T) {
+	ctx := context.Background()
+	s := &file.Config{Dir: t.TempDir(), Log: agenttest.Logger(t)}
+	states, err := s.List(ctx)
+	if err != nil || len(states) != 0 {
+		t.Fatalf("got states %v and error %v, want none", states, err)
+	}
+	for _, id := range []string{"wf1", "wf2"} {
+		if err := s.Put(ctx, spec.WorkflowState{WorkflowID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Delete(ctx, "wf1"); err != nil {
+		t.Fatal(err)
+	}
+	// Deleting state that does not exist is not an error.
+	if err := s.Delete(ctx, "wf1"); err != nil {
+		t.Fatal(err)
+	}
+	if states, err = s.List(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]spec.WorkflowState{{WorkflowID: "wf2"}}, states); diff != "" {
+		t.Errorf("unexpected states (-want +got):\n%s", diff)
+	}
+}
+
+// TestListCorrupt tests that a state file that cannot be decoded is set aside and the other states are listed.
+func TestListCorrupt(t *testing.T) {
+	ctx := context.Background()
+	s := &file.Config{Dir: t.TempDir(), Log: agenttest.Logger(t)}
+	if err := s.Put(ctx, spec.WorkflowState{WorkflowID: "wf1"}); err != nil {
+		t.Fatal(err)
+	}
+	corrupt := filepath.Join(s.Dir, "wf2.json")
+	if err := os.WriteFile(corrupt, []byte(`{"workflowID": "wf2", "completedAc`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for range 2 {
+		states, err := s.List(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff([]spec.WorkflowState{{WorkflowID: "wf1"}}, states); diff != "" {
+			t.Errorf("unexpected states (-want +got):\n%s", diff)
+		}
+	}
+	if _, err := os.Stat(corrupt + file.CorruptSuffix); err != nil {
+		t.Errorf("corrupt file was not kept: %v", err)
+	}
+	if _, err := s.Get(ctx, "wf2"); err != nil {
+		t.Errorf("got error %v getting the state of the corrupt file, want none", err)
+	}
+}
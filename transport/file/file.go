@@ -2,57 +2,424 @@ package file
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log/slog"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/jacobweinstock/tink-agent/pkg/conv"
 	"github.com/jacobweinstock/tink-agent/spec"
-	"gopkg.in/yaml.v3"
+)
+
+// DefaultPollInterval is how often FileLoc is checked for new workflow files in watch mode when PollInterval is not set.
+const DefaultPollInterval = 2 * time.Second
+
+// Suffixes of the files written for every workflow file, they are added to the workflow file name.
+const (
+	StatusSuffix = ".status.json"
+	LogSuffix    = ".log"
 )
 
 type Config struct {
-	Log     *slog.Logger
-	Actions chan spec.Action
+	Log       *slog.Logger
+	Workflows chan spec.Workflow
+	// FileLoc is a workflow file or a directory of them. Workflow files in a directory are the files with a
+	// .yaml, .yml, or .json extension, they are read in name order. Hidden files are ignored, so files can be
+	// copied into the directory under a hidden name and renamed once complete.
 	FileLoc string
-	cancel  chan bool
+	// Watch keeps checking FileLoc for new workflow files every PollInterval. A file is only read once its size
+	// and modification time have not changed for one interval, so partially copied files are not read.
+	// Without Watch the workflow files in FileLoc are read once when the transport starts.
+	Watch        bool
+	PollInterval time.Duration
+	// DoneDir and FailedDir are where a workflow file is moved, along with its status and log files, once all
+	// of its workflows have completed, to DoneDir when they all succeeded and to FailedDir otherwise.
+	// Relative paths are relative to the directory of the workflow files. Files are not moved when empty.
+	DoneDir   string
+	FailedDir string
+	// StatusDir is where status and log files are written. They are written next to the workflow file when
+	// empty. Set it when the workflow files are on read-only media, such as an ISO.
+	StatusDir string
+
+	mu sync.Mutex
+	// jobs are the workflow files being run, by the ID of each of their workflows.
+	jobs map[string]*job
+	// active are the paths of the workflow files being run.
+	active map[string]bool
+	// handled are the paths of workflow files that completed but could not be moved or recorded as complete.
+	handled map[string]bool
+	// stamps are the size and modification time workflow files had when FileLoc was last checked.
+	stamps map[string]stamp
+}
+
+// Status is the content of the status file of a workflow file. It is rewritten on every event.
+type Status struct {
+	// File is the path of the workflow file.
+	File string `json:"file"`
+	// State is pending until all the workflows in the file completed, then it is success when all of them
+	// succeeded and the final state of the first one that did not otherwise.
+	State spec.State `json:"state"`
+	// Error is why the file could not be read.
+	Error     string           `json:"error,omitempty"`
+	Workflows []WorkflowStatus `json:"workflows"`
+	// Events are all the events of the workflows in the file, in the order they were written.
+	Events []spec.Event `json:"events"`
+}
+
+type WorkflowStatus struct {
+	ID    string     `json:"id"`
+	State spec.State `json:"state"`
+}
+
+// StatePending is the state of a workflow file, and of its workflows, before they completed or started.
+const StatePending spec.State = "pending"
+
+// job is a workflow file being run.
+type job struct {
+	path      string
+	status    Status
+	remaining int
+}
+
+type stamp struct {
+	size    int64
+	modTime time.Time
 }
 
-// func(yield func(spec.Action) bool)
 func (c *Config) Start(ctx context.Context) error {
-	c.Log.Info("file transport starting")
-	c.cancel = make(chan bool)
-	contents, err := os.ReadFile(c.FileLoc)
+	c.Log.Info("file transport starting", "path", c.FileLoc, "watch", c.Watch)
+	if !c.Watch {
+		// Without Watch there is nothing to wait for, the files have to be there already.
+		if _, err := os.Stat(c.FileLoc); err != nil {
+			return err
+		}
+		c.scan(ctx)
+		return nil
+	}
+	interval := c.PollInterval
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		c.scan(ctx)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+		}
+	}
+}
+
+func (c *Config) Read(ctx context.Context) (spec.Workflow, error) {
+	select {
+	case <-ctx.Done():
+		return spec.Workflow{}, context.Canceled
+	case v := <-c.Workflows:
+		return v, nil
+	}
+}
+
+// Write records event in the status file of the workflow file it belongs to. Once every workflow in the
+// file has completed the file is moved to DoneDir or FailedDir. Events of unknown workflows are ignored.
+func (c *Config) Write(_ context.Context, event spec.Event) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	j, ok := c.jobs[event.WorkflowID]
+	if !ok {
+		return nil
+	}
+	j.status.Events = append(j.status.Events, event)
+	if event.Type == spec.EventTypeWorkflow {
+		for i := range j.status.Workflows {
+			if j.status.Workflows[i].ID == event.WorkflowID {
+				j.status.Workflows[i].State = event.State
+			}
+		}
+		if event.State.IsFinal() {
+			delete(c.jobs, event.WorkflowID)
+			j.remaining--
+		}
+	}
+	if j.remaining > 0 {
+		return c.writeStatus(j)
+	}
+
+	j.status.State = spec.StateSuccess
+	for _, wf := range j.status.Workflows {
+		if wf.State != spec.StateSuccess {
+			j.status.State = wf.State
+			break
+		}
+	}
+	err := c.writeStatus(j)
+	c.finish(j, err == nil)
+
+	return err
+}
+
+// WriteLog appends line, as JSON, to the log file of the workflow file the workflow of line belongs to.
+// Lines of unknown workflows are ignored.
+func (c *Config) WriteLog(_ context.Context, line spec.LogLine) error {
+	b, err := json.Marshal(line)
 	if err != nil {
 		return err
 	}
-	actions := []spec.Action{}
-	if err := yaml.Unmarshal(contents, &actions); err != nil {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	j, ok := c.jobs[line.WorkflowID]
+	if !ok {
+		return nil
+	}
+	f, err := os.OpenFile(c.sidePath(j.path, LogSuffix), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
 		return err
 	}
-	for _, action := range actions {
-		select {
-		case <-ctx.Done():
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// scan sends the workflows of every workflow file in FileLoc that is ready to be read, until ctx is done.
+func (c *Config) scan(ctx context.Context) {
+	paths, err := c.paths()
+	if err != nil {
+		// In watch mode FileLoc may not exist yet, such as before removable media is mounted.
+		c.Log.Debug("unable to list workflow files", "path", c.FileLoc, "error", err)
+		return
+	}
+	c.pruneStamps(paths)
+	for _, path := range paths {
+		for _, wf := range c.load(path) {
+			select {
+			case <-ctx.Done():
+				return
+			case c.Workflows <- wf:
+			}
+		}
+	}
+}
+
+// paths returns the workflow files in FileLoc, in name order.
+func (c *Config) paths() ([]string, error) {
+	fi, err := os.Stat(c.FileLoc)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return []string{c.FileLoc}, nil
+	}
+	entries, err := os.ReadDir(c.FileLoc)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, e := range entries {
+		name := e.Name()
+		if !e.Type().IsRegular() || strings.HasPrefix(name, ".") || strings.HasSuffix(name, StatusSuffix) {
+			continue
+		}
+		switch filepath.Ext(name) {
+		case ".yaml", ".yml", ".json":
+			paths = append(paths, filepath.Join(c.FileLoc, name))
+		}
+	}
+
+	return paths, nil
+}
+
+// load returns the workflows of the workflow file at path and starts recording their status.
+// Nothing is returned when the file is not ready to be read, is already being run, or has already completed.
+func (c *Config) load(path string) []spec.Workflow {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.active[path] || c.handled[path] {
+		return nil
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil
+	}
+	if c.Watch {
+		s := stamp{size: fi.Size(), modTime: fi.ModTime()}
+		prev, ok := c.stamps[path]
+		if c.stamps == nil {
+			c.stamps = map[string]stamp{}
+		}
+		c.stamps[path] = s
+		if !ok || prev != s {
 			return nil
-		case <-c.cancel:
+		}
+	}
+	if st, err := readStatus(c.sidePath(path, StatusSuffix)); err == nil && st.State != "" && st.State != StatePending {
+		// Remove the status file to run a completed workflow file again.
+		return nil
+	}
+
+	log := c.Log.With("file", path)
+	j := &job{path: path, status: Status{File: path, State: StatePending, Workflows: []WorkflowStatus{}, Events: []spec.Event{}}}
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		log.Info("unable to read workflow file", "error", err)
+		return nil
+	}
+	// Workflows without an ID use the file name.
+	id := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	wfs, err := conv.ParseWorkflows(contents, id)
+	if err == nil && len(wfs) == 0 {
+		err = errors.New("no workflows")
+	}
+	if err != nil {
+		log.Info("invalid workflow file", "error", err)
+		j.status.State, j.status.Error = spec.StateFailure, err.Error()
+		err := c.writeStatus(j)
+		if err != nil {
+			log.Info("unable to write workflow file status", "error", err)
+		}
+		c.finish(j, err == nil)
+		return nil
+	}
+	for _, wf := range wfs {
+		if _, ok := c.jobs[wf.ID]; ok {
+			log.Info("workflow is already running from another file, waiting for it to complete", "workflowID", wf.ID)
 			return nil
-		case c.Actions <- action:
+		}
+	}
+
+	if c.jobs == nil {
+		c.jobs = map[string]*job{}
+		c.active = map[string]bool{}
+	}
+	for _, wf := range wfs {
+		j.status.Workflows = append(j.status.Workflows, WorkflowStatus{ID: wf.ID, State: StatePending})
+		c.jobs[wf.ID] = j
+	}
+	j.remaining = len(wfs)
+	c.active[path] = true
+	if err := c.writeStatus(j); err != nil {
+		log.Info("unable to write workflow file status", "error", err)
+	}
+	log.Info("read workflow file", "workflows", len(wfs))
+
+	return wfs
+}
+
+// finish moves the files of j to DoneDir or FailedDir. When they cannot be moved and the completion of j
+// was not recorded in its status file, j is remembered so it is not run again.
+func (c *Config) finish(j *job, recorded bool) {
+	delete(c.active, j.path)
+	delete(c.stamps, j.path)
+	dir := c.FailedDir
+	if j.status.State == spec.StateSuccess {
+		dir = c.DoneDir
+	}
+	if dir != "" && !filepath.IsAbs(dir) {
+		dir = filepath.Join(c.dir(), dir)
+	}
+	moved := false
+	if dir != "" {
+		if err := c.move(j.path, dir); err != nil {
+			c.Log.Info("unable to move workflow file", "file", j.path, "dir", dir, "error", err)
+		} else {
+			moved = true
+		}
+	}
+	if !moved && !recorded {
+		if c.handled == nil {
+			c.handled = map[string]bool{}
+		}
+		c.handled[j.path] = true
+	}
+}
+
+// move moves the workflow file at path, and its status and log files when they are next to it, into dir.
+func (c *Config) move(path, dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	files := []string{path}
+	if c.StatusDir == "" {
+		files = append(files, path+StatusSuffix, path+LogSuffix)
+	}
+	for _, f := range files {
+		if err := os.Rename(f, filepath.Join(dir, filepath.Base(f))); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
 		}
 	}
 
 	return nil
 }
 
-func (c *Config) Read(ctx context.Context) (spec.Action, error) {
-	select {
-	case <-ctx.Done():
-		return spec.Action{}, context.Canceled
-	case v := <-c.Actions:
-		return v, nil
+// dir returns the directory of the workflow files.
+func (c *Config) dir() string {
+	if fi, err := os.Stat(c.FileLoc); err == nil && fi.IsDir() {
+		return c.FileLoc
 	}
+	return filepath.Dir(c.FileLoc)
 }
 
-func (c *Config) Write(ctx context.Context, event spec.Event) error {
-	if event.State == spec.StateFailure || event.State == spec.StateTimeout {
-		c.Actions = make(chan spec.Action)
+// sidePath returns the path of the file with suffix that belongs to the workflow file at path.
+func (c *Config) sidePath(path, suffix string) string {
+	if c.StatusDir == "" {
+		return path + suffix
+	}
+	return filepath.Join(c.StatusDir, filepath.Base(path)+suffix)
+}
+
+// writeStatus replaces the status file of j. It is replaced with a rename so it is never partially written.
+func (c *Config) writeStatus(j *job) error {
+	b, err := json.MarshalIndent(j.status, "", "  ")
+	if err != nil {
+		return err
 	}
+	path := c.sidePath(j.path, StatusSuffix)
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err := os.WriteFile(tmp, append(b, '\n'), 0o600); err != nil {
+		return fmt.Errorf("error writing status file: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("error writing status file: %w", err)
+	}
+
 	return nil
 }
+
+// pruneStamps forgets the stamps of workflow files that are gone.
+func (c *Config) pruneStamps(paths []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for path := range c.stamps {
+		if !slices.Contains(paths, path) {
+			delete(c.stamps, path)
+		}
+	}
+	for path := range c.handled {
+		if !slices.Contains(paths, path) {
+			delete(c.handled, path)
+		}
+	}
+}
+
+func readStatus(path string) (Status, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return Status{}, err
+	}
+	var st Status
+	if err := json.Unmarshal(b, &st); err != nil {
+		return Status{}, err
+	}
+
+	return st, nil
+}
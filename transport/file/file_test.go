@@ -0,0 +1,230 @@
+package file_test
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/jacobweinstock/tink-agent/agent/agenttest"
+	"github.com/jacobweinstock/tink-agent/spec"
+	"github.com/jacobweinstock/tink-agent/transport/file"
+)
+
+func TestTransport(t *testing.T) {
+	agenttest.TestTransport(t, func(t *testing.T) agenttest.Transport {
+		tr := newTransport(t)
+		start(t, tr)
+		submit := func(_ context.Context, wf spec.Workflow) error {
+			b, err := json.Marshal(wf)
+			if err != nil {
+				return err
+			}
+			return drop(tr.FileLoc, wf.ID+".json", string(b))
+		}
+		events := func() []spec.Event {
+			var events []spec.Event
+			for _, dir := range []string{tr.FileLoc, filepath.Join(tr.FileLoc, "done"), filepath.Join(tr.FileLoc, "failed")} {
+				matches, _ := filepath.Glob(filepath.Join(dir, "*"+file.StatusSuffix))
+				for _, m := range matches {
+					// The status file may be moved to done since it was listed, it is found there next time.
+					b, err := os.ReadFile(m)
+					if err != nil {
+						return nil
+					}
+					var st file.Status
+					if err := json.Unmarshal(b, &st); err != nil {
+						return nil
+					}
+					events = append(events, st.Events...)
+				}
+			}
+			return events
+		}
+		return agenttest.Transport{Reader: tr, Writer: tr, Submit: submit, Events: events}
+	})
+}
+
+// TestWatch tests that workflow files dropped into the watched directory are run in name order and moved
+// to the done or failed directory with their status once their workflows complete.
+func TestWatch(t *testing.T) {
+	tr := newTransport(t)
+	start(t, tr)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	files := map[string]string{
+		// Multiple YAML documents, the second is a list of actions in the older format.
+		"a.yaml": "---\nid: wf-a\nactions:\n  - name: first\n    image: first:v1\n---\n- name: second\n  image: second:v1\n---\n",
+		// A stream of JSON values, one per line.
+		"b.json": `{"id": "wf-b1", "actions": [{"name": "first", "image": "first:v1"}]}` + "\n" + `{"actions": [{"name": "second", "image": "second:v1"}]}` + "\n",
+		"c.yml":  "not: [valid",
+		// Files that are not workflow files are left alone.
+		"notes.txt": "not a workflow",
+	}
+	for name, contents := range files {
+		if err := drop(tr.FileLoc, name, contents); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got []string
+	for _, state := range []spec.State{spec.StateSuccess, spec.StateSuccess, spec.StateSuccess, spec.StateFailure} {
+		wf, err := tr.Read(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, wf.ID)
+		if err := tr.WriteLog(ctx, spec.LogLine{WorkflowID: wf.ID, Text: "output of " + wf.ID}); err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range []spec.State{spec.StateRunning, state} {
+			if err := tr.Write(ctx, spec.Event{Type: spec.EventTypeWorkflow, WorkflowID: wf.ID, State: s}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if diff := cmp.Diff([]string{"wf-a", "a-2", "wf-b1", "b-2"}, got); diff != "" {
+		t.Errorf("unexpected workflows (-want +got):\n%s", diff)
+	}
+
+	done, failed := filepath.Join(tr.FileLoc, "done"), filepath.Join(tr.FileLoc, "failed")
+	// The invalid file is only read once the workflows before it are read.
+	for _, err := os.Stat(filepath.Join(failed, "c.yml")); err != nil && ctx.Err() == nil; _, err = os.Stat(filepath.Join(failed, "c.yml")) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, f := range []string{filepath.Join(done, "a.yaml"), filepath.Join(done, "a.yaml.log"), filepath.Join(failed, "b.json"), filepath.Join(failed, "c.yml"), filepath.Join(tr.FileLoc, "notes.txt")} {
+		if _, err := os.Stat(f); err != nil {
+			t.Errorf("file %v: %v", f, err)
+		}
+	}
+	st := readStatus(t, filepath.Join(done, "a.yaml"+file.StatusSuffix))
+	want := []file.WorkflowStatus{{ID: "wf-a", State: spec.StateSuccess}, {ID: "a-2", State: spec.StateSuccess}}
+	if diff := cmp.Diff(want, st.Workflows); diff != "" || st.State != spec.StateSuccess || len(st.Events) != 4 {
+		t.Errorf("got status %v with %d events, unexpected workflows (-want +got):\n%s", st.State, len(st.Events), diff)
+	}
+	if st := readStatus(t, filepath.Join(failed, "b.json"+file.StatusSuffix)); st.State != spec.StateFailure {
+		t.Errorf("got status %v, want %v", st.State, spec.StateFailure)
+	}
+	if st := readStatus(t, filepath.Join(failed, "c.yml"+file.StatusSuffix)); st.State != spec.StateFailure || st.Error == "" {
+		t.Errorf("got status %v with error %q, want %v with an error", st.State, st.Error, spec.StateFailure)
+	}
+}
+
+// TestCompleted tests that a workflow file is not run again once its status file records it completed.
+func TestCompleted(t *testing.T) {
+	tr := newTransport(t)
+	tr.DoneDir, tr.FailedDir = "", ""
+	if err := drop(tr.FileLoc, "wf.yaml", "id: wf\nactions:\n  - name: first\n    image: first:v1\n"); err != nil {
+		t.Fatal(err)
+	}
+	stop := start(t, tr)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := tr.Read(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Write(ctx, spec.Event{Type: spec.EventTypeWorkflow, WorkflowID: "wf", State: spec.StateSuccess}); err != nil {
+		t.Fatal(err)
+	}
+	stop()
+
+	// A new transport has to rely on the status file to know the workflow file completed.
+	tr = &file.Config{Log: tr.Log, Workflows: make(chan spec.Workflow), FileLoc: tr.FileLoc, Watch: true, PollInterval: 10 * time.Millisecond}
+	start(t, tr)
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if wf, err := tr.Read(ctx); err == nil {
+		t.Errorf("read workflow %v again", wf.ID)
+	}
+}
+
+// TestStatusDir tests that status and log files are written to StatusDir and only the workflow file is moved.
+func TestStatusDir(t *testing.T) {
+	tr := newTransport(t)
+	tr.StatusDir = t.TempDir()
+	tr.Watch = false
+	if err := drop(tr.FileLoc, "wf.yaml", "id: wf\nactions:\n  - name: first\n    image: first:v1\n"); err != nil {
+		t.Fatal(err)
+	}
+	start(t, tr)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := tr.Read(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.WriteLog(ctx, spec.LogLine{WorkflowID: "wf", Text: "output"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Write(ctx, spec.Event{Type: spec.EventTypeWorkflow, WorkflowID: "wf", State: spec.StateSuccess}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range []string{filepath.Join(tr.FileLoc, "done", "wf.yaml"), filepath.Join(tr.StatusDir, "wf.yaml"+file.LogSuffix)} {
+		if _, err := os.Stat(f); err != nil {
+			t.Errorf("file %v: %v", f, err)
+		}
+	}
+	if st := readStatus(t, filepath.Join(tr.StatusDir, "wf.yaml"+file.StatusSuffix)); st.State != spec.StateSuccess {
+		t.Errorf("got status %v, want %v", st.State, spec.StateSuccess)
+	}
+}
+
+// newTransport returns a transport watching a new directory.
+func newTransport(t *testing.T) *file.Config {
+	t.Helper()
+	return &file.Config{
+		Log:          agenttest.Logger(t),
+		Workflows:    make(chan spec.Workflow),
+		FileLoc:      t.TempDir(),
+		Watch:        true,
+		PollInterval: 10 * time.Millisecond,
+		DoneDir:      "done",
+		FailedDir:    "failed",
+	}
+}
+
+// start starts tr until the returned function is called or the test ends.
+func start(t *testing.T, tr *file.Config) func() {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := tr.Start(ctx); err != nil {
+			t.Errorf("starting transport: %v", err)
+		}
+	}()
+	stop := func() {
+		cancel()
+		<-done
+	}
+	t.Cleanup(stop)
+
+	return stop
+}
+
+// drop writes a file to dir the way a workflow file should be copied in, under a hidden name that is then renamed.
+func drop(dir, name, contents string) error {
+	tmp := filepath.Join(dir, "."+name)
+	if err := os.WriteFile(tmp, []byte(contents), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, name))
+}
+
+func readStatus(t *testing.T, path string) file.Status {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var st file.Status
+	if err := json.Unmarshal(b, &st); err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
@@ -0,0 +1,137 @@
+package grpc
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jacobweinstock/tink-agent/spec"
+	"github.com/jacobweinstock/tink-agent/transport/grpc/proto"
+)
+
+// toWorkflow returns the workflow request is about, made up of the actions from the current one onward that
+// belong to workerID. The actions of any following task for another worker are left to that worker.
+// An error is returned when request or any of the actions are not valid.
+func toWorkflow(workerID string, request *proto.WorkflowContext, actions []*proto.WorkflowAction) (spec.Workflow, error) {
+	id := request.GetWorkflowId()
+	if id == "" {
+		return spec.Workflow{}, errors.New("workflow has no ID")
+	}
+	index := request.GetCurrentActionIndex()
+	if index < 0 || index >= int64(len(actions)) {
+		return spec.Workflow{}, fmt.Errorf("current action index %d is out of range of the %d actions of the workflow", index, len(actions))
+	}
+
+	wf := spec.Workflow{
+		ID:       id,
+		Actions:  []spec.Action{},
+		Metadata: map[string]string{"currentTask": request.GetCurrentTask()},
+	}
+	for i := int(index); i < len(actions); i++ {
+		a := actions[i]
+		if a == nil {
+			return spec.Workflow{}, fmt.Errorf("action %d is empty", i)
+		}
+		if w := a.GetWorkerId(); w != "" && w != workerID {
+			break
+		}
+		action, err := toSpec(id, i, a)
+		if err != nil {
+			return spec.Workflow{}, fmt.Errorf("action %d (%v) is not valid: %w", i, a.GetName(), err)
+		}
+		wf.Actions = append(wf.Actions, action)
+	}
+
+	return wf, nil
+}
+
+// toSpec returns a, the action at index in the workflow with workflowID. Every field is checked, and an error
+// describing every problem found is returned when a is not valid.
+func toSpec(workflowID string, index int, a *proto.WorkflowAction) (spec.Action, error) {
+	var errs []error
+	if a.GetName() == "" {
+		errs = append(errs, errors.New("name is required"))
+	}
+	if a.GetImage() == "" {
+		errs = append(errs, errors.New("image is required"))
+	}
+	if a.GetTimeout() < 0 {
+		errs = append(errs, fmt.Errorf("timeout %d is negative", a.GetTimeout()))
+	}
+
+	action := spec.Action{
+		TaskName:       a.GetTaskName(),
+		WorkflowID:     workflowID,
+		ID:             strconv.Itoa(index),
+		Name:           a.GetName(),
+		Image:          a.GetImage(),
+		Env:            []spec.Env{},
+		Volumes:        []spec.Volume{},
+		Namespaces:     spec.Namespaces{PID: a.GetPid()},
+		Retries:        0,
+		TimeoutSeconds: int(a.GetTimeout()),
+	}
+	if cmd := a.GetCommand(); len(cmd) > 0 {
+		if cmd[0] == "" {
+			errs = append(errs, errors.New("command is empty"))
+		}
+		action.Cmd, action.Args = cmd[0], cmd[1:]
+	}
+	for i, v := range a.GetVolumes() {
+		if strings.TrimSpace(v) == "" {
+			errs = append(errs, fmt.Errorf("volume %d is empty", i))
+			continue
+		}
+		action.Volumes = append(action.Volumes, spec.Volume(v))
+	}
+	for _, v := range a.GetEnvironment() {
+		// Values may contain "=", only the first one separates the name.
+		k, val, ok := strings.Cut(v, "=")
+		if !ok || k == "" {
+			errs = append(errs, fmt.Errorf("environment variable %q is not in NAME=value form", v))
+			continue
+		}
+		action.Env = append(action.Env, spec.Env{Key: k, Value: val})
+	}
+	if pid := a.GetPid(); pid != "" && pid != "host" && (!strings.HasPrefix(pid, "container:") || pid == "container:") {
+		errs = append(errs, fmt.Errorf("pid namespace %q is not host or container:<id>", pid))
+	}
+	for _, h := range []struct {
+		name string
+		cmd  []string
+		set  *[]string
+	}{
+		{"on_timeout", a.GetOnTimeout(), &action.OnTimeout},
+		{"on_failure", a.GetOnFailure(), &action.OnFailure},
+	} {
+		if len(h.cmd) == 0 {
+			continue
+		}
+		if h.cmd[0] == "" {
+			errs = append(errs, fmt.Errorf("%v command is empty", h.name))
+			continue
+		}
+		*h.set = h.cmd
+	}
+
+	return action, errors.Join(errs...)
+}
+
+func specToProto(inState spec.State) proto.State {
+	switch inState {
+	case spec.StateRunning, spec.StateRetrying:
+		return proto.State_STATE_RUNNING
+	case spec.StateSuccess:
+		return proto.State_STATE_SUCCESS
+	case spec.StateFailure:
+		return proto.State_STATE_FAILED
+	case spec.StateTimeout:
+		return proto.State_STATE_TIMEOUT
+	case spec.StateCancelled:
+		// The v1 API has no cancelled state.
+		return proto.State_STATE_FAILED
+	}
+
+	return proto.State(-1)
+}
@@ -0,0 +1,197 @@
+package grpc
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/jacobweinstock/tink-agent/spec"
+	"github.com/jacobweinstock/tink-agent/transport/grpc/proto"
+)
+
+func TestToSpec(t *testing.T) {
+	tests := map[string]struct {
+		action  *proto.WorkflowAction
+		want    spec.Action
+		wantErr []string
+	}{
+		"all fields": {
+			action: &proto.WorkflowAction{
+				TaskName:    "os-installation",
+				Name:        "stream-image",
+				Image:       "quay.io/tinkerbell/actions/image2disk:latest",
+				Timeout:     600,
+				Command:     []string{"/usr/bin/image2disk", "--verbose"},
+				OnTimeout:   []string{"/usr/bin/diagnose", "timeout"},
+				OnFailure:   []string{"/usr/bin/diagnose"},
+				WorkerId:    "worker1",
+				Volumes:     []string{"/dev:/dev", "/var/run/docker.sock:/var/run/docker.sock:ro"},
+				Environment: []string{"DEST_DISK=/dev/sda", "IMG_URL=http://10.1.1.11:8080/image.gz?a=b&c=d", "EMPTY="},
+				Pid:         "host",
+			},
+			want: spec.Action{
+				TaskName:       "os-installation",
+				WorkflowID:     "wf1",
+				ID:             "2",
+				Name:           "stream-image",
+				Image:          "quay.io/tinkerbell/actions/image2disk:latest",
+				Cmd:            "/usr/bin/image2disk",
+				Args:           []string{"--verbose"},
+				Env:            []spec.Env{{Key: "DEST_DISK", Value: "/dev/sda"}, {Key: "IMG_URL", Value: "http://10.1.1.11:8080/image.gz?a=b&c=d"}, {Key: "EMPTY"}},
+				Volumes:        []spec.Volume{"/dev:/dev", "/var/run/docker.sock:/var/run/docker.sock:ro"},
+				Namespaces:     spec.Namespaces{PID: "host"},
+				TimeoutSeconds: 600,
+				OnTimeout:      []string{"/usr/bin/diagnose", "timeout"},
+				OnFailure:      []string{"/usr/bin/diagnose"},
+			},
+		},
+		"minimal": {
+			action: &proto.WorkflowAction{Name: "a", Image: "i"},
+			want:   spec.Action{WorkflowID: "wf1", ID: "2", Name: "a", Image: "i", Env: []spec.Env{}, Volumes: []spec.Volume{}},
+		},
+		"container pid namespace": {
+			action: &proto.WorkflowAction{Name: "a", Image: "i", Pid: "container:abc"},
+			want:   spec.Action{WorkflowID: "wf1", ID: "2", Name: "a", Image: "i", Env: []spec.Env{}, Volumes: []spec.Volume{}, Namespaces: spec.Namespaces{PID: "container:abc"}},
+		},
+		"missing name and image": {
+			action:  &proto.WorkflowAction{},
+			wantErr: []string{"name is required", "image is required"},
+		},
+		"invalid fields": {
+			action: &proto.WorkflowAction{
+				Name:        "a",
+				Image:       "i",
+				Timeout:     -1,
+				Command:     []string{""},
+				OnTimeout:   []string{"", "arg"},
+				OnFailure:   []string{""},
+				Volumes:     []string{"/dev:/dev", " "},
+				Environment: []string{"NO_EQUALS", "=value"},
+				Pid:         "container:",
+			},
+			wantErr: []string{
+				"timeout -1 is negative",
+				"command is empty",
+				"volume 1 is empty",
+				`environment variable "NO_EQUALS" is not in NAME=value form`,
+				`environment variable "=value" is not in NAME=value form`,
+				`pid namespace "container:" is not host or container:<id>`,
+				"on_timeout command is empty",
+				"on_failure command is empty",
+			},
+		},
+		"nil action": {
+			action:  nil,
+			wantErr: []string{"name is required", "image is required"},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := toSpec("wf1", 2, tt.action)
+			if len(tt.wantErr) > 0 {
+				if err == nil {
+					t.Fatal("got no error")
+				}
+				if diff := cmp.Diff(tt.wantErr, strings.Split(err.Error(), "\n")); diff != "" {
+					t.Errorf("unexpected errors (-want +got):\n%s", diff)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error %v", err)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("unexpected action (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestToWorkflow(t *testing.T) {
+	actions := []*proto.WorkflowAction{
+		{Name: "first", Image: "i", WorkerId: "worker1"},
+		{Name: "second", Image: "i", WorkerId: "worker1"},
+		{Name: "third", Image: "i", WorkerId: "worker2"},
+		{Name: "fourth", Image: "i", WorkerId: "worker1"},
+	}
+	tests := map[string]struct {
+		request     *proto.WorkflowContext
+		actions     []*proto.WorkflowAction
+		wantActions []string
+		wantErr     string
+	}{
+		"from the start": {
+			request:     &proto.WorkflowContext{WorkflowId: "wf1", CurrentTask: "task1"},
+			actions:     actions,
+			wantActions: []string{"0 first", "1 second"},
+		},
+		"from the current action": {
+			request:     &proto.WorkflowContext{WorkflowId: "wf1", CurrentActionIndex: 1},
+			actions:     actions,
+			wantActions: []string{"1 second"},
+		},
+		"after another worker": {
+			request:     &proto.WorkflowContext{WorkflowId: "wf1", CurrentActionIndex: 3},
+			actions:     actions,
+			wantActions: []string{"3 fourth"},
+		},
+		"index past the actions": {
+			request: &proto.WorkflowContext{WorkflowId: "wf1", CurrentActionIndex: 4},
+			actions: actions,
+			wantErr: "current action index 4 is out of range of the 4 actions of the workflow",
+		},
+		"negative index": {
+			request: &proto.WorkflowContext{WorkflowId: "wf1", CurrentActionIndex: -1},
+			actions: actions,
+			wantErr: "current action index -1 is out of range of the 4 actions of the workflow",
+		},
+		"no actions": {
+			request: &proto.WorkflowContext{WorkflowId: "wf1"},
+			wantErr: "current action index 0 is out of range of the 0 actions of the workflow",
+		},
+		"no ID": {
+			request: &proto.WorkflowContext{},
+			actions: actions,
+			wantErr: "workflow has no ID",
+		},
+		"nil action": {
+			request: &proto.WorkflowContext{WorkflowId: "wf1"},
+			actions: []*proto.WorkflowAction{actions[0], nil},
+			wantErr: "action 1 is empty",
+		},
+		"invalid action": {
+			request: &proto.WorkflowContext{WorkflowId: "wf1"},
+			actions: []*proto.WorkflowAction{{Name: "first", Image: "i", Environment: []string{"BAD"}}},
+			wantErr: `action 0 (first) is not valid: environment variable "BAD" is not in NAME=value form`,
+		},
+		"invalid action of another worker": {
+			request:     &proto.WorkflowContext{WorkflowId: "wf1", CurrentActionIndex: 1},
+			actions:     []*proto.WorkflowAction{actions[0], actions[1], {WorkerId: "worker2"}},
+			wantActions: []string{"1 second"},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			wf, err := toWorkflow("worker1", tt.request, tt.actions)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("got error %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error %v", err)
+			}
+			var got []string
+			for _, a := range wf.Actions {
+				got = append(got, a.ID+" "+a.Name)
+			}
+			if diff := cmp.Diff(tt.wantActions, got); diff != "" {
+				t.Errorf("unexpected actions (-want +got):\n%s", diff)
+			}
+			if wf.ID != "wf1" || wf.Metadata["currentTask"] != tt.request.GetCurrentTask() {
+				t.Errorf("got workflow %v with metadata %v", wf.ID, wf.Metadata)
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+// Package devserver is an in-process Tink server for developing and testing the agent without a Tinkerbell stack.
+//
+// It serves both the v1 WorkflowService used by the grpc transport and the v2 WorkflowService used by the grpcv2
+// transport. Workflows are loaded from the same Template and Workflow YAML used with Tinkerbell, and every status
+// reported by an agent is recorded.
+package devserver
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jacobweinstock/tink-agent/transport/grpc/proto"
+	workflow "github.com/jacobweinstock/tink-agent/transport/grpc/proto/workflow/v2"
+	"google.golang.org/grpc"
+)
+
+type Config struct {
+	Log *slog.Logger
+	// HardwareMap renders Templates that no loaded Workflow refers to, for example {"device_1": "52:54:00:0f:2e:67"}.
+	HardwareMap map[string]string
+
+	mu        sync.Mutex
+	templates map[string]string
+	runs      []*run
+	reports   []Report
+	changed   chan struct{}
+}
+
+// Workflow is the state of a loaded workflow.
+type Workflow struct {
+	ID string
+	// State is STATE_PENDING until an action is reported, then the state of the workflow as a whole.
+	State proto.State
+	// CurrentAction is the index of the action being run, or to be run next.
+	CurrentAction int
+	// CurrentActionState is the state of the current action.
+	CurrentActionState proto.State
+	Actions            int
+}
+
+// Report is a status reported by an agent.
+type Report struct {
+	Time time.Time
+	// API is the version of the workflow API the status was reported with, "v1" or "v2".
+	API        string
+	WorkflowID string
+	WorkerID   string
+	TaskName   string
+	// ActionID is the index of the action in the workflow. It is empty for reports about the workflow as a whole.
+	ActionID   string
+	ActionName string
+	State      proto.State
+	Message    string
+}
+
+// run is a loaded workflow along with its progress.
+type run struct {
+	id          string
+	actions     []*proto.WorkflowAction
+	state       proto.State
+	current     int
+	actionState proto.State
+	// end is one past the last action handed to a v2 agent, 0 when the workflow is not handed to one.
+	end int
+}
+
+// Serve serves the v1 and v2 workflow APIs on l until ctx is done.
+func (c *Config) Serve(ctx context.Context, l net.Listener) error {
+	s := grpc.NewServer()
+	proto.RegisterWorkflowServiceServer(s, &v1Server{c})
+	workflow.RegisterWorkflowServiceServer(s, &v2Server{c})
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.Serve(l)
+	}()
+	c.Log.Info("dev server listening", "addr", l.Addr().String())
+
+	select {
+	case <-ctx.Done():
+		// Streams only end when the agent disconnects, so they are not waited for.
+		s.Stop()
+		<-errs
+		return nil
+	case err := <-errs:
+		return fmt.Errorf("error serving: %w", err)
+	}
+}
+
+// Workflows returns the state of every loaded workflow, in the order they were loaded.
+func (c *Config) Workflows() []Workflow {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.workflows()
+}
+
+// Reports returns every status reported, in order.
+func (c *Config) Reports() []Report {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]Report(nil), c.reports...)
+}
+
+// Wait blocks until done returns true for the state of the loaded workflows, or ctx is done.
+// It returns the workflows done was last called with.
+func (c *Config) Wait(ctx context.Context, done func([]Workflow) bool) ([]Workflow, error) {
+	for {
+		c.mu.Lock()
+		wfs := c.workflows()
+		changed := c.changes()
+		c.mu.Unlock()
+		if done(wfs) {
+			return wfs, nil
+		}
+		select {
+		case <-ctx.Done():
+			return wfs, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// workflows returns the state of every loaded workflow. c.mu must be held.
+func (c *Config) workflows() []Workflow {
+	wfs := make([]Workflow, 0, len(c.runs))
+	for _, r := range c.runs {
+		wfs = append(wfs, Workflow{ID: r.id, State: r.state, CurrentAction: r.current, CurrentActionState: r.actionState, Actions: len(r.actions)})
+	}
+
+	return wfs
+}
+
+// changes returns a channel that is closed on the next change. c.mu must be held.
+func (c *Config) changes() <-chan struct{} {
+	if c.changed == nil {
+		c.changed = make(chan struct{})
+	}
+
+	return c.changed
+}
+
+// notify wakes up anything waiting for a change. c.mu must be held.
+func (c *Config) notify() {
+	if c.changed != nil {
+		close(c.changed)
+		c.changed = nil
+	}
+}
+
+// find returns the run with id. c.mu must be held.
+func (c *Config) find(id string) (*run, error) {
+	for _, r := range c.runs {
+		if r.id == id {
+			return r, nil
+		}
+	}
+
+	return nil, fmt.Errorf("workflow %q not found", id)
+}
+
+// record records rep and updates the progress of its workflow. c.mu must be held.
+func (c *Config) record(r *run, index int, rep Report) {
+	rep.Time = time.Now()
+	c.reports = append(c.reports, rep)
+	c.Log.Info("status reported", "api", rep.API, "workflowID", rep.WorkflowID, "worker", rep.WorkerID, "action", rep.ActionName, "state", rep.State.String(), "message", rep.Message)
+
+	defer c.notify()
+	if index < 0 {
+		r.state = rep.State
+		r.end = 0
+		return
+	}
+	r.current = index
+	r.actionState = rep.State
+	switch rep.State {
+	case proto.State_STATE_RUNNING:
+		r.state = proto.State_STATE_RUNNING
+	case proto.State_STATE_SUCCESS:
+		if index == len(r.actions)-1 {
+			r.state = proto.State_STATE_SUCCESS
+			r.end = 0
+			return
+		}
+		// The same as the Tink server, the next action is pending once an action succeeds.
+		r.current, r.actionState = index+1, proto.State_STATE_PENDING
+		if r.current == r.end {
+			r.end = 0
+		}
+	default:
+		r.state = rep.State
+		r.end = 0
+	}
+}
+
+// final reports whether s is a state a workflow does not leave.
+func final(s proto.State) bool {
+	return s == proto.State_STATE_SUCCESS || s == proto.State_STATE_FAILED || s == proto.State_STATE_TIMEOUT
+}
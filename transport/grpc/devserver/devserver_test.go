@@ -0,0 +1,288 @@
+package devserver_test
+
+import (
+	"context"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/jacobweinstock/tink-agent/agent"
+	"github.com/jacobweinstock/tink-agent/agent/agenttest"
+	"github.com/jacobweinstock/tink-agent/runtime/fake"
+	"github.com/jacobweinstock/tink-agent/spec"
+	"github.com/jacobweinstock/tink-agent/transport/grpc"
+	"github.com/jacobweinstock/tink-agent/transport/grpc/devserver"
+	"github.com/jacobweinstock/tink-agent/transport/grpc/proto"
+	workflow "github.com/jacobweinstock/tink-agent/transport/grpc/proto/workflow/v2"
+	"github.com/jacobweinstock/tink-agent/transport/grpcv2"
+	ggrpc "google.golang.org/grpc"
+)
+
+// worker is the worker in the hardware map of example/grpc_workflow.yaml.
+const worker = "52:54:00:0f:2e:67"
+
+func example(t *testing.T) []byte {
+	t.Helper()
+	var docs []string
+	for _, f := range []string{"grpc_template.yaml", "grpc_workflow.yaml"} {
+		b, err := os.ReadFile("../../../example/" + f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		docs = append(docs, string(b))
+	}
+
+	return []byte(strings.Join(docs, "\n---\n"))
+}
+
+const twoTasks = `
+kind: Template
+metadata:
+  name: two-tasks
+spec:
+  data: |
+    tasks:
+      - name: first
+        worker: "{{.device_1}}"
+        volumes: ["/dev:/dev"]
+        environment:
+          A: task
+          B: task
+        actions:
+          - name: one
+            image: one
+            command: ["/bin/one", "-v"]
+            environment:
+              B: action
+      - name: second
+        worker: "{{.device_2}}"
+        actions:
+          - name: two
+            image: two
+`
+
+func TestLoad(t *testing.T) {
+	tests := map[string]struct {
+		data        []byte
+		hardwareMap map[string]string
+		want        []devserver.Workflow
+		wantErr     string
+	}{
+		"example": {
+			data: example(t),
+			want: []devserver.Workflow{{ID: "virtual", Actions: 6}},
+		},
+		"template without a workflow": {
+			data:        []byte(twoTasks),
+			hardwareMap: map[string]string{"device_1": "w1", "device_2": "w2"},
+			want:        []devserver.Workflow{{ID: "two-tasks", Actions: 2}},
+		},
+		"missing hardware": {
+			data:    []byte(twoTasks),
+			wantErr: `template "two-tasks": error rendering template`,
+		},
+		"missing template": {
+			data:    []byte("kind: Workflow\nmetadata:\n  name: wf\nspec:\n  templateRef: nope\n"),
+			wantErr: `template "nope" not found`,
+		},
+		"unknown kind": {
+			data:    []byte("kind: Hardware\nmetadata:\n  name: hw\n"),
+			wantErr: `Hardware "hw" is not a Template or Workflow`,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			c := &devserver.Config{Log: agenttest.Logger(t), HardwareMap: tt.hardwareMap}
+			err := c.Load(tt.data)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, c.Workflows()); diff != "" {
+				t.Errorf("unexpected workflows (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestActions(t *testing.T) {
+	c := &devserver.Config{Log: agenttest.Logger(t), HardwareMap: map[string]string{"device_1": "w1", "device_2": "w2"}}
+	if err := c.Load([]byte(twoTasks)); err != nil {
+		t.Fatal(err)
+	}
+	conn := serve(t, c)
+	got, err := proto.NewWorkflowServiceClient(conn).GetWorkflowActions(context.Background(), &proto.WorkflowActionsRequest{WorkflowId: "two-tasks"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []*proto.WorkflowAction{
+		{TaskName: "first", Name: "one", Image: "one", Command: []string{"/bin/one", "-v"}, WorkerId: "w1", Volumes: []string{"/dev:/dev"}, Environment: []string{"A=task", "B=action"}},
+		{TaskName: "second", Name: "two", Image: "two", WorkerId: "w2", Environment: []string{}},
+	}
+	if len(got.GetActionList()) != len(want) {
+		t.Fatalf("got %d actions, want %d", len(got.GetActionList()), len(want))
+	}
+	for i, a := range got.GetActionList() {
+		if a.String() != want[i].String() {
+			t.Errorf("action %d is %v, want %v", i, a, want[i])
+		}
+	}
+}
+
+func TestAgent(t *testing.T) {
+	tests := map[string]struct {
+		transport func(t *testing.T, addr string) (agent.TransportReader, agent.TransportWriter)
+		outcomes  map[string][]fake.Outcome
+		want      proto.State
+		// wantReports are the states reported, in order.
+		wantReports []proto.State
+	}{
+		"v1 success": {
+			transport: v1,
+			want:      proto.State_STATE_SUCCESS,
+		},
+		"v1 failure": {
+			transport:   v1,
+			outcomes:    map[string][]fake.Outcome{"1": {{ExitCode: 1}}},
+			want:        proto.State_STATE_FAILED,
+			wantReports: []proto.State{proto.State_STATE_RUNNING, proto.State_STATE_SUCCESS, proto.State_STATE_RUNNING, proto.State_STATE_FAILED},
+		},
+		"v2 success": {
+			transport: v2,
+			want:      proto.State_STATE_SUCCESS,
+		},
+		"v2 failure": {
+			transport:   v2,
+			outcomes:    map[string][]fake.Outcome{"1": {{ExitCode: 1}}},
+			want:        proto.State_STATE_FAILED,
+			wantReports: []proto.State{proto.State_STATE_RUNNING, proto.State_STATE_SUCCESS, proto.State_STATE_RUNNING, proto.State_STATE_FAILED},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			c := &devserver.Config{Log: agenttest.Logger(t)}
+			if err := c.Load(example(t)); err != nil {
+				t.Fatal(err)
+			}
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			run(t, func(ctx context.Context) error { return c.Serve(ctx, l) })
+			tr, tw := tt.transport(t, l.Addr().String())
+			a := &agent.Config{TransportReader: tr, TransportWriter: tw, RuntimeExecutor: &fake.Config{Outcomes: tt.outcomes}}
+			run(t, func(ctx context.Context) error {
+				a.Run(ctx, agenttest.Logger(t))
+				return nil
+			})
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			wfs, err := c.Wait(ctx, func(wfs []devserver.Workflow) bool {
+				return wfs[0].State != proto.State_STATE_PENDING && wfs[0].State != proto.State_STATE_RUNNING
+			})
+			if err != nil {
+				t.Fatalf("workflow did not complete: %v, got %+v", err, wfs)
+			}
+			if wfs[0].State != tt.want {
+				t.Errorf("got workflow state %v, want %v", wfs[0].State, tt.want)
+			}
+			want := tt.wantReports
+			if want == nil {
+				for range wfs[0].Actions {
+					want = append(want, proto.State_STATE_RUNNING, proto.State_STATE_SUCCESS)
+				}
+			}
+			var got []proto.State
+			for _, r := range c.Reports() {
+				got = append(got, r.State)
+				if r.WorkerID != worker {
+					t.Errorf("got report from worker %q, want %q", r.WorkerID, worker)
+				}
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("unexpected reports (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func v1(t *testing.T, addr string) (agent.TransportReader, agent.TransportWriter) {
+	conn, err := grpc.NewClientConn(addr, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	tr := &grpc.Config{
+		Log:              agenttest.Logger(t),
+		TinkServerClient: proto.NewWorkflowServiceClient(conn),
+		WorkerID:         worker,
+		RetryInterval:    10 * time.Millisecond,
+		Workflows:        make(chan spec.Workflow),
+	}
+	run(t, tr.Start)
+
+	return tr, tr
+}
+
+func v2(t *testing.T, addr string) (agent.TransportReader, agent.TransportWriter) {
+	conn, err := grpc.NewClientConn(addr, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	tr := &grpcv2.Config{
+		Log:           agenttest.Logger(t),
+		Client:        workflow.NewWorkflowServiceClient(conn),
+		AgentID:       worker,
+		RetryInterval: 10 * time.Millisecond,
+		Workflows:     make(chan spec.Workflow),
+		Cancel:        make(chan string),
+	}
+	run(t, tr.Start)
+
+	return tr, tr
+}
+
+// serve serves c on a random local port until t completes, returning a connection to it.
+func serve(t *testing.T, c *devserver.Config) *ggrpc.ClientConn {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	run(t, func(ctx context.Context) error { return c.Serve(ctx, l) })
+	conn, err := grpc.NewClientConn(l.Addr().String(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return conn
+}
+
+// run runs f in the background until t completes.
+func run(t *testing.T, f func(context.Context) error) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := f(ctx); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
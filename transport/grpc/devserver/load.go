@@ -0,0 +1,169 @@
+package devserver
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"text/template"
+
+	"github.com/jacobweinstock/tink-agent/transport/grpc/proto"
+	"gopkg.in/yaml.v3"
+)
+
+// object is a Tinkerbell Template or Workflow.
+type object struct {
+	Kind     string `yaml:"kind"`
+	Metadata struct {
+		Name string `yaml:"name"`
+	} `yaml:"metadata"`
+	Spec struct {
+		// Data is the workflow definition of a Template.
+		Data string `yaml:"data"`
+		// TemplateRef and HardwareMap are the Template of a Workflow and the values it is rendered with.
+		TemplateRef string            `yaml:"templateRef"`
+		HardwareMap map[string]string `yaml:"hardwareMap"`
+	} `yaml:"spec"`
+}
+
+// definition is the workflow definition in the data of a Template.
+type definition struct {
+	Version string `yaml:"version"`
+	Name    string `yaml:"name"`
+	Tasks   []task `yaml:"tasks"`
+}
+
+type task struct {
+	Name        string            `yaml:"name"`
+	Worker      string            `yaml:"worker"`
+	Actions     []action          `yaml:"actions"`
+	Volumes     []string          `yaml:"volumes"`
+	Environment map[string]string `yaml:"environment"`
+}
+
+type action struct {
+	Name        string            `yaml:"name"`
+	Image       string            `yaml:"image"`
+	Timeout     int64             `yaml:"timeout"`
+	Command     []string          `yaml:"command"`
+	OnTimeout   []string          `yaml:"on-timeout"`
+	OnFailure   []string          `yaml:"on-failure"`
+	Volumes     []string          `yaml:"volumes"`
+	Environment map[string]string `yaml:"environment"`
+	Pid         string            `yaml:"pid"`
+}
+
+// Load loads the Templates and Workflows in data, which may hold multiple YAML documents.
+// Every Workflow is added, rendered from the Template it refers to. Templates that no Workflow in data refers to
+// are added as a workflow with the name of the Template, rendered with HardwareMap.
+func (c *Config) Load(data []byte) error {
+	var workflows []object
+	templates := map[string]bool{}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.templates == nil {
+		c.templates = map[string]string{}
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	for {
+		var o object
+		if err := dec.Decode(&o); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return fmt.Errorf("error decoding: %w", err)
+		}
+		switch o.Kind {
+		case "Template":
+			c.templates[o.Metadata.Name] = o.Spec.Data
+			templates[o.Metadata.Name] = true
+		case "Workflow":
+			workflows = append(workflows, o)
+		default:
+			return fmt.Errorf("%v %q is not a Template or Workflow", o.Kind, o.Metadata.Name)
+		}
+	}
+
+	var runs []*run
+	for _, wf := range workflows {
+		r, err := c.render(wf.Metadata.Name, wf.Spec.TemplateRef, wf.Spec.HardwareMap)
+		if err != nil {
+			return fmt.Errorf("workflow %q: %w", wf.Metadata.Name, err)
+		}
+		runs = append(runs, r)
+		delete(templates, wf.Spec.TemplateRef)
+	}
+	for _, name := range slices.Sorted(maps.Keys(templates)) {
+		r, err := c.render(name, name, c.HardwareMap)
+		if err != nil {
+			return fmt.Errorf("template %q: %w", name, err)
+		}
+		runs = append(runs, r)
+	}
+	for _, r := range runs {
+		if _, err := c.find(r.id); err == nil {
+			return fmt.Errorf("workflow %q is already loaded", r.id)
+		}
+	}
+	c.runs = append(c.runs, runs...)
+	c.notify()
+
+	return nil
+}
+
+// render returns a run of the Template named tmpl rendered with hardware. c.mu must be held.
+func (c *Config) render(id, tmpl string, hardware map[string]string) (*run, error) {
+	data, ok := c.templates[tmpl]
+	if !ok {
+		return nil, fmt.Errorf("template %q not found", tmpl)
+	}
+	t, err := template.New(tmpl).Option("missingkey=error").Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing template: %w", err)
+	}
+	b := new(bytes.Buffer)
+	if err := t.Execute(b, hardware); err != nil {
+		return nil, fmt.Errorf("error rendering template, is the hardware map missing a value?: %w", err)
+	}
+	var def definition
+	if err := yaml.Unmarshal(b.Bytes(), &def); err != nil {
+		return nil, fmt.Errorf("error decoding template data: %w", err)
+	}
+
+	r := &run{id: id}
+	for _, tk := range def.Tasks {
+		for _, a := range tk.Actions {
+			// Task volumes and environment apply to every action of the task, the same as the Tink server.
+			env := maps.Clone(tk.Environment)
+			if env == nil {
+				env = map[string]string{}
+			}
+			maps.Copy(env, a.Environment)
+			environment := make([]string, 0, len(env))
+			for _, k := range slices.Sorted(maps.Keys(env)) {
+				environment = append(environment, k+"="+env[k])
+			}
+			r.actions = append(r.actions, &proto.WorkflowAction{
+				TaskName:    tk.Name,
+				Name:        a.Name,
+				Image:       a.Image,
+				Timeout:     a.Timeout,
+				Command:     a.Command,
+				OnTimeout:   a.OnTimeout,
+				OnFailure:   a.OnFailure,
+				WorkerId:    strings.TrimSpace(tk.Worker),
+				Volumes:     append(slices.Clone(tk.Volumes), a.Volumes...),
+				Environment: environment,
+				Pid:         a.Pid,
+			})
+		}
+	}
+	if len(r.actions) == 0 {
+		return nil, errors.New("workflow has no actions")
+	}
+
+	return r, nil
+}
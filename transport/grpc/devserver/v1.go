@@ -0,0 +1,96 @@
+package devserver
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/jacobweinstock/tink-agent/transport/grpc/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// v1Server is the v1 WorkflowService. It behaves like the Tink server: the context of every workflow whose
+// current action belongs to the worker is sent, and a workflow advances as its actions are reported.
+type v1Server struct {
+	c *Config
+}
+
+func (s *v1Server) GetWorkflowContexts(req *proto.WorkflowContextRequest, stream proto.WorkflowService_GetWorkflowContextsServer) error {
+	var contexts []*proto.WorkflowContext
+	s.c.mu.Lock()
+	for _, r := range s.c.runs {
+		// Workflows handed to a v2 agent are left to it.
+		if final(r.state) || r.end != 0 || r.actions[r.current].GetWorkerId() != req.GetWorkerId() {
+			continue
+		}
+		a := r.actions[r.current]
+		contexts = append(contexts, &proto.WorkflowContext{
+			WorkflowId:           r.id,
+			CurrentWorker:        a.GetWorkerId(),
+			CurrentTask:          a.GetTaskName(),
+			CurrentAction:        a.GetName(),
+			CurrentActionIndex:   int64(r.current),
+			CurrentActionState:   r.actionState,
+			TotalNumberOfActions: int64(len(r.actions)),
+		})
+	}
+	s.c.mu.Unlock()
+
+	for _, wc := range contexts {
+		if err := stream.Send(wc); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *v1Server) GetWorkflowActions(_ context.Context, req *proto.WorkflowActionsRequest) (*proto.WorkflowActionList, error) {
+	s.c.mu.Lock()
+	defer s.c.mu.Unlock()
+	r, err := s.c.find(req.GetWorkflowId())
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+
+	return &proto.WorkflowActionList{ActionList: r.actions}, nil
+}
+
+func (s *v1Server) ReportActionStatus(_ context.Context, req *proto.WorkflowActionStatus) (*proto.Empty, error) {
+	s.c.mu.Lock()
+	defer s.c.mu.Unlock()
+	r, err := s.c.find(req.GetWorkflowId())
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	if final(r.state) {
+		return nil, status.Errorf(codes.FailedPrecondition, "workflow %q has already completed", r.id)
+	}
+	// Action names are only unique within a task, and may repeat in later tasks.
+	index := -1
+	for i := r.current; i < len(r.actions); i++ {
+		if r.actions[i].GetTaskName() == req.GetTaskName() && r.actions[i].GetName() == req.GetActionName() {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "workflow %q has no action %q in task %q from the current action onward", r.id, req.GetActionName(), req.GetTaskName())
+	}
+	if w := r.actions[index].GetWorkerId(); w != req.GetWorkerId() {
+		return nil, status.Errorf(codes.PermissionDenied, "action %q belongs to worker %q, not %q", req.GetActionName(), w, req.GetWorkerId())
+	}
+
+	s.c.record(r, index, Report{
+		API:        "v1",
+		WorkflowID: r.id,
+		WorkerID:   req.GetWorkerId(),
+		TaskName:   req.GetTaskName(),
+		ActionID:   strconv.Itoa(index),
+		ActionName: req.GetActionName(),
+		State:      req.GetActionStatus(),
+		Message:    req.GetMessage(),
+	})
+
+	return &proto.Empty{}, nil
+}
@@ -0,0 +1,149 @@
+package devserver
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/jacobweinstock/tink-agent/spec"
+	"github.com/jacobweinstock/tink-agent/transport/grpc/proto"
+	workflow "github.com/jacobweinstock/tink-agent/transport/grpc/proto/workflow/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// v2Server is the v2 WorkflowService. Each stream is handed one workflow at a time, made up of the actions from
+// the current one onward that belong to the agent. The next workflow is handed out once they have all completed.
+type v2Server struct {
+	c *Config
+}
+
+func (s *v2Server) GetWorkflows(req *workflow.GetWorkflowsRequest, stream workflow.WorkflowService_GetWorkflowsServer) error {
+	ctx := stream.Context()
+	var held *run
+	for {
+		var wf *workflow.Workflow
+		s.c.mu.Lock()
+		if held != nil && held.end == 0 {
+			held = nil
+		}
+		if held == nil {
+			held, wf = s.c.next(req.GetAgentId())
+		}
+		changed := s.c.changes()
+		s.c.mu.Unlock()
+
+		if wf != nil {
+			s.c.Log.Info("starting workflow", "workflowID", wf.GetWorkflowId(), "agent", req.GetAgentId(), "actions", len(wf.GetActions()))
+			cmd := &workflow.GetWorkflowsResponse_StartWorkflow_{StartWorkflow: &workflow.GetWorkflowsResponse_StartWorkflow{Workflow: wf}}
+			if err := stream.Send(&workflow.GetWorkflowsResponse{Cmd: cmd}); err != nil {
+				s.release(held)
+				return err
+			}
+		}
+		select {
+		case <-ctx.Done():
+			// The workflow is handed out again when the agent reconnects.
+			s.release(held)
+			return nil
+		case <-changed:
+		}
+	}
+}
+
+// release allows r to be handed to an agent again if it has not completed.
+func (s *v2Server) release(r *run) {
+	if r == nil {
+		return
+	}
+	s.c.mu.Lock()
+	defer s.c.mu.Unlock()
+	r.end = 0
+	s.c.notify()
+}
+
+// next returns the first workflow whose current action belongs to agentID and that is not already handed out,
+// along with the actions of it to hand to the agent. c.mu must be held.
+func (c *Config) next(agentID string) (*run, *workflow.Workflow) {
+	for _, r := range c.runs {
+		if final(r.state) || r.end != 0 || r.actions[r.current].GetWorkerId() != agentID {
+			continue
+		}
+		wf := &workflow.Workflow{WorkflowId: r.id}
+		for r.end = r.current; r.end < len(r.actions) && r.actions[r.end].GetWorkerId() == agentID; r.end++ {
+			wf.Actions = append(wf.Actions, toV2(r.end, r.actions[r.end]))
+		}
+		return r, wf
+	}
+
+	return nil, nil
+}
+
+// toV2 converts the action at index of a workflow to the v2 API. The index is used as the action ID,
+// the same as the grpc transport does.
+func toV2(index int, a *proto.WorkflowAction) *workflow.Workflow_Action {
+	wa := &workflow.Workflow_Action{
+		Id:      strconv.Itoa(index),
+		Name:    a.GetName(),
+		Image:   a.GetImage(),
+		Env:     map[string]string{},
+		Volumes: a.GetVolumes(),
+	}
+	if len(a.GetCommand()) > 0 {
+		wa.Cmd = &a.GetCommand()[0]
+		wa.Args = a.GetCommand()[1:]
+	}
+	for _, e := range a.GetEnvironment() {
+		k, v, _ := strings.Cut(e, "=")
+		wa.Env[k] = v
+	}
+
+	return wa
+}
+
+func (s *v2Server) PublishEvent(_ context.Context, req *workflow.PublishEventRequest) (*workflow.PublishEventResponse, error) {
+	ev := req.GetEvent()
+	s.c.mu.Lock()
+	defer s.c.mu.Unlock()
+	r, err := s.c.find(ev.GetWorkflowId())
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	if final(r.state) {
+		return nil, status.Errorf(codes.FailedPrecondition, "workflow %q has already completed", r.id)
+	}
+
+	rep := Report{API: "v2", WorkflowID: r.id}
+	var id string
+	switch e := ev.GetEvent().(type) {
+	case *workflow.Event_ActionStarted_:
+		id, rep.State = e.ActionStarted.GetActionId(), proto.State_STATE_RUNNING
+	case *workflow.Event_ActionSucceeded_:
+		id, rep.State = e.ActionSucceeded.GetActionId(), proto.State_STATE_SUCCESS
+	case *workflow.Event_ActionFailed_:
+		id, rep.State = e.ActionFailed.GetActionId(), proto.State_STATE_FAILED
+		if e.ActionFailed.GetFailureReason() == spec.FailureClassTimeout.Reason() {
+			rep.State = proto.State_STATE_TIMEOUT
+		}
+		rep.Message = e.ActionFailed.GetFailureMessage()
+		if reason := e.ActionFailed.GetFailureReason(); reason != "" {
+			rep.Message = reason + ": " + rep.Message
+		}
+	case *workflow.Event_WorkflowRejected_:
+		rep.State, rep.Message = proto.State_STATE_FAILED, "rejected: "+e.WorkflowRejected.GetMessage()
+		s.c.record(r, -1, rep)
+		return &workflow.PublishEventResponse{}, nil
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "unknown event %T", e)
+	}
+
+	index, err := strconv.Atoi(id)
+	if err != nil || index < r.current || index >= len(r.actions) {
+		return nil, status.Errorf(codes.InvalidArgument, "workflow %q has no action %q from the current action onward", r.id, id)
+	}
+	a := r.actions[index]
+	rep.ActionID, rep.ActionName, rep.TaskName, rep.WorkerID = id, a.GetName(), a.GetTaskName(), a.GetWorkerId()
+	s.c.record(r, index, rep)
+
+	return &workflow.PublishEventResponse{}, nil
+}
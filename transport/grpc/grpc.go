@@ -2,15 +2,15 @@ package grpc
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
-	"strings"
+	"sync"
 	"time"
 
-	"crypto/tls"
-
+	"github.com/jacobweinstock/tink-agent/pkg/backoff"
 	"github.com/jacobweinstock/tink-agent/spec"
 	"github.com/jacobweinstock/tink-agent/transport/grpc/proto"
 
@@ -24,104 +24,218 @@ type Config struct {
 	Log              *slog.Logger
 	TinkServerClient proto.WorkflowServiceClient
 	WorkerID         string
-	RetryInterval    time.Duration
-	Actions          chan spec.Action
+	// RetryInterval is how long to wait before opening the workflow context stream again once the server ends it,
+	// and the first delay of the exponential backoff after an error. Defaults to DefaultRetryInterval.
+	RetryInterval time.Duration
+	// MaxRetryInterval caps the backoff after errors. Defaults to DefaultMaxRetryInterval.
+	MaxRetryInterval time.Duration
+	Workflows        chan spec.Workflow
+
+	mu sync.Mutex
+	// inProcess is the ID of the workflow handed to the agent that has not yet completed.
+	inProcess string
+	// actions are the actions of the workflows of this worker, by workflow ID.
+	actions map[string][]*proto.WorkflowAction
 }
 
+const (
+	// DefaultRetryInterval is the RetryInterval used when none is set.
+	DefaultRetryInterval = 5 * time.Second
+	// DefaultMaxRetryInterval is the MaxRetryInterval used when none is set.
+	DefaultMaxRetryInterval = time.Minute
+)
+
 func (c *Config) Start(ctx context.Context) error {
 	c.Log.Info("grpc transport starting")
-	var inProcessAction *proto.WorkflowAction
+	interval := backoff.Or(c.RetryInterval, DefaultRetryInterval)
+	maxInterval := backoff.Or(c.MaxRetryInterval, DefaultMaxRetryInterval)
+	failures := 0
 	for {
-		select {
-		case <-ctx.Done():
+		received, err := c.watch(ctx)
+		if ctx.Err() != nil {
 			return nil
-		default:
 		}
-
-		stream, err := c.TinkServerClient.GetWorkflowContexts(ctx, &proto.WorkflowContextRequest{WorkerId: c.WorkerID})
+		if received > 0 {
+			failures = 0
+		}
+		// The stream ending without an error is the server having sent every workflow context it has,
+		// it is opened again after RetryInterval. Errors back off exponentially.
+		delay := backoff.Jitter(interval)
 		if err != nil {
+			failures++
+			delay = backoff.Exponential(interval, maxInterval, failures)
 			// TODO(jacobweinstock): handle unrecoverable errors
-			c.Log.Debug("error getting workflow contexts", "error", err)
-			<-time.After(c.RetryInterval)
-			continue
+			c.Log.Debug("error watching workflow contexts", "error", err, "retryIn", delay)
 		}
-
-		request, err := stream.Recv()
-		if err != nil && !errors.Is(err, io.EOF) {
-			c.Log.Debug("error receiving workflow context", "error", err)
-			<-time.After(c.RetryInterval)
-			continue
+		if !backoff.Wait(ctx, delay) {
+			return nil
 		}
+	}
+}
 
-		if request == nil || request.GetCurrentWorker() != c.WorkerID || request.GetCurrentActionState() != proto.State_STATE_PENDING {
-			<-time.After(c.RetryInterval)
-			continue
+// watch opens a workflow context stream and handles every context as it is received, until the server ends the
+// stream or an error occurs. It returns the number of contexts received.
+func (c *Config) watch(ctx context.Context) (int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := c.TinkServerClient.GetWorkflowContexts(ctx, &proto.WorkflowContextRequest{WorkerId: c.WorkerID})
+	if err != nil {
+		return 0, err
+	}
+	seen := map[string]bool{}
+	for received := 0; ; received++ {
+		request, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			// The server sends the context of every workflow of this worker, the actions of any other are not needed.
+			c.prune(seen)
+			return received, nil
 		}
-
-		actions, err := c.TinkServerClient.GetWorkflowActions(ctx, &proto.WorkflowActionsRequest{WorkflowId: request.GetWorkflowId()})
 		if err != nil {
-			c.Log.Debug("error getting workflow actions", "error", err)
-			<-time.After(c.RetryInterval)
-			continue
+			return received, err
 		}
-
-		curAction := actions.GetActionList()[request.GetCurrentActionIndex()]
-		if curAction.String() == inProcessAction.String() {
-			<-time.After(c.RetryInterval)
-			continue
+		seen[request.GetWorkflowId()] = true
+		if err := c.handle(ctx, request); err != nil {
+			return received + 1, err
 		}
+	}
+}
 
-		action := spec.Action{
-			TaskName:       request.GetCurrentTask(),
-			ID:             request.GetWorkflowId(),
-			Name:           curAction.Name,
-			Image:          curAction.Image,
-			Env:            []spec.Env{},
-			Volumes:        []spec.Volume{},
-			Namespaces:     spec.Namespaces{},
-			Retries:        0,
-			TimeoutSeconds: int(curAction.Timeout),
-		}
-		if len(curAction.Command) > 0 {
-			action.Cmd = curAction.Command[0]
-			if len(curAction.Command) > 1 {
-				action.Args = curAction.Command[1:]
-			}
-		}
-		for _, v := range curAction.Volumes {
-			action.Volumes = append(action.Volumes, spec.Volume(v))
-		}
-		for _, v := range curAction.GetEnvironment() {
-			kv := strings.Split(v, "=")
-			env := spec.Env{
-				Key:   kv[0],
-				Value: kv[1],
-			}
-			action.Env = append(action.Env, env)
+// handle hands the workflow of request to Read when its next action is pending and belongs to this worker.
+func (c *Config) handle(ctx context.Context, request *proto.WorkflowContext) error {
+	if done(request) {
+		c.mu.Lock()
+		delete(c.actions, request.GetWorkflowId())
+		c.mu.Unlock()
+		return nil
+	}
+	if request.GetCurrentWorker() != c.WorkerID || request.GetCurrentActionState() != proto.State_STATE_PENDING {
+		return nil
+	}
+
+	// The server moves the current action back to pending as each action of a running workflow succeeds.
+	c.mu.Lock()
+	inProcess := c.inProcess
+	c.mu.Unlock()
+	if inProcess == request.GetWorkflowId() {
+		return nil
+	}
+
+	actions, err := c.workflowActions(ctx, request.GetWorkflowId())
+	if err != nil {
+		return fmt.Errorf("error getting workflow actions: %w", err)
+	}
+
+	wf, err := toWorkflow(c.WorkerID, request, actions)
+	if err != nil {
+		return c.reject(ctx, request, err)
+	}
+
+	c.mu.Lock()
+	c.inProcess = wf.ID
+	c.mu.Unlock()
+	select {
+	case <-ctx.Done():
+	case c.Workflows <- wf:
+	}
+
+	return nil
+}
+
+// reject reports the workflow of request as failed because it is not valid, instead of running it.
+func (c *Config) reject(ctx context.Context, request *proto.WorkflowContext, reason error) error {
+	c.Log.Info("invalid workflow", "workflowID", request.GetWorkflowId(), "error", reason)
+	c.mu.Lock()
+	delete(c.actions, request.GetWorkflowId())
+	c.mu.Unlock()
+	_, err := c.TinkServerClient.ReportActionStatus(ctx, &proto.WorkflowActionStatus{
+		WorkflowId:   request.GetWorkflowId(),
+		TaskName:     request.GetCurrentTask(),
+		ActionName:   request.GetCurrentAction(),
+		ActionStatus: proto.State_STATE_FAILED,
+		Message:      "invalid workflow: " + reason.Error(),
+		WorkerId:     c.WorkerID,
+	})
+	if err != nil {
+		return fmt.Errorf("error reporting invalid workflow %v: %w", request.GetWorkflowId(), err)
+	}
+
+	return nil
+}
+
+// workflowActions returns the actions of the workflow with id. They do not change, so they are only
+// requested from the server the first time.
+func (c *Config) workflowActions(ctx context.Context, id string) ([]*proto.WorkflowAction, error) {
+	c.mu.Lock()
+	actions, ok := c.actions[id]
+	c.mu.Unlock()
+	if ok {
+		return actions, nil
+	}
+	list, err := c.TinkServerClient.GetWorkflowActions(ctx, &proto.WorkflowActionsRequest{WorkflowId: id})
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.actions == nil {
+		c.actions = map[string][]*proto.WorkflowAction{}
+	}
+	c.actions[id] = list.GetActionList()
+
+	return list.GetActionList(), nil
+}
+
+// prune forgets the actions of every workflow not in seen.
+func (c *Config) prune(seen map[string]bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id := range c.actions {
+		if !seen[id] {
+			delete(c.actions, id)
 		}
-		action.Namespaces.PID = curAction.GetPid()
+	}
+}
 
-		c.Actions <- action
-		inProcessAction = curAction
+// done reports whether the workflow of request has completed.
+func done(request *proto.WorkflowContext) bool {
+	switch request.GetCurrentActionState() {
+	case proto.State_STATE_SUCCESS:
+		return request.GetCurrentActionIndex() == request.GetTotalNumberOfActions()-1
+	case proto.State_STATE_FAILED, proto.State_STATE_TIMEOUT:
+		return true
 	}
+
+	return false
 }
 
-func (c *Config) Read(ctx context.Context) (spec.Action, error) {
+func (c *Config) Read(ctx context.Context) (spec.Workflow, error) {
 	select {
 	case <-ctx.Done():
-		return spec.Action{}, context.Canceled
-	case v := <-c.Actions:
+		return spec.Workflow{}, context.Canceled
+	case v := <-c.Workflows:
 		return v, nil
 	}
 }
 
 func (c *Config) Write(ctx context.Context, event spec.Event) error {
+	// The v1 API only knows about actions, a completed workflow only needs to be forgotten.
+	if event.Type == spec.EventTypeWorkflow {
+		if event.State.IsFinal() {
+			c.mu.Lock()
+			if c.inProcess == event.WorkflowID {
+				c.inProcess = ""
+			}
+			c.mu.Unlock()
+		}
+		return nil
+	}
+
 	ar := &proto.WorkflowActionStatus{
-		WorkflowId:   event.Action.ID,
+		WorkflowId:   event.WorkflowID,
 		TaskName:     event.Action.TaskName,
 		ActionName:   event.Action.Name,
 		ActionStatus: specToProto(event.State),
-		Seconds:      0,
+		Seconds:      int64(event.Result.Duration().Seconds()),
 		Message:      event.Message,
 		WorkerId:     c.WorkerID,
 	}
@@ -133,36 +247,27 @@ func (c *Config) Write(ctx context.Context, event spec.Event) error {
 	return nil
 }
 
-func NewClientConn(authority string, tlsEnabled bool, tlsInsecure bool) (*grpc.ClientConn, error) {
+// NewClientConn returns a connection to the Tink server at authority. The connection is not encrypted when
+// tlsCfg is nil. perRPC, for example a Token, is sent with every call when not nil. extra are added to the
+// options the connection is made with, for example keepalive parameters.
+func NewClientConn(authority string, tlsCfg *tls.Config, perRPC credentials.PerRPCCredentials, extra ...grpc.DialOption) (*grpc.ClientConn, error) {
 	if authority == "" {
 		return nil, fmt.Errorf("authority (IP:Port) is required")
 	}
-	var creds grpc.DialOption
-	if tlsEnabled { // #nosec G402
-		creds = grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{InsecureSkipVerify: tlsInsecure}))
+	opts := append([]grpc.DialOption{grpc.WithStatsHandler(otelgrpc.NewClientHandler())}, extra...)
+	if tlsCfg != nil {
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(tlsCfg)))
 	} else {
-		creds = grpc.WithTransportCredentials(insecure.NewCredentials())
+		opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	}
+	if perRPC != nil {
+		opts = append(opts, grpc.WithPerRPCCredentials(perRPC))
 	}
 
-	conn, err := grpc.NewClient(authority, creds, grpc.WithStatsHandler(otelgrpc.NewClientHandler()))
+	conn, err := grpc.NewClient(authority, opts...)
 	if err != nil {
 		return nil, fmt.Errorf("dial tinkerbell server: %w", err)
 	}
 
 	return conn, nil
 }
-
-func specToProto(inState spec.State) proto.State {
-	switch inState {
-	case spec.StateRunning:
-		return proto.State_STATE_RUNNING
-	case spec.StateSuccess:
-		return proto.State_STATE_SUCCESS
-	case spec.StateFailure:
-		return proto.State_STATE_FAILED
-	case spec.StateTimeout:
-		return proto.State_STATE_TIMEOUT
-	}
-
-	return proto.State(-1)
-}
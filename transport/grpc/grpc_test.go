@@ -0,0 +1,491 @@
+package grpc_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jacobweinstock/tink-agent/agent/agenttest"
+	"github.com/jacobweinstock/tink-agent/pkg/tlsconfig"
+	"github.com/jacobweinstock/tink-agent/pkg/tlsconfig/tlsconfigtest"
+	"github.com/jacobweinstock/tink-agent/spec"
+	tgrpc "github.com/jacobweinstock/tink-agent/transport/grpc"
+	"github.com/jacobweinstock/tink-agent/transport/grpc/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestTransport(t *testing.T) {
+	agenttest.TestTransport(t, func(t *testing.T) agenttest.Transport {
+		srv := &server{workerID: "worker1", served: make(chan struct{})}
+		conn := serve(t, func(s *grpc.Server) { proto.RegisterWorkflowServiceServer(s, srv) })
+		tr := &tgrpc.Config{
+			Log:              agenttest.Logger(t),
+			TinkServerClient: proto.NewWorkflowServiceClient(conn),
+			WorkerID:         srv.workerID,
+			RetryInterval:    10 * time.Millisecond,
+			Workflows:        make(chan spec.Workflow),
+		}
+		start(t, tr.Start)
+
+		return agenttest.Transport{Reader: tr, Writer: tr, Submit: srv.submit, Events: srv.events, Fail: srv.setFail}
+	})
+}
+
+// TestStream tests that workflow contexts are acted on as they are sent on a stream the server keeps open,
+// and that the actions of a workflow are only requested once.
+func TestStream(t *testing.T) {
+	srv := &streamServer{contexts: make(chan *proto.WorkflowContext), actions: map[string][]*proto.WorkflowAction{
+		"wf1": {{Name: "first", Image: "first:v1", WorkerId: "worker1"}, {Name: "second", Image: "second:v1", WorkerId: "worker1"}},
+		"wf2": {{Name: "only", Image: "only:v1", WorkerId: "worker1"}},
+	}}
+	conn := serve(t, func(s *grpc.Server) { proto.RegisterWorkflowServiceServer(s, srv) })
+	tr := &tgrpc.Config{
+		Log:              agenttest.Logger(t),
+		TinkServerClient: proto.NewWorkflowServiceClient(conn),
+		WorkerID:         "worker1",
+		RetryInterval:    time.Minute,
+		Workflows:        make(chan spec.Workflow),
+	}
+	start(t, tr.Start)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	steps := []struct {
+		id          string
+		index       int64
+		wantActions []string
+	}{
+		{"wf1", 0, []string{"first", "second"}},
+		// The same workflow again, as when a task of another worker runs in between.
+		{"wf1", 1, []string{"second"}},
+		{"wf2", 0, []string{"only"}},
+	}
+	for _, s := range steps {
+		wc := &proto.WorkflowContext{WorkflowId: s.id, CurrentWorker: "worker1", CurrentActionIndex: s.index, CurrentActionState: proto.State_STATE_PENDING}
+		select {
+		case srv.contexts <- wc:
+		case <-ctx.Done():
+			t.Fatal("transport is not receiving workflow contexts")
+		}
+		wf, err := tr.Read(ctx)
+		if err != nil {
+			t.Fatalf("reading workflow %v: %v", s.id, err)
+		}
+		var got []string
+		for _, a := range wf.Actions {
+			got = append(got, a.Name)
+		}
+		if wf.ID != s.id || !slices.Equal(got, s.wantActions) {
+			t.Errorf("read workflow %v with actions %v, want %v with %v", wf.ID, got, s.id, s.wantActions)
+		}
+		if err := tr.Write(ctx, spec.Event{Type: spec.EventTypeWorkflow, WorkflowID: wf.ID, State: spec.StateSuccess}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.streams != 1 {
+		t.Errorf("got %d streams opened, want 1", srv.streams)
+	}
+	if want := []string{"wf1", "wf2"}; !slices.Equal(srv.requested, want) {
+		t.Errorf("got actions requested for %v, want %v", srv.requested, want)
+	}
+}
+
+// TestInvalidWorkflow tests that a workflow that is not valid is reported as failed instead of being run.
+func TestInvalidWorkflow(t *testing.T) {
+	srv := &streamServer{contexts: make(chan *proto.WorkflowContext), actions: map[string][]*proto.WorkflowAction{
+		"invalid": {{Name: "first", Image: "first:v1", Environment: []string{"NOT_SET"}}},
+		"valid":   {{Name: "first", Image: "first:v1"}},
+	}}
+	conn := serve(t, func(s *grpc.Server) { proto.RegisterWorkflowServiceServer(s, srv) })
+	tr := &tgrpc.Config{
+		Log:              agenttest.Logger(t),
+		TinkServerClient: proto.NewWorkflowServiceClient(conn),
+		WorkerID:         "worker1",
+		RetryInterval:    time.Minute,
+		Workflows:        make(chan spec.Workflow),
+	}
+	start(t, tr.Start)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for _, id := range []string{"invalid", "valid"} {
+		wc := &proto.WorkflowContext{WorkflowId: id, CurrentWorker: "worker1", CurrentAction: "first", CurrentTask: "task1", CurrentActionState: proto.State_STATE_PENDING}
+		select {
+		case srv.contexts <- wc:
+		case <-ctx.Done():
+			t.Fatal("transport is not receiving workflow contexts")
+		}
+	}
+	wf, err := tr.Read(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wf.ID != "valid" {
+		t.Errorf("read workflow %v, want valid", wf.ID)
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if len(srv.reports) != 1 {
+		t.Fatalf("got %d reports, want 1", len(srv.reports))
+	}
+	r := srv.reports[0]
+	if r.GetWorkflowId() != "invalid" || r.GetActionName() != "first" || r.GetTaskName() != "task1" || r.GetActionStatus() != proto.State_STATE_FAILED || !strings.Contains(r.GetMessage(), "NOT_SET") {
+		t.Errorf("got report %v, want the first action of the invalid workflow failed", r)
+	}
+}
+
+// TestReconnectBackoff tests that the stream is opened again with increasing delays while the server fails.
+func TestReconnectBackoff(t *testing.T) {
+	srv := &streamServer{fail: 4, contexts: make(chan *proto.WorkflowContext)}
+	conn := serve(t, func(s *grpc.Server) { proto.RegisterWorkflowServiceServer(s, srv) })
+	tr := &tgrpc.Config{
+		Log:              agenttest.Logger(t),
+		TinkServerClient: proto.NewWorkflowServiceClient(conn),
+		WorkerID:         "worker1",
+		RetryInterval:    50 * time.Millisecond,
+		MaxRetryInterval: time.Second,
+		Workflows:        make(chan spec.Workflow),
+	}
+	start(t, tr.Start)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		srv.mu.Lock()
+		opened := srv.opened
+		srv.mu.Unlock()
+		if len(opened) > srv.fail {
+			// Each delay is double the one before, give or take the jitter.
+			first, last := opened[1].Sub(opened[0]), opened[srv.fail].Sub(opened[srv.fail-1])
+			if last < 2*first {
+				t.Errorf("got delays from %v to %v, want them to grow", first, last)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("stream was opened %d times, want %d", len(opened), srv.fail+1)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestZeroRetryInterval tests that a transport without a retry interval does not open the stream again
+// straight away after an error.
+func TestZeroRetryInterval(t *testing.T) {
+	srv := &streamServer{fail: 100, contexts: make(chan *proto.WorkflowContext)}
+	conn := serve(t, func(s *grpc.Server) { proto.RegisterWorkflowServiceServer(s, srv) })
+	tr := &tgrpc.Config{
+		Log:              agenttest.Logger(t),
+		TinkServerClient: proto.NewWorkflowServiceClient(conn),
+		WorkerID:         "worker1",
+		Workflows:        make(chan spec.Workflow),
+	}
+	start(t, tr.Start)
+
+	time.Sleep(500 * time.Millisecond)
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if len(srv.opened) > 1 {
+		t.Errorf("stream was opened %d times within 500ms, want at most once", len(srv.opened))
+	}
+}
+
+// TestClientConnAuth tests that a connection made with mutual TLS sends the token with every call.
+func TestClientConnAuth(t *testing.T) {
+	certs := tlsconfigtest.Generate(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var auth []string
+	s := grpc.NewServer(
+		grpc.Creds(credentials.NewTLS(certs.Server(t, true))),
+		grpc.UnaryInterceptor(func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			md, _ := metadata.FromIncomingContext(ctx)
+			mu.Lock()
+			auth = append(auth, md.Get("authorization")...)
+			mu.Unlock()
+			return handler(ctx, req)
+		}),
+	)
+	proto.RegisterWorkflowServiceServer(s, &server{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = s.Serve(l)
+	}()
+	t.Cleanup(func() {
+		s.Stop()
+		<-done
+	})
+
+	file := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(file, []byte("first"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	call := func(files tlsconfig.Files) error {
+		t.Helper()
+		tlsCfg, err := files.Client()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := tgrpc.NewClientConn(l.Addr().String(), tlsCfg, &tgrpc.Token{File: file})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		_, err = proto.NewWorkflowServiceClient(conn).ReportActionStatus(ctx, &proto.WorkflowActionStatus{WorkflowId: "wf1"})
+		return err
+	}
+
+	files := tlsconfig.Files{CA: certs.CA, Cert: certs.ClientCert, Key: certs.ClientKey, ServerName: certs.ServerName}
+	if err := call(files); err != nil {
+		t.Fatalf("calling with mutual TLS: %v", err)
+	}
+	if err := os.WriteFile(file, []byte("second token"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := call(files); err != nil {
+		t.Fatalf("calling with a rotated token: %v", err)
+	}
+	if err := call(tlsconfig.Files{CA: certs.CA, ServerName: certs.ServerName}); err == nil {
+		t.Error("got no error calling without a client certificate")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"Bearer first", "Bearer second token"}; !slices.Equal(auth, want) {
+		t.Errorf("server got authorization %q, want %q", auth, want)
+	}
+}
+
+// serve starts a gRPC server on a random local port with the services registered by register,
+// returning a client connection to it. Both are stopped when t completes.
+func serve(t *testing.T, register func(*grpc.Server)) *grpc.ClientConn {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := grpc.NewServer()
+	register(s)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = s.Serve(l)
+	}()
+	conn, err := tgrpc.NewClientConn(l.Addr().String(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+		s.Stop()
+		<-done
+	})
+
+	return conn
+}
+
+// start runs f in the background until t completes.
+func start(t *testing.T, f func(context.Context) error) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := f(ctx); err != nil {
+			t.Errorf("starting transport: %v", err)
+		}
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+// streamServer is a v1 workflow service that keeps the workflow context stream open, sending the contexts
+// received on contexts. The first fail streams fail.
+type streamServer struct {
+	proto.UnimplementedWorkflowServiceServer
+	contexts chan *proto.WorkflowContext
+	actions  map[string][]*proto.WorkflowAction
+	fail     int
+
+	mu sync.Mutex
+	// opened are the times streams were asked for.
+	opened []time.Time
+	// streams is the number of streams that did not fail.
+	streams   int
+	requested []string
+	reports   []*proto.WorkflowActionStatus
+}
+
+func (s *streamServer) GetWorkflowContexts(_ *proto.WorkflowContextRequest, stream proto.WorkflowService_GetWorkflowContextsServer) error {
+	s.mu.Lock()
+	s.opened = append(s.opened, time.Now())
+	if len(s.opened) <= s.fail {
+		s.mu.Unlock()
+		return status.Error(codes.Unavailable, "unavailable")
+	}
+	s.streams++
+	s.mu.Unlock()
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case wc := <-s.contexts:
+			if err := stream.Send(wc); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *streamServer) GetWorkflowActions(_ context.Context, req *proto.WorkflowActionsRequest) (*proto.WorkflowActionList, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requested = append(s.requested, req.GetWorkflowId())
+
+	return &proto.WorkflowActionList{ActionList: s.actions[req.GetWorkflowId()]}, nil
+}
+
+func (s *streamServer) ReportActionStatus(_ context.Context, req *proto.WorkflowActionStatus) (*proto.Empty, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reports = append(s.reports, req)
+
+	return &proto.Empty{}, nil
+}
+
+// server is a v1 workflow service that hands out one submitted workflow at a time and records
+// the reported action statuses.
+type server struct {
+	proto.UnimplementedWorkflowServiceServer
+	workerID string
+
+	mu sync.Mutex
+	// fail, when set, has every request fail.
+	fail bool
+	// pending is the workflow waiting for its actions to be read by the agent.
+	pending *spec.Workflow
+	// served is closed once the actions of pending have been read.
+	served   chan struct{}
+	statuses []spec.Event
+}
+
+// submit makes wf the pending workflow, blocking until its actions are read or ctx is done.
+func (s *server) submit(ctx context.Context, wf spec.Workflow) error {
+	s.mu.Lock()
+	if s.pending != nil {
+		s.mu.Unlock()
+		return errors.New("a workflow is already pending")
+	}
+	s.pending = &wf
+	served := make(chan struct{})
+	s.served = served
+	s.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-served:
+		return nil
+	}
+}
+
+func (s *server) setFail(fail bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fail = fail
+}
+
+func (s *server) events() []spec.Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]spec.Event(nil), s.statuses...)
+}
+
+func (s *server) GetWorkflowContexts(_ *proto.WorkflowContextRequest, stream proto.WorkflowService_GetWorkflowContextsServer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail {
+		return status.Error(codes.Unavailable, "unavailable")
+	}
+	if s.pending == nil {
+		return nil
+	}
+
+	return stream.Send(&proto.WorkflowContext{
+		WorkflowId:           s.pending.ID,
+		CurrentWorker:        s.workerID,
+		CurrentAction:        s.pending.Actions[0].Name,
+		CurrentActionState:   proto.State_STATE_PENDING,
+		TotalNumberOfActions: int64(len(s.pending.Actions)),
+	})
+}
+
+func (s *server) GetWorkflowActions(_ context.Context, req *proto.WorkflowActionsRequest) (*proto.WorkflowActionList, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail {
+		return nil, status.Error(codes.Unavailable, "unavailable")
+	}
+	if s.pending == nil || s.pending.ID != req.GetWorkflowId() {
+		return nil, errors.New("workflow not found")
+	}
+	list := &proto.WorkflowActionList{}
+	for _, a := range s.pending.Actions {
+		list.ActionList = append(list.ActionList, &proto.WorkflowAction{
+			Name:     a.Name,
+			Image:    a.Image,
+			Timeout:  int64(a.TimeoutSeconds),
+			WorkerId: s.workerID,
+		})
+	}
+	s.pending = nil
+	close(s.served)
+
+	return list, nil
+}
+
+func (s *server) ReportActionStatus(_ context.Context, req *proto.WorkflowActionStatus) (*proto.Empty, error) {
+	states := map[proto.State]spec.State{
+		proto.State_STATE_RUNNING: spec.StateRunning,
+		proto.State_STATE_SUCCESS: spec.StateSuccess,
+		proto.State_STATE_FAILED:  spec.StateFailure,
+		proto.State_STATE_TIMEOUT: spec.StateTimeout,
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail {
+		return nil, status.Error(codes.Unavailable, "unavailable")
+	}
+	s.statuses = append(s.statuses, spec.Event{
+		Type:       spec.EventTypeAction,
+		WorkflowID: req.GetWorkflowId(),
+		Action:     spec.Action{Name: req.GetActionName()},
+		Message:    req.GetMessage(),
+		State:      states[req.GetActionStatus()],
+	})
+
+	return &proto.Empty{}, nil
+}
@@ -0,0 +1,72 @@
+package grpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Token is per-RPC credentials that send a bearer token in the authorization metadata of every call.
+// It is only sent over TLS.
+type Token struct {
+	// Value is a static token. It is used when File is empty.
+	Value string
+	// File is a file the token is read from. It is read again whenever it changes, so a rotated token
+	// is used without restarting the agent.
+	File string
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	cached  string
+}
+
+// GetRequestMetadata implements credentials.PerRPCCredentials.
+func (t *Token) GetRequestMetadata(_ context.Context, _ ...string) (map[string]string, error) {
+	tok, err := t.token()
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]string{"authorization": "Bearer " + tok}, nil
+}
+
+// RequireTransportSecurity implements credentials.PerRPCCredentials.
+func (t *Token) RequireTransportSecurity() bool {
+	return true
+}
+
+// token returns the current token, reading File if it changed since it was last read.
+func (t *Token) token() (string, error) {
+	if t.File == "" {
+		if t.Value == "" {
+			return "", errors.New("no token")
+		}
+		return t.Value, nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fi, err := os.Stat(t.File)
+	if err != nil {
+		return "", fmt.Errorf("error reading token file: %w", err)
+	}
+	if t.cached != "" && fi.ModTime().Equal(t.modTime) && fi.Size() == t.size {
+		return t.cached, nil
+	}
+	b, err := os.ReadFile(t.File)
+	if err != nil {
+		return "", fmt.Errorf("error reading token file: %w", err)
+	}
+	tok := strings.TrimSpace(string(b))
+	if tok == "" {
+		return "", fmt.Errorf("token file %v is empty", t.File)
+	}
+	t.cached, t.modTime, t.size = tok, fi.ModTime(), fi.Size()
+
+	return tok, nil
+}
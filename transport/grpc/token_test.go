@@ -0,0 +1,58 @@
+package grpc_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	tgrpc "github.com/jacobweinstock/tink-agent/transport/grpc"
+)
+
+func TestToken(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "token")
+	write := func(tok string, mod time.Time) {
+		t.Helper()
+		if err := os.WriteFile(file, []byte(tok+"\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		// The file is written again within the resolution of some file systems, so the time is set explicitly.
+		if err := os.Chtimes(file, mod, mod); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(tok *tgrpc.Token, want string) {
+		t.Helper()
+		md, err := tok.GetRequestMetadata(context.Background())
+		if err != nil {
+			t.Fatalf("getting request metadata: %v", err)
+		}
+		if got := md["authorization"]; got != "Bearer "+want {
+			t.Errorf("got authorization %q, want %q", got, "Bearer "+want)
+		}
+	}
+
+	check(&tgrpc.Token{Value: "static"}, "static")
+
+	now := time.Now()
+	write("first", now.Add(-time.Minute))
+	tok := &tgrpc.Token{Value: "static", File: file}
+	check(tok, "first")
+	write("second", now)
+	check(tok, "second")
+
+	write("", now.Add(time.Minute))
+	if _, err := tok.GetRequestMetadata(context.Background()); err == nil {
+		t.Error("got no error with an empty token file")
+	}
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tok.GetRequestMetadata(context.Background()); err == nil {
+		t.Error("got no error with a missing token file")
+	}
+	if !tok.RequireTransportSecurity() {
+		t.Error("token can be sent without TLS")
+	}
+}
@@ -0,0 +1,329 @@
+package grpcv2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jacobweinstock/tink-agent/pkg/backoff"
+	"github.com/jacobweinstock/tink-agent/spec"
+	workflow "github.com/jacobweinstock/tink-agent/transport/grpc/proto/workflow/v2"
+)
+
+// Config is a transport that uses the v2 WorkflowService API.
+// Workflows are received from the GetWorkflows stream and events are published with PublishEvent.
+type Config struct {
+	Log     *slog.Logger
+	Client  workflow.WorkflowServiceClient
+	AgentID string
+	// RetryInterval is how long to wait before opening the workflows stream again once the server ends it,
+	// and the first delay of the exponential backoff after an error. Defaults to DefaultRetryInterval.
+	RetryInterval time.Duration
+	// MaxRetryInterval caps the backoff after errors. Defaults to DefaultMaxRetryInterval.
+	MaxRetryInterval time.Duration
+	Workflows        chan spec.Workflow
+	// Cancel receives the ID of each workflow the server asked to stop.
+	Cancel chan string
+
+	mu sync.Mutex
+	// running is the workflow handed to the agent that has not yet completed, nil if there is none.
+	running *run
+}
+
+const (
+	// DefaultRetryInterval is the RetryInterval used when none is set.
+	DefaultRetryInterval = 5 * time.Second
+	// DefaultMaxRetryInterval is the MaxRetryInterval used when none is set.
+	DefaultMaxRetryInterval = time.Minute
+)
+
+// run tracks a workflow handed to the agent.
+type run struct {
+	workflowID string
+	// firstActionID is the ID of the first action of the workflow.
+	firstActionID string
+	// cancel stops handing the workflow to the agent if it has not yet been read.
+	cancel context.CancelFunc
+	// read receives whether the agent read the workflow, once it is read or cancel is called.
+	read chan bool
+	// delivered caches what was received from read.
+	readOnce  sync.Once
+	delivered bool
+}
+
+// wasRead reports whether the agent read the workflow. cancel must have been called.
+func (r *run) wasRead() bool {
+	r.readOnce.Do(func() { r.delivered = <-r.read })
+	return r.delivered
+}
+
+func (c *Config) Start(ctx context.Context) error {
+	c.Log.Info("grpc v2 transport starting")
+	interval := backoff.Or(c.RetryInterval, DefaultRetryInterval)
+	maxInterval := backoff.Or(c.MaxRetryInterval, DefaultMaxRetryInterval)
+	failures := 0
+	for {
+		received, err := c.watch(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if received > 0 {
+			failures = 0
+		}
+		// The stream ending without an error is opened again after RetryInterval. Errors back off exponentially.
+		delay := backoff.Jitter(interval)
+		if err != nil {
+			failures++
+			delay = backoff.Exponential(interval, maxInterval, failures)
+			c.Log.Debug("error watching workflows", "error", err, "retryIn", delay)
+		}
+		if !backoff.Wait(ctx, delay) {
+			return nil
+		}
+	}
+}
+
+// watch opens a workflows stream and handles every command as it is received, until the server ends the
+// stream or an error occurs. It returns the number of commands received.
+func (c *Config) watch(ctx context.Context) (int, error) {
+	stream, err := c.Client.GetWorkflows(ctx, &workflow.GetWorkflowsRequest{AgentId: c.AgentID})
+	if err != nil {
+		return 0, fmt.Errorf("error getting workflows stream: %w", err)
+	}
+	for received := 0; ; received++ {
+		resp, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return received, nil
+		}
+		if err != nil {
+			return received, fmt.Errorf("error receiving from workflows stream: %w", err)
+		}
+
+		switch resp.GetCmd().(type) {
+		case *workflow.GetWorkflowsResponse_StartWorkflow_:
+			c.startWorkflow(ctx, resp.GetStartWorkflow().GetWorkflow())
+		case *workflow.GetWorkflowsResponse_StopWorkflow_:
+			c.stopWorkflow(ctx, resp.GetStopWorkflow().GetWorkflowId())
+		}
+	}
+}
+
+// startWorkflow hands wf to the agent.
+// Only one workflow is handled at a time, any other workflow is rejected.
+func (c *Config) startWorkflow(ctx context.Context, wf *workflow.Workflow) {
+	if wf.GetWorkflowId() == "" {
+		c.Log.Info("received workflow without an ID, ignoring")
+		return
+	}
+	if len(wf.GetActions()) == 0 {
+		c.reject(ctx, wf.GetWorkflowId(), "workflow has no actions")
+		return
+	}
+
+	c.mu.Lock()
+	if c.running != nil {
+		running := c.running.workflowID
+		c.mu.Unlock()
+		c.reject(ctx, wf.GetWorkflowId(), fmt.Sprintf("agent is already running workflow %v", running))
+		return
+	}
+	w := spec.Workflow{
+		ID:      wf.GetWorkflowId(),
+		Actions: make([]spec.Action, 0, len(wf.GetActions())),
+	}
+	for _, a := range wf.GetActions() {
+		w.Actions = append(w.Actions, toSpec(wf.GetWorkflowId(), a))
+	}
+	rctx, cancel := context.WithCancel(ctx)
+	r := &run{
+		workflowID:    w.ID,
+		firstActionID: w.Actions[0].ID,
+		cancel:        cancel,
+		read:          make(chan bool, 1),
+	}
+	c.running = r
+	c.mu.Unlock()
+
+	c.Log.Info("received workflow", "workflowID", w.ID, "actions", len(w.Actions))
+	// The stream must keep being read while the agent is busy so that stop commands are received.
+	go func() {
+		select {
+		case <-rctx.Done():
+			r.read <- false
+		case c.Workflows <- w:
+			r.read <- true
+		}
+	}()
+}
+
+// stopWorkflow discards the running workflow if the agent has not read it yet, otherwise it asks the agent
+// to cancel it. A workflow the agent read stays running until its final event is written.
+func (c *Config) stopWorkflow(ctx context.Context, workflowID string) {
+	c.mu.Lock()
+	r := c.running
+	if r == nil || r.workflowID != workflowID {
+		c.mu.Unlock()
+		c.Log.Info("received stop for a workflow that is not running, ignoring", "workflowID", workflowID)
+		return
+	}
+	r.cancel()
+	read := r.wasRead()
+	if !read {
+		c.running = nil
+	}
+	c.mu.Unlock()
+
+	if !read {
+		// The agent never sees the workflow so it does not report it, the server is told it was cancelled here.
+		// The v2 API has no workflow events, it is reported the way the agent reports a cancelled action.
+		c.Log.Info("discarding stopped workflow that was not started", "workflowID", workflowID)
+		event := spec.Event{
+			Type:       spec.EventTypeAction,
+			WorkflowID: workflowID,
+			Action:     spec.Action{ID: r.firstActionID, WorkflowID: workflowID},
+			Message:    "workflow stopped before it started",
+			State:      spec.StateCancelled,
+		}
+		if err := c.Write(ctx, event); err != nil {
+			c.Log.Info("error publishing workflow cancelled event", "workflowID", workflowID, "error", err)
+		}
+		return
+	}
+
+	c.Log.Info("stopping workflow", "workflowID", workflowID)
+	select {
+	case <-ctx.Done():
+	case c.Cancel <- workflowID:
+	}
+}
+
+func (c *Config) reject(ctx context.Context, workflowID, msg string) {
+	c.Log.Info("rejecting workflow", "workflowID", workflowID, "reason", msg)
+	ev := &workflow.Event{
+		WorkflowId: workflowID,
+		Event: &workflow.Event_WorkflowRejected_{
+			WorkflowRejected: &workflow.Event_WorkflowRejected{Message: msg},
+		},
+	}
+	if _, err := c.Client.PublishEvent(ctx, &workflow.PublishEventRequest{Event: ev}); err != nil {
+		c.Log.Info("error publishing workflow rejected event", "workflowID", workflowID, "error", err)
+	}
+}
+
+func (c *Config) Read(ctx context.Context) (spec.Workflow, error) {
+	select {
+	case <-ctx.Done():
+		return spec.Workflow{}, context.Canceled
+	case v := <-c.Workflows:
+		return v, nil
+	}
+}
+
+// Cancelled returns the channel on which stop workflow commands are delivered.
+func (c *Config) Cancelled() <-chan string {
+	return c.Cancel
+}
+
+func (c *Config) Write(ctx context.Context, event spec.Event) error {
+	// The v2 API only has action events, a completed workflow only needs to be forgotten.
+	if event.Type == spec.EventTypeWorkflow {
+		if event.State.IsFinal() {
+			c.finish(event.WorkflowID)
+		}
+		return nil
+	}
+	// The v2 API has no retry event, the action is still running as far as the server is concerned.
+	if event.State == spec.StateRetrying {
+		return nil
+	}
+
+	ev := toProto(event)
+	if _, err := c.Client.PublishEvent(ctx, &workflow.PublishEventRequest{Event: ev}); err != nil {
+		return fmt.Errorf("error publishing event: %v: %w", ev, err)
+	}
+
+	return nil
+}
+
+// finish allows a new workflow to be started once workflowID has completed.
+func (c *Config) finish(workflowID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.running == nil || c.running.workflowID != workflowID {
+		return
+	}
+	c.running.cancel()
+	c.running = nil
+}
+
+func toSpec(workflowID string, a *workflow.Workflow_Action) spec.Action {
+	action := spec.Action{
+		WorkflowID: workflowID,
+		ID:         a.GetId(),
+		Name:       a.GetName(),
+		Image:      a.GetImage(),
+		Cmd:        a.GetCmd(),
+		Args:       a.GetArgs(),
+		Env:        []spec.Env{},
+		Volumes:    []spec.Volume{},
+		Namespaces: spec.Namespaces{
+			Network: a.GetNetworkNamespace(),
+		},
+	}
+	// Maps have no order, sort the keys so the environment is deterministic.
+	keys := make([]string, 0, len(a.GetEnv()))
+	for k := range a.GetEnv() {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		action.Env = append(action.Env, spec.Env{Key: k, Value: a.GetEnv()[k]})
+	}
+	for _, v := range a.GetVolumes() {
+		action.Volumes = append(action.Volumes, spec.Volume(v))
+	}
+
+	return action
+}
+
+func toProto(event spec.Event) *workflow.Event {
+	ev := &workflow.Event{WorkflowId: event.WorkflowID}
+	switch event.State {
+	case spec.StateRunning:
+		ev.Event = &workflow.Event_ActionStarted_{
+			ActionStarted: &workflow.Event_ActionStarted{ActionId: event.Action.ID},
+		}
+	case spec.StateSuccess:
+		ev.Event = &workflow.Event_ActionSucceeded_{
+			ActionSucceeded: &workflow.Event_ActionSucceeded{ActionId: event.Action.ID},
+		}
+	default:
+		reason, message := event.Result.Reason, event.Result.Message
+		if reason == "" {
+			switch event.State {
+			case spec.StateTimeout:
+				reason = spec.FailureClassTimeout.Reason()
+			case spec.StateCancelled:
+				reason = "Cancelled"
+			}
+		}
+		if message == "" {
+			message = event.Message
+		}
+		failed := &workflow.Event_ActionFailed{
+			ActionId:       event.Action.ID,
+			FailureMessage: &message,
+		}
+		if reason != "" {
+			failed.FailureReason = &reason
+		}
+		ev.Event = &workflow.Event_ActionFailed_{ActionFailed: failed}
+	}
+
+	return ev
+}
@@ -0,0 +1,286 @@
+package grpcv2_test
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/jacobweinstock/tink-agent/agent/agenttest"
+	"github.com/jacobweinstock/tink-agent/spec"
+	tgrpc "github.com/jacobweinstock/tink-agent/transport/grpc"
+	workflow "github.com/jacobweinstock/tink-agent/transport/grpc/proto/workflow/v2"
+	"github.com/jacobweinstock/tink-agent/transport/grpcv2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestTransport(t *testing.T) {
+	agenttest.TestTransport(t, func(t *testing.T) agenttest.Transport {
+		srv := newServer()
+		tr := start(t, srv, 10*time.Millisecond)
+		return agenttest.Transport{Reader: tr, Writer: tr, Submit: srv.submit, Events: srv.list, Fail: srv.setFail}
+	})
+}
+
+// TestStopBeforeRead tests that a workflow stopped before the agent read it is reported to the server as
+// cancelled, without the agent being asked to cancel it.
+func TestStopBeforeRead(t *testing.T) {
+	srv := newServer()
+	tr := start(t, srv, 10*time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := srv.submit(ctx, spec.Workflow{ID: "wf1", Actions: []spec.Action{{ID: "a1", Name: "first", Image: "first:v1"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.stop(ctx, "wf1"); err != nil {
+		t.Fatal(err)
+	}
+	for len(srv.list()) == 0 && ctx.Err() == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+	want := []spec.Event{{Type: spec.EventTypeAction, WorkflowID: "wf1", Action: spec.Action{ID: "a1"}, State: spec.StateFailure, Result: spec.Result{Reason: "Cancelled"}}}
+	if diff := cmp.Diff(want, srv.list()); diff != "" {
+		t.Errorf("unexpected events (-want +got):\n%s", diff)
+	}
+
+	// The next workflow is handed to the agent, and the stopped one is not.
+	go func() {
+		_ = srv.submit(ctx, spec.Workflow{ID: "wf2", Actions: []spec.Action{{ID: "a1", Name: "first", Image: "first:v1"}}})
+	}()
+	wf, err := tr.Read(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wf.ID != "wf2" {
+		t.Errorf("read workflow %v, want wf2", wf.ID)
+	}
+	select {
+	case id := <-tr.Cancelled():
+		t.Errorf("agent was asked to cancel workflow %v", id)
+	default:
+	}
+}
+
+// TestStopRunning tests that a workflow the agent was asked to cancel is still running until its final event
+// is written, so no other workflow is started before.
+func TestStopRunning(t *testing.T) {
+	srv := newServer()
+	tr := start(t, srv, 10*time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	wf := func(id string) spec.Workflow {
+		return spec.Workflow{ID: id, Actions: []spec.Action{{ID: "a1", Name: "first", Image: "first:v1"}}}
+	}
+
+	if err := srv.submit(ctx, wf("wf1")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tr.Read(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.stop(ctx, "wf1"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ctx.Done():
+		t.Fatal("agent was not asked to cancel the workflow")
+	case id := <-tr.Cancelled():
+		if id != "wf1" {
+			t.Fatalf("agent was asked to cancel %v, want wf1", id)
+		}
+	}
+
+	// wf1 is still being cancelled, wf2 is rejected.
+	if err := srv.submit(ctx, wf("wf2")); err != nil {
+		t.Fatal(err)
+	}
+	for len(srv.list()) == 0 && ctx.Err() == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if diff := cmp.Diff([]spec.Event{{Type: spec.EventTypeWorkflow, WorkflowID: "wf2"}}, srv.list()); diff != "" {
+		t.Errorf("unexpected events (-want +got):\n%s", diff)
+	}
+
+	if err := tr.Write(ctx, spec.Event{Type: spec.EventTypeWorkflow, WorkflowID: "wf1", State: spec.StateCancelled}); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.submit(ctx, wf("wf3")); err != nil {
+		t.Fatal(err)
+	}
+	got, err := tr.Read(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != "wf3" {
+		t.Errorf("read workflow %v, want wf3", got.ID)
+	}
+}
+
+// TestZeroRetryInterval tests that a transport without a RetryInterval does not reopen a failing stream in a
+// tight loop.
+func TestZeroRetryInterval(t *testing.T) {
+	srv := newServer()
+	srv.fail = true
+	start(t, srv, 0)
+
+	time.Sleep(500 * time.Millisecond)
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.opened > 1 {
+		t.Errorf("stream was opened %d times within 500ms, want at most once", srv.opened)
+	}
+}
+
+// start starts a transport connected to srv until the test ends.
+func start(t *testing.T, srv *server, retryInterval time.Duration) *grpcv2.Config {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := grpc.NewServer()
+	workflow.RegisterWorkflowServiceServer(s, srv)
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		_ = s.Serve(l)
+	}()
+	conn, err := tgrpc.NewClientConn(l.Addr().String(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+		s.Stop()
+		<-served
+	})
+
+	tr := &grpcv2.Config{
+		Log:           agenttest.Logger(t),
+		Client:        workflow.NewWorkflowServiceClient(conn),
+		AgentID:       "agent1",
+		RetryInterval: retryInterval,
+		Workflows:     make(chan spec.Workflow),
+		Cancel:        make(chan string, 1),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := tr.Start(ctx); err != nil {
+			t.Errorf("starting transport: %v", err)
+		}
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	return tr
+}
+
+// server is a v2 workflow service that sends submitted workflows and stop commands to the connected agent
+// and records the events it publishes.
+type server struct {
+	workflow.UnimplementedWorkflowServiceServer
+	cmds chan *workflow.GetWorkflowsResponse
+
+	mu sync.Mutex
+	// fail, when set, has every stream fail straight away and every event fail to publish.
+	fail   bool
+	opened int
+	events []spec.Event
+}
+
+func newServer() *server {
+	return &server{cmds: make(chan *workflow.GetWorkflowsResponse)}
+}
+
+// submit sends wf to the agent, blocking until it is sent on a stream or ctx is done.
+func (s *server) submit(ctx context.Context, wf spec.Workflow) error {
+	w := &workflow.Workflow{WorkflowId: wf.ID}
+	for _, a := range wf.Actions {
+		w.Actions = append(w.Actions, &workflow.Workflow_Action{Id: a.ID, Name: a.Name, Image: a.Image})
+	}
+	cmd := &workflow.GetWorkflowsResponse_StartWorkflow_{StartWorkflow: &workflow.GetWorkflowsResponse_StartWorkflow{Workflow: w}}
+
+	return s.send(ctx, &workflow.GetWorkflowsResponse{Cmd: cmd})
+}
+
+// stop asks the agent to stop workflowID, blocking until it is sent on a stream or ctx is done.
+func (s *server) stop(ctx context.Context, workflowID string) error {
+	cmd := &workflow.GetWorkflowsResponse_StopWorkflow_{StopWorkflow: &workflow.GetWorkflowsResponse_StopWorkflow{WorkflowId: workflowID}}
+
+	return s.send(ctx, &workflow.GetWorkflowsResponse{Cmd: cmd})
+}
+
+func (s *server) send(ctx context.Context, cmd *workflow.GetWorkflowsResponse) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case s.cmds <- cmd:
+		return nil
+	}
+}
+
+func (s *server) setFail(fail bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fail = fail
+}
+
+func (s *server) list() []spec.Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]spec.Event(nil), s.events...)
+}
+
+func (s *server) GetWorkflows(_ *workflow.GetWorkflowsRequest, stream workflow.WorkflowService_GetWorkflowsServer) error {
+	s.mu.Lock()
+	s.opened++
+	fail := s.fail
+	s.mu.Unlock()
+	if fail {
+		return status.Error(codes.Unavailable, "unavailable")
+	}
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case cmd := <-s.cmds:
+			if err := stream.Send(cmd); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *server) PublishEvent(_ context.Context, req *workflow.PublishEventRequest) (*workflow.PublishEventResponse, error) {
+	ev := req.GetEvent()
+	e := spec.Event{Type: spec.EventTypeAction, WorkflowID: ev.GetWorkflowId()}
+	switch {
+	case ev.GetActionStarted() != nil:
+		e.Action.ID, e.State = ev.GetActionStarted().GetActionId(), spec.StateRunning
+	case ev.GetActionSucceeded() != nil:
+		e.Action.ID, e.State = ev.GetActionSucceeded().GetActionId(), spec.StateSuccess
+	case ev.GetActionFailed() != nil:
+		e.Action.ID, e.State = ev.GetActionFailed().GetActionId(), spec.StateFailure
+		e.Result.Reason = ev.GetActionFailed().GetFailureReason()
+	default:
+		e.Type = spec.EventTypeWorkflow
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail {
+		return nil, status.Error(codes.Unavailable, "unavailable")
+	}
+	s.events = append(s.events, e)
+
+	return &workflow.PublishEventResponse{}, nil
+}
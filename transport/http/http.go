@@ -0,0 +1,308 @@
+// Package http is a transport for simple backends. Workflows are polled for with GET requests and events are
+// sent with POST requests, both as JSON.
+//
+// The workflow URL is requested with the agent ID in the agentID query parameter, and, when long polling, the
+// most seconds the server may hold the request in the wait query parameter. The server responds with:
+//   - 200 OK and the next workflow of the agent, in the same form as a workflow file. Workflows must have an ID.
+//   - 204 No Content or 404 Not Found when there is no workflow for the agent.
+//   - 304 Not Modified when the request had an If-None-Match header with the ETag of the current response.
+//
+// Every event is sent to the events URL as a JSON spec.Event with an Idempotency-Key header of spec.Event.Key,
+// which is the same for every attempt to send it. Any 2xx response accepts the event.
+package http
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jacobweinstock/tink-agent/pkg/backoff"
+	"github.com/jacobweinstock/tink-agent/pkg/conv"
+	"github.com/jacobweinstock/tink-agent/spec"
+)
+
+const (
+	// DefaultPollInterval is how long to wait between workflow requests when PollInterval is not set.
+	DefaultPollInterval = 5 * time.Second
+	// DefaultTimeout is how long a request can take when Timeout is not set. It does not include LongPoll.
+	DefaultTimeout = 30 * time.Second
+	// DefaultRetryInterval is how long to wait before sending an event again when RetryInterval is not set.
+	DefaultRetryInterval = time.Second
+	// DefaultMaxRetryInterval is the most the interval between workflow requests grows to after errors,
+	// when MaxRetryInterval is not set.
+	DefaultMaxRetryInterval = time.Minute
+)
+
+// AgentIDHeader is the header every request carries the agent ID in.
+const AgentIDHeader = "Tink-Agent-ID"
+
+// maxBody is the largest workflow response read.
+const maxBody = 10 << 20
+
+// maxCompleted is how many of the most recently completed workflows are remembered. A server that keeps
+// returning a workflow does so until it has seen its final event, so only the last few are needed.
+const maxCompleted = 100
+
+type Config struct {
+	Log     *slog.Logger
+	AgentID string
+	// WorkflowURL is polled for the next workflow of the agent.
+	WorkflowURL string
+	// EventsURL is where events are posted.
+	EventsURL string
+	// PollInterval is how long to wait between workflow requests.
+	PollInterval time.Duration
+	// LongPoll, when set, is the most the server is asked to hold a workflow request until there is a workflow
+	// for the agent. Servers that do not support long polling respond straight away.
+	LongPoll time.Duration
+	// Timeout is how long a request can take, in addition to LongPoll.
+	Timeout time.Duration
+	// Retries is how many more times an event is sent after it failed because of a network error, a 429, or a
+	// 5xx response. RetryInterval is the delay before the first retry, it doubles after every one.
+	Retries       int
+	RetryInterval time.Duration
+	// MaxRetryInterval is the most the interval between workflow requests grows to after errors.
+	MaxRetryInterval time.Duration
+	// TLS is the configuration used for https URLs. The system certificate pool is used when nil.
+	TLS *tls.Config
+	// Header is added to every request, such as an Authorization header.
+	Header    http.Header
+	Workflows chan spec.Workflow
+
+	once   sync.Once
+	client *http.Client
+	mu     sync.Mutex
+	// running is the ID of the workflow handed to the agent that has not yet completed, empty if there is none.
+	running string
+	// completed are the IDs of the last maxCompleted workflows that completed, oldest first, so they are not
+	// run again if the server still returns them.
+	completed []string
+	// etag is the ETag of the last workflow response.
+	etag string
+}
+
+func (c *Config) Start(ctx context.Context) error {
+	c.Log.Info("http transport starting", "url", c.WorkflowURL)
+	for _, u := range []struct{ name, url string }{{"workflow", c.WorkflowURL}, {"events", c.EventsURL}} {
+		if u.url == "" {
+			return fmt.Errorf("%v URL is required", u.name)
+		}
+		if _, err := url.Parse(u.url); err != nil {
+			return fmt.Errorf("%v URL is not valid: %w", u.name, err)
+		}
+	}
+	interval := backoff.Or(c.PollInterval, DefaultPollInterval)
+	maxInterval := backoff.Or(c.MaxRetryInterval, DefaultMaxRetryInterval)
+	failures := 0
+	for {
+		wf, err := c.poll(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		d := backoff.Jitter(interval)
+		if err != nil {
+			c.Log.Info("error getting workflow", "error", err)
+			failures++
+			d = backoff.Exponential(interval, maxInterval, failures)
+		} else {
+			failures = 0
+		}
+		if wf != nil {
+			c.Log.Info("received workflow", "workflowID", wf.ID, "actions", len(wf.Actions))
+			select {
+			case <-ctx.Done():
+				return nil
+			case c.Workflows <- *wf:
+			}
+		}
+		if !backoff.Wait(ctx, d) {
+			return nil
+		}
+	}
+}
+
+// poll requests the next workflow. It returns nil when there is no new workflow to run.
+func (c *Config) poll(ctx context.Context) (*spec.Workflow, error) {
+	u, err := url.Parse(c.WorkflowURL)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	q.Set("agentID", c.AgentID)
+	if c.LongPoll > 0 {
+		// The server is asked in whole seconds, rounded up so that a LongPoll under a second is not no wait at all.
+		q.Set("wait", strconv.Itoa(int(math.Ceil(c.LongPoll.Seconds()))))
+	}
+	u.RawQuery = q.Encode()
+
+	ctx, cancel := context.WithTimeout(ctx, backoff.Or(c.Timeout, DefaultTimeout)+c.LongPoll)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	c.mu.Lock()
+	if c.etag != "" {
+		req.Header.Set("If-None-Match", c.etag)
+	}
+	c.mu.Unlock()
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return nil, nil
+	case http.StatusNoContent, http.StatusNotFound:
+		c.mu.Lock()
+		c.etag = ""
+		c.mu.Unlock()
+		return nil, nil
+	default:
+		return nil, statusError(resp)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxBody))
+	if err != nil {
+		return nil, fmt.Errorf("error reading workflow: %w", err)
+	}
+	wf, err := conv.ParseWorkflow(b, "")
+	if err != nil {
+		return nil, fmt.Errorf("error parsing workflow: %w", err)
+	}
+	if wf.ID == "" {
+		return nil, errors.New("workflow has no ID")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// The ETag is only kept for a workflow that is run, so any other workflow is returned again once the running one completes.
+	switch {
+	case slices.Contains(c.completed, wf.ID) || wf.ID == c.running:
+		return nil, nil
+	case c.running != "":
+		c.Log.Debug("ignoring workflow while another one is running", "workflowID", wf.ID, "running", c.running)
+		return nil, nil
+	}
+	c.running = wf.ID
+	c.etag = resp.Header.Get("ETag")
+
+	return &wf, nil
+}
+
+func (c *Config) Read(ctx context.Context) (spec.Workflow, error) {
+	select {
+	case <-ctx.Done():
+		return spec.Workflow{}, context.Canceled
+	case v := <-c.Workflows:
+		return v, nil
+	}
+}
+
+// Write posts event to EventsURL, trying again after errors that may be temporary.
+func (c *Config) Write(ctx context.Context, event spec.Event) error {
+	if event.Type == spec.EventTypeWorkflow && event.State.IsFinal() {
+		c.finish(event.WorkflowID)
+	}
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	key := event.Key()
+	d := backoff.Or(c.RetryInterval, DefaultRetryInterval)
+	for attempt := 0; ; attempt++ {
+		retry, err := c.post(ctx, b, key)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= c.Retries || ctx.Err() != nil {
+			return fmt.Errorf("error posting event: %v: %w", event, err)
+		}
+		c.Log.Debug("error posting event, trying again", "error", err, "attempt", attempt+1)
+		if !backoff.Wait(ctx, backoff.Jitter(d)) {
+			return fmt.Errorf("error posting event: %v: %w", event, err)
+		}
+		d *= 2
+	}
+}
+
+// post sends an event, reporting whether it is worth sending again when it fails.
+func (c *Config) post(ctx context.Context, body []byte, key string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, backoff.Or(c.Timeout, DefaultTimeout))
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.EventsURL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", key)
+	resp, err := c.do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, maxBody))
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500, statusError(resp)
+}
+
+// do sends req with Header and the agent ID.
+func (c *Config) do(req *http.Request) (*http.Response, error) {
+	c.once.Do(func() {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		if c.TLS != nil {
+			t.TLSClientConfig = c.TLS.Clone()
+		}
+		c.client = &http.Client{Transport: t}
+	})
+	for k, v := range c.Header {
+		req.Header[k] = v
+	}
+	req.Header.Set(AgentIDHeader, c.AgentID)
+
+	return c.client.Do(req)
+}
+
+// finish forgets the running workflow once it completed.
+func (c *Config) finish(workflowID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !slices.Contains(c.completed, workflowID) {
+		c.completed = append(c.completed, workflowID)
+		if len(c.completed) > maxCompleted {
+			c.completed = slices.Delete(c.completed, 0, len(c.completed)-maxCompleted)
+		}
+	}
+	if c.running == workflowID {
+		c.running = ""
+	}
+}
+
+// statusError returns an error describing an unexpected response, including the start of its body.
+func statusError(resp *http.Response) error {
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	if msg := strings.TrimSpace(string(b)); msg != "" {
+		return fmt.Errorf("unexpected response %v: %v", resp.Status, msg)
+	}
+
+	return fmt.Errorf("unexpected response %v", resp.Status)
+}
@@ -0,0 +1,363 @@
+package http_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jacobweinstock/tink-agent/agent/agenttest"
+	"github.com/jacobweinstock/tink-agent/pkg/tlsconfig"
+	"github.com/jacobweinstock/tink-agent/pkg/tlsconfig/tlsconfigtest"
+	"github.com/jacobweinstock/tink-agent/spec"
+	thttp "github.com/jacobweinstock/tink-agent/transport/http"
+)
+
+func TestTransport(t *testing.T) {
+	agenttest.TestTransport(t, func(t *testing.T) agenttest.Transport {
+		b := &backend{}
+		srv := httptest.NewServer(b)
+		t.Cleanup(srv.Close)
+		tr := newTransport(t, srv.URL)
+		start(t, tr)
+		return agenttest.Transport{Reader: tr, Writer: tr, Submit: b.submit, Events: b.Events, Fail: b.setFail}
+	})
+}
+
+// TestETag tests that the workflow is requested with the ETag of the last response, and that a workflow the
+// server keeps returning is only run once.
+func TestETag(t *testing.T) {
+	b := &backend{}
+	srv := httptest.NewServer(b)
+	t.Cleanup(srv.Close)
+	tr := newTransport(t, srv.URL)
+	tr.LongPoll = 30 * time.Second
+	start(t, tr)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	go func() {
+		_ = b.submit(ctx, spec.Workflow{ID: "wf1", Actions: []spec.Action{{Name: "first", Image: "first:v1"}}})
+	}()
+	if _, err := tr.Read(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// Wait for a few more requests while the workflow runs.
+	for b.requestCount() < 5 && ctx.Err() == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+	b.mu.Lock()
+	requests := b.requests
+	b.mu.Unlock()
+	var ok, notModified int
+	for _, r := range requests {
+		switch r.status {
+		case http.StatusOK:
+			ok++
+		case http.StatusNotModified:
+			notModified++
+		}
+		if r.agentID != "agent1" || r.wait != "30" {
+			t.Errorf("got request for agent %q waiting %q, want agent1 waiting 30", r.agentID, r.wait)
+		}
+	}
+	if ok != 1 || notModified == 0 {
+		t.Errorf("got %d full and %d not modified responses, want 1 full response", ok, notModified)
+	}
+
+	ctx2, cancel2 := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel2()
+	if wf, err := tr.Read(ctx2); err == nil {
+		t.Errorf("read workflow %v again", wf.ID)
+	}
+}
+
+// TestRetries tests that events are sent again after temporary errors with the same idempotency key, and
+// TestLongPollWait tests that the server is asked to hold workflow requests for LongPoll rounded up to whole seconds.
+func TestLongPollWait(t *testing.T) {
+	tests := map[time.Duration]string{
+		30 * time.Second:        "30",
+		1500 * time.Millisecond: "2",
+		100 * time.Millisecond:  "1",
+	}
+	for longPoll, want := range tests {
+		t.Run(longPoll.String(), func(t *testing.T) {
+			b := &backend{}
+			srv := httptest.NewServer(b)
+			t.Cleanup(srv.Close)
+			tr := newTransport(t, srv.URL)
+			tr.LongPoll = longPoll
+			start(t, tr)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			for b.requestCount() == 0 && ctx.Err() == nil {
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			if len(b.requests) == 0 {
+				t.Fatal("no workflow request was made")
+			}
+			if got := b.requests[0].wait; got != want {
+				t.Errorf("got wait %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+// that they are not sent again after other errors.
+func TestRetries(t *testing.T) {
+	tests := map[string]struct {
+		status  int
+		wantErr bool
+		want    int
+	}{
+		"unavailable":       {status: http.StatusServiceUnavailable, want: 3},
+		"too many requests": {status: http.StatusTooManyRequests, want: 3},
+		"bad request":       {status: http.StatusBadRequest, wantErr: true, want: 1},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			var mu sync.Mutex
+			var keys []string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				keys = append(keys, r.Header.Get("Idempotency-Key"))
+				if len(keys) < 3 {
+					w.WriteHeader(tt.status)
+				}
+			}))
+			t.Cleanup(srv.Close)
+			tr := newTransport(t, srv.URL)
+			tr.Retries = 3
+
+			e := spec.Event{ID: "e1", Type: spec.EventTypeAction, WorkflowID: "wf1", Action: spec.Action{ID: "a1", Name: "first"}, State: spec.StateRunning}
+			if err := tr.Write(context.Background(), e); (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if len(keys) != tt.want {
+				t.Fatalf("got %d attempts, want %d", len(keys), tt.want)
+			}
+			for _, k := range keys {
+				if k != e.ID {
+					t.Errorf("got idempotency keys %v, want them all %v", keys, e.ID)
+					break
+				}
+			}
+		})
+	}
+}
+
+// TestEventFormat tests that events are posted with the field names of the JSON form of spec.Event.
+func TestEventFormat(t *testing.T) {
+	var mu sync.Mutex
+	var body map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		_ = json.NewDecoder(r.Body).Decode(&body)
+	}))
+	t.Cleanup(srv.Close)
+	tr := newTransport(t, srv.URL)
+
+	e := spec.Event{ID: "e1", Type: spec.EventTypeAction, WorkflowID: "wf1", Action: spec.Action{ID: "a1", Name: "first"}, Message: "running action", State: spec.StateRunning}
+	if err := tr.Write(context.Background(), e); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for _, k := range []string{"id", "type", "workflowID", "action", "message", "state", "result"} {
+		if _, ok := body[k]; !ok {
+			t.Errorf("posted event %v has no %q field", body, k)
+		}
+	}
+	if action, _ := body["action"].(map[string]any); action["name"] != "first" {
+		t.Errorf("posted event has action %v, want the action named first", body["action"])
+	}
+}
+
+// TestAuth tests that requests are sent with mutual TLS and the configured headers.
+func TestAuth(t *testing.T) {
+	certs := tlsconfigtest.Generate(t)
+	b := &backend{header: "Bearer secret"}
+	srv := httptest.NewUnstartedServer(b)
+	srv.TLS = certs.Server(t, true)
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	tlsCfg, err := tlsconfig.Files{CA: certs.CA, Cert: certs.ClientCert, Key: certs.ClientKey, ServerName: "tink.example.com"}.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := newTransport(t, srv.URL)
+	tr.TLS = tlsCfg
+	tr.Header = http.Header{"Authorization": {"Bearer secret"}}
+	start(t, tr)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	go func() {
+		_ = b.submit(ctx, spec.Workflow{ID: "wf1", Actions: []spec.Action{{Name: "first", Image: "first:v1"}}})
+	}()
+	if _, err := tr.Read(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Write(ctx, spec.Event{Type: spec.EventTypeWorkflow, WorkflowID: "wf1", State: spec.StateSuccess}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without the header every request is refused.
+	tr = newTransport(t, srv.URL)
+	tr.TLS = tlsCfg
+	if err := tr.Write(ctx, spec.Event{Type: spec.EventTypeWorkflow, WorkflowID: "wf1", State: spec.StateSuccess}); err == nil {
+		t.Error("got no error writing without the authorization header")
+	}
+}
+
+// backend is the server side of the transport. It hands out the submitted workflow until its final event is posted.
+type backend struct {
+	// header, when set, is the Authorization header every request must have.
+	header string
+
+	mu sync.Mutex
+	// fail, when set, has every request fail with a 503.
+	fail     bool
+	workflow *spec.Workflow
+	done     chan struct{}
+	events   []spec.Event
+	requests []request
+}
+
+type request struct {
+	agentID string
+	wait    string
+	status  int
+}
+
+func (b *backend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if b.header != "" && r.Header.Get("Authorization") != b.header {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	b.mu.Lock()
+	fail := b.fail
+	b.mu.Unlock()
+	if fail {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		b.get(w, r)
+	case http.MethodPost:
+		b.post(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (b *backend) get(w http.ResponseWriter, r *http.Request) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	req := request{agentID: r.URL.Query().Get("agentID"), wait: r.URL.Query().Get("wait"), status: http.StatusNoContent}
+	defer func() { b.requests = append(b.requests, req) }()
+	if b.workflow == nil {
+		w.WriteHeader(req.status)
+		return
+	}
+	etag := `"` + b.workflow.ID + `"`
+	if r.Header.Get("If-None-Match") == etag {
+		req.status = http.StatusNotModified
+		w.WriteHeader(req.status)
+		return
+	}
+	req.status = http.StatusOK
+	w.Header().Set("ETag", etag)
+	_ = json.NewEncoder(w).Encode(b.workflow)
+}
+
+func (b *backend) post(w http.ResponseWriter, r *http.Request) {
+	var e spec.Event
+	if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.events = append(b.events, e)
+	if e.Type == spec.EventTypeWorkflow && e.State.IsFinal() && b.workflow != nil && b.workflow.ID == e.WorkflowID {
+		b.workflow = nil
+		close(b.done)
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// submit hands out wf until its final event is posted.
+func (b *backend) submit(ctx context.Context, wf spec.Workflow) error {
+	done := make(chan struct{})
+	b.mu.Lock()
+	b.workflow, b.done = &wf, done
+	b.mu.Unlock()
+	select {
+	case <-ctx.Done():
+	case <-done:
+	}
+
+	return nil
+}
+
+func (b *backend) setFail(fail bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.fail = fail
+}
+
+func (b *backend) Events() []spec.Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]spec.Event(nil), b.events...)
+}
+
+func (b *backend) requestCount() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.requests)
+}
+
+func newTransport(t *testing.T, url string) *thttp.Config {
+	t.Helper()
+	return &thttp.Config{
+		Log:           agenttest.Logger(t),
+		AgentID:       "agent1",
+		WorkflowURL:   url + "/workflow",
+		EventsURL:     url + "/events",
+		PollInterval:  10 * time.Millisecond,
+		RetryInterval: 10 * time.Millisecond,
+		Timeout:       5 * time.Second,
+		Workflows:     make(chan spec.Workflow),
+	}
+}
+
+// start starts tr until the test ends.
+func start(t *testing.T, tr *thttp.Config) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := tr.Start(ctx); err != nil {
+			t.Errorf("starting transport: %v", err)
+		}
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
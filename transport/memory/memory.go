@@ -0,0 +1,131 @@
+// Package memory is an in-memory transport that records every event and line of action output, for testing.
+package memory
+
+import (
+	"context"
+	"sync"
+
+	"github.com/jacobweinstock/tink-agent/spec"
+)
+
+type Config struct {
+	// Workflows are read by the agent. Use Submit to send a workflow.
+	Workflows chan spec.Workflow
+	// Cancel receives the IDs of workflows to stop. Use Stop to send an ID.
+	Cancel chan string
+	// WriteErr, when set, is called for every event and any error it returns is returned by Write.
+	// The event is not recorded when an error is returned.
+	WriteErr func(spec.Event) error
+
+	mu      sync.Mutex
+	events  []spec.Event
+	logs    []spec.LogLine
+	changed chan struct{}
+}
+
+// New returns a transport with unbuffered channels.
+func New() *Config {
+	return &Config{Workflows: make(chan spec.Workflow), Cancel: make(chan string)}
+}
+
+func (c *Config) Read(ctx context.Context) (spec.Workflow, error) {
+	select {
+	case <-ctx.Done():
+		return spec.Workflow{}, context.Canceled
+	case wf := <-c.Workflows:
+		return wf, nil
+	}
+}
+
+func (c *Config) Cancelled() <-chan string {
+	return c.Cancel
+}
+
+func (c *Config) Write(_ context.Context, event spec.Event) error {
+	if c.WriteErr != nil {
+		if err := c.WriteErr(event); err != nil {
+			return err
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.events = append(c.events, event)
+	c.notify()
+
+	return nil
+}
+
+func (c *Config) WriteLog(_ context.Context, line spec.LogLine) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.logs = append(c.logs, line)
+	c.notify()
+
+	return nil
+}
+
+// Submit sends wf to the agent, blocking until it is read or ctx is done.
+func (c *Config) Submit(ctx context.Context, wf spec.Workflow) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case c.Workflows <- wf:
+		return nil
+	}
+}
+
+// Stop asks the agent to stop the workflow with id, blocking until it is received or ctx is done.
+func (c *Config) Stop(ctx context.Context, id string) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case c.Cancel <- id:
+		return nil
+	}
+}
+
+// Events returns every event written, in order.
+func (c *Config) Events() []spec.Event {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]spec.Event(nil), c.events...)
+}
+
+// Logs returns every line of action output written, in order.
+func (c *Config) Logs() []spec.LogLine {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]spec.LogLine(nil), c.logs...)
+}
+
+// Wait blocks until done returns true for the events written so far, or ctx is done.
+// It returns the events done was last called with.
+func (c *Config) Wait(ctx context.Context, done func([]spec.Event) bool) ([]spec.Event, error) {
+	for {
+		c.mu.Lock()
+		events := append([]spec.Event(nil), c.events...)
+		if c.changed == nil {
+			c.changed = make(chan struct{})
+		}
+		changed := c.changed
+		c.mu.Unlock()
+		if done(events) {
+			return events, nil
+		}
+		select {
+		case <-ctx.Done():
+			return events, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// notify wakes up any callers of Wait. c.mu must be held.
+func (c *Config) notify() {
+	if c.changed != nil {
+		close(c.changed)
+		c.changed = nil
+	}
+}
@@ -0,0 +1,25 @@
+package memory_test
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+
+	"github.com/jacobweinstock/tink-agent/agent/agenttest"
+	"github.com/jacobweinstock/tink-agent/spec"
+	"github.com/jacobweinstock/tink-agent/transport/memory"
+)
+
+func TestTransport(t *testing.T) {
+	agenttest.TestTransport(t, func(*testing.T) agenttest.Transport {
+		tr := memory.New()
+		var fail atomic.Bool
+		tr.WriteErr = func(spec.Event) error {
+			if fail.Load() {
+				return errors.New("write failed")
+			}
+			return nil
+		}
+		return agenttest.Transport{Reader: tr, Writer: tr, Submit: tr.Submit, Events: tr.Events, Fail: fail.Store}
+	})
+}
@@ -0,0 +1,197 @@
+package nats
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jacobweinstock/tink-agent/spec"
+	natspb "github.com/jacobweinstock/tink-agent/transport/nats/proto"
+	"github.com/nats-io/nats.go"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// EventVersion is the version of the Event schema. It changes when a field is removed or its meaning changes,
+// fields may be added without changing it.
+const EventVersion = "v1"
+
+// Encoding is how events are encoded when they are published.
+type Encoding string
+
+const (
+	// EncodingJSON encodes events as Event in JSON. It is the default.
+	EncodingJSON Encoding = "json"
+	// EncodingProtobuf encodes events as the Event message in proto/event.proto.
+	EncodingProtobuf Encoding = "protobuf"
+)
+
+// Headers set on every published event so that they can be routed and correlated without decoding them.
+const (
+	// HeaderContentType is the media type of the encoding of the event, application/json or application/protobuf.
+	HeaderContentType = "Content-Type"
+	// HeaderEventVersion is the EventVersion of the event.
+	HeaderEventVersion = "Tink-Event-Version"
+	// HeaderAgentID is the ID of the agent that published the event.
+	HeaderAgentID = "Tink-Agent-ID"
+	// HeaderWorkflowID is the ID of the workflow the event is about. Every event of a workflow has the same one.
+	HeaderWorkflowID = "Tink-Workflow-ID"
+	// HeaderActionID is the ID of the action the event is about. It is not set for workflow events.
+	HeaderActionID = "Tink-Action-ID"
+)
+
+// Event is the schema of a published event. The protobuf encoding is the Event message in proto/event.proto.
+type Event struct {
+	// Version is EventVersion.
+	Version string `json:"version"`
+	// ID is unique to the event, events with the same ID are duplicates of each other.
+	ID      string `json:"id"`
+	AgentID string `json:"agentID"`
+	// Type is "workflow" for events about a workflow as a whole and "action" for events about a single action.
+	Type       string `json:"type"`
+	WorkflowID string `json:"workflowID"`
+	// ActionID and ActionName are only set for action events.
+	ActionID   string `json:"actionID,omitempty"`
+	ActionName string `json:"actionName,omitempty"`
+	// State is one of running, retrying, success, failure, timeout or cancelled.
+	State   string `json:"state"`
+	Message string `json:"message,omitempty"`
+	// Time is when the event was published.
+	Time time.Time `json:"time"`
+	// Started, Finished, ExitCode and Reason are the outcome of an action run. They are only set for action
+	// events in the retrying state or a final state.
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+	ExitCode *int       `json:"exitCode,omitempty"`
+	Reason   string     `json:"reason,omitempty"`
+}
+
+// newEvent returns e as published by agentID.
+func newEvent(agentID string, e spec.Event) Event {
+	ev := Event{
+		Version:    EventVersion,
+		ID:         e.Key(),
+		AgentID:    agentID,
+		Type:       string(e.Type),
+		WorkflowID: e.WorkflowID,
+		ActionID:   e.Action.ID,
+		ActionName: e.Action.Name,
+		State:      string(e.State),
+		Message:    e.Message,
+		Time:       time.Now().UTC(),
+		Reason:     e.Result.Reason,
+	}
+	if !e.Result.Started.IsZero() {
+		started, finished, code := e.Result.Started.UTC(), e.Result.Finished.UTC(), e.Result.ExitCode
+		ev.Started, ev.Finished, ev.ExitCode = &started, &finished, &code
+	}
+
+	return ev
+}
+
+// message returns e encoded with enc as a message to subj.
+func (e Event) message(subj string, enc Encoding) (*nats.Msg, error) {
+	msg := nats.NewMsg(subj)
+	var err error
+	switch enc {
+	case EncodingJSON, "":
+		msg.Data, err = json.Marshal(e)
+		msg.Header.Set(HeaderContentType, "application/json")
+	case EncodingProtobuf:
+		msg.Data, err = e.MarshalProto()
+		msg.Header.Set(HeaderContentType, "application/protobuf")
+	default:
+		return nil, fmt.Errorf("unknown event encoding %q", enc)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error encoding event: %w", err)
+	}
+	msg.Header.Set(HeaderEventVersion, e.Version)
+	msg.Header.Set(HeaderAgentID, e.AgentID)
+	msg.Header.Set(HeaderWorkflowID, e.WorkflowID)
+	if e.ActionID != "" {
+		msg.Header.Set(HeaderActionID, e.ActionID)
+	}
+
+	return msg, nil
+}
+
+// MarshalProto returns e in the protobuf encoding of the Event message in event.proto.
+func (e Event) MarshalProto() ([]byte, error) {
+	return proto.Marshal(e.toProto())
+}
+
+// UnmarshalProto sets e from b, the protobuf encoding of the Event message in event.proto.
+func (e *Event) UnmarshalProto(b []byte) error {
+	var m natspb.Event
+	if err := proto.Unmarshal(b, &m); err != nil {
+		return fmt.Errorf("error decoding event: %w", err)
+	}
+	*e = Event{
+		Version:    m.GetVersion(),
+		ID:         m.GetId(),
+		AgentID:    m.GetAgentId(),
+		Type:       m.GetType(),
+		WorkflowID: m.GetWorkflowId(),
+		ActionID:   m.GetActionId(),
+		ActionName: m.GetActionName(),
+		State:      m.GetState(),
+		Message:    m.GetMessage(),
+		Time:       fromTimestamp(m.GetTime()),
+		Reason:     m.GetReason(),
+	}
+	if m.Started != nil {
+		t := fromTimestamp(m.GetStarted())
+		e.Started = &t
+	}
+	if m.Finished != nil {
+		t := fromTimestamp(m.GetFinished())
+		e.Finished = &t
+	}
+	if m.ExitCode != nil {
+		code := int(m.GetExitCode())
+		e.ExitCode = &code
+	}
+
+	return nil
+}
+
+// toProto returns e as the generated Event message.
+func (e Event) toProto() *natspb.Event {
+	m := &natspb.Event{
+		Version:    e.Version,
+		Id:         e.ID,
+		AgentId:    e.AgentID,
+		Type:       e.Type,
+		WorkflowId: e.WorkflowID,
+		ActionId:   e.ActionID,
+		ActionName: e.ActionName,
+		State:      e.State,
+		Message:    e.Message,
+		Reason:     e.Reason,
+	}
+	if !e.Time.IsZero() {
+		m.Time = timestamppb.New(e.Time)
+	}
+	if e.Started != nil {
+		m.Started = timestamppb.New(*e.Started)
+	}
+	if e.Finished != nil {
+		m.Finished = timestamppb.New(*e.Finished)
+	}
+	if e.ExitCode != nil {
+		code := int32(*e.ExitCode)
+		m.ExitCode = &code
+	}
+
+	return m
+}
+
+// fromTimestamp returns ts as a UTC time, the zero time when ts is not set.
+func fromTimestamp(ts *timestamppb.Timestamp) time.Time {
+	if ts == nil {
+		return time.Time{}
+	}
+
+	return ts.AsTime()
+}
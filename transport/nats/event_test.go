@@ -0,0 +1,73 @@
+package nats_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/jacobweinstock/tink-agent/transport/nats"
+	natspb "github.com/jacobweinstock/tink-agent/transport/nats/proto"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/testing/protocmp"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// TestEventProto tests that the protobuf encoding of an Event is the Event message of event.proto.
+func TestEventProto(t *testing.T) {
+	now := time.Date(2024, 10, 1, 12, 0, 0, 123, time.UTC)
+	started, finished := now.Add(-time.Minute), now.Add(-time.Second)
+	tests := map[string]struct {
+		event nats.Event
+		want  *natspb.Event
+	}{
+		"workflow": {
+			event: nats.Event{Version: "v1", ID: "e1", AgentID: "agent1", Type: "workflow", WorkflowID: "wf1", State: "running", Time: now},
+			want:  &natspb.Event{Version: "v1", Id: "e1", AgentId: "agent1", Type: "workflow", WorkflowId: "wf1", State: "running", Time: timestamppb.New(now)},
+		},
+		"zero exit code": {
+			event: nats.Event{
+				Version: "v1", ID: "e2", AgentID: "agent1", Type: "action", WorkflowID: "wf1", ActionID: "a1", ActionName: "first",
+				State: "success", Message: "action completed", Time: now, Started: &started, Finished: &finished, ExitCode: new(int),
+			},
+			want: &natspb.Event{
+				Version: "v1", Id: "e2", AgentId: "agent1", Type: "action", WorkflowId: "wf1", ActionId: "a1", ActionName: "first",
+				State: "success", Message: "action completed", Time: timestamppb.New(now), Started: timestamppb.New(started),
+				Finished: timestamppb.New(finished), ExitCode: proto.Int32(0),
+			},
+		},
+		"negative exit code": {
+			event: nats.Event{
+				Version: "v1", ID: "e3", AgentID: "agent1", Type: "action", WorkflowID: "wf1", ActionID: "a1", ActionName: "first",
+				State: "failure", Time: now, Started: &started, Finished: &finished, ExitCode: func() *int { c := -1; return &c }(), Reason: "ImagePull",
+			},
+			want: &natspb.Event{
+				Version: "v1", Id: "e3", AgentId: "agent1", Type: "action", WorkflowId: "wf1", ActionId: "a1", ActionName: "first",
+				State: "failure", Time: timestamppb.New(now), Started: timestamppb.New(started), Finished: timestamppb.New(finished),
+				ExitCode: proto.Int32(-1), Reason: "ImagePull",
+			},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			b, err := tt.event.MarshalProto()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := &natspb.Event{}
+			if err := proto.Unmarshal(b, got); err != nil {
+				t.Fatalf("decoding as the Event message: %v", err)
+			}
+			if diff := cmp.Diff(tt.want, got, protocmp.Transform()); diff != "" {
+				t.Errorf("unexpected message (-want +got):\n%s", diff)
+			}
+
+			var e nats.Event
+			if err := e.UnmarshalProto(b); err != nil {
+				t.Fatalf("decoding event: %v", err)
+			}
+			if diff := cmp.Diff(tt.event, e); diff != "" {
+				t.Errorf("unexpected event (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
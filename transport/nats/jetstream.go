@@ -0,0 +1,247 @@
+package nats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jacobweinstock/tink-agent/pkg/backoff"
+	"github.com/jacobweinstock/tink-agent/pkg/conv"
+	"github.com/jacobweinstock/tink-agent/spec"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// DefaultAckWait is the AckWait used when none is set.
+const DefaultAckWait = time.Minute
+
+// inflight is a workflow read from the consumer that has not been acknowledged.
+type inflight struct {
+	msg jetstream.Msg
+	// stop stops the progress heartbeat of msg.
+	stop context.CancelFunc
+}
+
+// consume hands workflows from a durable consumer of subj to Read until ctx is done.
+// A workflow is only acknowledged once its final event is published, so the server redelivers it
+// if the agent stops before then.
+func (c *Config) consume(ctx context.Context, nc *nats.Conn, subj string) error {
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return fmt.Errorf("error creating jetstream context: %w", err)
+	}
+	c.mu.Lock()
+	c.js = js
+	c.pending = map[string]*inflight{}
+	c.mu.Unlock()
+
+	var cons jetstream.Consumer
+	for {
+		if cons, err = c.consumer(ctx, js, subj); err == nil {
+			break
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		// The server may not be reachable yet, the same as with core NATS keep trying until it is.
+		c.Log.Info("unable to create jetstream consumer, retrying", "error", err)
+		if !backoff.Wait(ctx, 5*time.Second) {
+			return nil
+		}
+	}
+
+	it, err := cons.Messages(jetstream.PullMaxMessages(1))
+	if err != nil {
+		return fmt.Errorf("error consuming from stream %v: %w", c.StreamName, err)
+	}
+	defer it.Stop()
+	stop := context.AfterFunc(ctx, it.Stop)
+	defer stop()
+
+	var heartbeats sync.WaitGroup
+	defer heartbeats.Wait()
+	defer c.release()
+	c.Log.Info("nats transport starting", "stream", c.StreamName, "consumer", cons.CachedInfo().Name)
+	for {
+		msg, err := it.Next()
+		if errors.Is(err, jetstream.ErrMsgIteratorClosed) {
+			return nil
+		}
+		if err != nil {
+			c.Log.Debug("error reading from consumer", "error", err)
+			continue
+		}
+		c.handle(ctx, msg, &heartbeats)
+	}
+}
+
+// consumer binds to the durable consumer of this agent, creating it and the stream if they do not exist.
+func (c *Config) consumer(ctx context.Context, js jetstream.JetStream, subj string) (jetstream.Consumer, error) {
+	stream, err := js.Stream(ctx, c.StreamName)
+	if errors.Is(err, jetstream.ErrStreamNotFound) {
+		stream, err = js.CreateStream(ctx, jetstream.StreamConfig{
+			Name:     c.StreamName,
+			Subjects: []string{fmt.Sprintf("%v.*.%v", c.StreamName, c.ActionsSubject), fmt.Sprintf("%v.*.%v", c.StreamName, c.EventsSubject)},
+		})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting stream %v: %w", c.StreamName, err)
+	}
+
+	cons, err := stream.CreateOrUpdateConsumer(ctx, jetstream.ConsumerConfig{
+		Durable:       durable(c.AgentID),
+		FilterSubject: subj,
+		DeliverPolicy: jetstream.DeliverAllPolicy,
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		AckWait:       c.ackWait(),
+		// Workflows are run one at a time, the next is only delivered once the last is acknowledged.
+		MaxAckPending: 1,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating consumer: %w", err)
+	}
+
+	return cons, nil
+}
+
+// handle hands the workflow in msg to Read, reporting progress on it to the server until it is acknowledged.
+func (c *Config) handle(ctx context.Context, msg jetstream.Msg, heartbeats *sync.WaitGroup) {
+	meta, err := msg.Metadata()
+	if err != nil {
+		c.Log.Info("unable to read message metadata", "error", err)
+		_ = msg.Term()
+		return
+	}
+	// Messages that are only a list of actions have no workflow ID. The stream sequence is used so
+	// that a redelivered message gets the same ID and any saved progress is picked up.
+	wf, err := conv.ParseWorkflow(msg.Data(), fmt.Sprintf("%v-%d", c.StreamName, meta.Sequence.Stream))
+	if err != nil {
+		c.Log.Info("unable to parse workflow", "error", err)
+		_ = msg.Term()
+		return
+	}
+
+	c.mu.Lock()
+	if _, ok := c.pending[wf.ID]; ok {
+		c.mu.Unlock()
+		c.Log.Debug("workflow redelivered while running", "workflowID", wf.ID)
+		return
+	}
+	hctx, cancel := context.WithCancel(ctx)
+	c.pending[wf.ID] = &inflight{msg: msg, stop: cancel}
+	c.mu.Unlock()
+
+	heartbeats.Add(1)
+	go func() {
+		defer heartbeats.Done()
+		c.heartbeat(hctx, msg)
+	}()
+
+	select {
+	case <-ctx.Done():
+	case c.Workflows <- wf:
+	}
+}
+
+// heartbeat tells the server the workflow in msg is still being run until ctx is done.
+func (c *Config) heartbeat(ctx context.Context, msg jetstream.Msg) {
+	t := time.NewTicker(c.ackWait() / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := msg.InProgress(); err != nil {
+				c.Log.Debug("error reporting workflow progress", "error", err)
+			}
+		}
+	}
+}
+
+// release stops the heartbeat of every workflow that was not acknowledged and asks the server to redeliver it.
+func (c *Config) release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, f := range c.pending {
+		c.nak(id, f)
+	}
+}
+
+// releaseWorkflow stops the heartbeat of the workflow with id and asks the server to redeliver it,
+// so that a workflow whose final event could not be published does not hold up the consumer.
+func (c *Config) releaseWorkflow(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if f, ok := c.pending[id]; ok {
+		c.nak(id, f)
+	}
+}
+
+// nak stops the heartbeat of f and asks the server to redeliver it. c.mu must be held.
+func (c *Config) nak(id string, f *inflight) {
+	f.stop()
+	if err := f.msg.Nak(); err != nil {
+		c.Log.Debug("error releasing workflow", "workflowID", id, "error", err)
+	}
+	delete(c.pending, id)
+}
+
+// publish publishes the event in msg to the stream. Once the final event of a workflow is
+// published the workflow is acknowledged so that it is not redelivered.
+func (c *Config) publish(ctx context.Context, msg *nats.Msg, event spec.Event) error {
+	c.mu.Lock()
+	js := c.js
+	c.mu.Unlock()
+	if js == nil {
+		return errors.New("not connected to the nats jetstream")
+	}
+	ack, err := js.PublishMsg(ctx, msg, jetstream.WithMsgID(event.Key()), jetstream.WithExpectStream(c.StreamName))
+	if err != nil {
+		if event.Type == spec.EventTypeWorkflow && event.State.IsFinal() {
+			c.releaseWorkflow(event.WorkflowID)
+		}
+		return fmt.Errorf("error publishing event: %w", err)
+	}
+	if ack.Duplicate {
+		c.Log.Debug("event already published", "workflowID", event.WorkflowID, "state", event.State)
+	}
+	if event.Type != spec.EventTypeWorkflow || !event.State.IsFinal() {
+		return nil
+	}
+
+	c.mu.Lock()
+	f, ok := c.pending[event.WorkflowID]
+	delete(c.pending, event.WorkflowID)
+	c.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	f.stop()
+	if err := f.msg.DoubleAck(ctx); err != nil {
+		return fmt.Errorf("error acknowledging workflow %v: %w", event.WorkflowID, err)
+	}
+
+	return nil
+}
+
+// durable returns the durable consumer name of agentID, which cannot contain some of the characters an ID can.
+func durable(agentID string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', '*', '>', '/', '\\', ' ', '\t', '\n', '\r':
+			return '_'
+		}
+		return r
+	}, agentID)
+}
+
+func (c *Config) ackWait() time.Duration {
+	if c.AckWait > 0 {
+		return c.AckWait
+	}
+	return DefaultAckWait
+}
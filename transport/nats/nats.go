@@ -2,43 +2,98 @@ package nats
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/netip"
+	"os"
+	"sync"
+	"time"
 
+	"github.com/jacobweinstock/tink-agent/pkg/conv"
+	"github.com/jacobweinstock/tink-agent/pkg/rand"
 	"github.com/jacobweinstock/tink-agent/spec"
 	"github.com/nats-io/nats.go"
-	"gopkg.in/yaml.v3"
+	"github.com/nats-io/nats.go/jetstream"
 )
 
 type Config struct {
 	StreamName     string
 	EventsSubject  string
 	ActionsSubject string
-	IPPort         netip.AddrPort
-	Log            *slog.Logger
-	AgentID        string
-	Actions        chan spec.Action
-	conn           *nats.Conn
-	cancel         chan bool
+	// LogsSubject is the subject action output is published to. Action output is not published when empty.
+	LogsSubject string
+	IPPort      netip.AddrPort
+	Log         *slog.Logger
+	AgentID     string
+	Workflows   chan spec.Workflow
+	// JetStream reads actions from a durable consumer on the StreamName stream instead of a core NATS subscription,
+	// so actions published while the agent is down are not lost. Events are published to the stream with IDs the
+	// server uses to drop duplicates. The stream is created, capturing the actions and events subjects of every agent,
+	// if it does not exist.
+	JetStream bool
+	// AckWait is how long the server waits before redelivering a workflow the agent has stopped reporting progress on.
+	// Only used in JetStream mode. Defaults to DefaultAckWait.
+	AckWait time.Duration
+	// Encoding is how events are encoded. Defaults to EncodingJSON.
+	Encoding Encoding
+	// User and Password, Token, NKeySeedFile and CredentialsFile are the ways the agent can authenticate
+	// with the server. At most one of them can be used. The agent connects without credentials when none are set.
+	User     string
+	Password string
+	Token    string
+	// NKeySeedFile is a file with the NKey seed of the agent.
+	NKeySeedFile string
+	// CredentialsFile is a .creds file with the user JWT and NKey seed of the agent.
+	CredentialsFile string
+	// TLS is the TLS configuration the server is connected with. The connection is not encrypted when nil.
+	TLS *tls.Config
+
+	mu sync.Mutex
+	// conn is nil until Start has connected.
+	conn *nats.Conn
+	// js is nil until Start has connected in JetStream mode.
+	js jetstream.JetStream
+	// pending are the workflows read from the consumer that have not been acknowledged, by workflow ID.
+	pending map[string]*inflight
 }
 
 func (c *Config) Start(ctx context.Context) error {
-	c.cancel = make(chan bool)
+	switch c.Encoding {
+	case "", EncodingJSON, EncodingProtobuf:
+	default:
+		return fmt.Errorf("unknown event encoding %q", c.Encoding)
+	}
 	opts := []nats.Option{
 		nats.Name(c.AgentID),
 		nats.RetryOnFailedConnect(true),
 		nats.MaxReconnects(-1),
 	}
-	nc, err := nats.Connect(fmt.Sprintf("nats://%v", c.IPPort.String()), opts...)
+	auth, err := c.auth()
+	if err != nil {
+		return err
+	}
+	opts = append(opts, auth...)
+	scheme := "nats"
+	if c.TLS != nil {
+		scheme = "tls"
+		opts = append(opts, nats.Secure(c.TLS))
+	}
+	nc, err := nats.Connect(fmt.Sprintf("%v://%v", scheme, c.IPPort.String()), opts...)
 	if err != nil {
 		return err
 	}
 	defer nc.Close()
+	c.mu.Lock()
 	c.conn = nc
+	c.mu.Unlock()
 
-	base := fmt.Sprintf("%v.%v", c.StreamName, c.AgentID)
-	subj := fmt.Sprintf("%v.%v", base, c.ActionsSubject)
+	subj := c.subject(c.ActionsSubject)
+	if c.JetStream {
+		return c.consume(ctx, nc, subj)
+	}
 	sub, err := nc.SubscribeSync(subj)
 	if err != nil {
 		return err
@@ -59,38 +114,102 @@ func (c *Config) Start(ctx context.Context) error {
 			continue
 		}
 
-		actions := []spec.Action{}
-		if err := yaml.Unmarshal(msg.Data, &actions); err != nil {
+		// Messages that are only a list of actions have no workflow ID, so one is generated.
+		wf, err := conv.ParseWorkflow(msg.Data, rand.String(10))
+		if err != nil {
+			c.Log.Info("unable to parse workflow", "error", err)
 			continue
 		}
-		for _, action := range actions {
-			select {
-			case <-ctx.Done():
-			case <-c.cancel:
-			case c.Actions <- action:
-				continue
-			}
-			break
+		select {
+		case <-ctx.Done():
+		case c.Workflows <- wf:
 		}
 	}
 }
 
-func (c *Config) Read(ctx context.Context) (spec.Action, error) {
+func (c *Config) Read(ctx context.Context) (spec.Workflow, error) {
 	select {
 	case <-ctx.Done():
-		return spec.Action{}, context.Canceled
-	case v := <-c.Actions:
+		return spec.Workflow{}, context.Canceled
+	case v := <-c.Workflows:
 		return v, nil
 	}
 }
 
 func (c *Config) Write(ctx context.Context, event spec.Event) error {
-	if event.State == spec.StateFailure || event.State == spec.StateTimeout {
-		c.Actions = make(chan spec.Action)
-		c.cancel <- true
+	nc, err := c.connection()
+	if err != nil {
+		return err
+	}
+	msg, err := newEvent(c.AgentID, event).message(c.subject(c.EventsSubject), c.Encoding)
+	if err != nil {
+		return err
+	}
+	if c.JetStream {
+		return c.publish(ctx, msg, event)
+	}
+	return nc.PublishMsg(msg)
+}
+
+func (c *Config) WriteLog(_ context.Context, line spec.LogLine) error {
+	if c.LogsSubject == "" {
+		return nil
+	}
+	nc, err := c.connection()
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(line)
+	if err != nil {
+		return err
 	}
-	return c.conn.PublishMsg(&nats.Msg{
-		Subject: fmt.Sprintf("%v.%v.%v", c.StreamName, c.AgentID, c.EventsSubject),
-		Data:    []byte(event.String()),
+	return nc.PublishMsg(&nats.Msg{
+		Subject: c.subject(c.LogsSubject),
+		Data:    b,
 	})
 }
+
+// connection returns the connection to the server, or an error if Start has not connected yet.
+func (c *Config) connection() (*nats.Conn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return nil, errors.New("not connected to the nats server")
+	}
+
+	return c.conn, nil
+}
+
+// auth returns the options that authenticate the agent with the server.
+func (c *Config) auth() ([]nats.Option, error) {
+	var opts []nats.Option
+	if c.User != "" || c.Password != "" {
+		opts = append(opts, nats.UserInfo(c.User, c.Password))
+	}
+	if c.Token != "" {
+		opts = append(opts, nats.Token(c.Token))
+	}
+	if c.NKeySeedFile != "" {
+		opt, err := nats.NkeyOptionFromSeed(c.NKeySeedFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading nkey seed: %w", err)
+		}
+		opts = append(opts, opt)
+	}
+	if c.CredentialsFile != "" {
+		if _, err := os.Stat(c.CredentialsFile); err != nil {
+			return nil, fmt.Errorf("error reading credentials: %w", err)
+		}
+		opts = append(opts, nats.UserCredentials(c.CredentialsFile))
+	}
+	if len(opts) > 1 {
+		return nil, errors.New("only one of user and password, token, nkey seed or credentials can be used")
+	}
+
+	return opts, nil
+}
+
+// subject returns the subject of this agent named name.
+func (c *Config) subject(name string) string {
+	return fmt.Sprintf("%v.%v.%v", c.StreamName, c.AgentID, name)
+}
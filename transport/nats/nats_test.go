@@ -0,0 +1,523 @@
+package nats_test
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/jacobweinstock/tink-agent/agent/agenttest"
+	"github.com/jacobweinstock/tink-agent/pkg/tlsconfig"
+	"github.com/jacobweinstock/tink-agent/pkg/tlsconfig/tlsconfigtest"
+	"github.com/jacobweinstock/tink-agent/spec"
+	"github.com/jacobweinstock/tink-agent/transport/nats"
+	"github.com/nats-io/nats-server/v2/server"
+	natsgo "github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/nats-io/nkeys"
+)
+
+func TestTransport(t *testing.T) {
+	for _, js := range []bool{false, true} {
+		t.Run(fmt.Sprintf("JetStream=%v", js), func(t *testing.T) {
+			agenttest.TestTransport(t, func(t *testing.T) agenttest.Transport {
+				ns := runServer(t, js)
+				tr := newTransport(ns, agenttest.Logger(t))
+				tr.JetStream = js
+				start(t, tr)
+
+				nc, err := natsgo.Connect(ns.ClientURL())
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(nc.Close)
+				var mu sync.Mutex
+				var events []spec.Event
+				sub, err := nc.Subscribe("tinkerbell.agent1.events", func(m *natsgo.Msg) {
+					var e nats.Event
+					if err := json.Unmarshal(m.Data, &e); err != nil {
+						t.Errorf("decoding event: %v", err)
+						return
+					}
+					mu.Lock()
+					defer mu.Unlock()
+					events = append(events, spec.Event{
+						Type:       spec.EventType(e.Type),
+						WorkflowID: e.WorkflowID,
+						Action:     spec.Action{ID: e.ActionID, Name: e.ActionName},
+						State:      spec.State(e.State),
+					})
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := nc.Flush(); err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { _ = sub.Unsubscribe() })
+
+				// Core NATS drops messages without a subscriber, so wait for the transport to subscribe.
+				// In JetStream mode the stream is the subscriber.
+				deadline := time.Now().Add(10 * time.Second)
+				for !ns.GlobalAccount().SubscriptionInterest(actions) {
+					if time.Now().After(deadline) {
+						t.Fatal("transport did not subscribe")
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+
+				submit := func(_ context.Context, wf spec.Workflow) error {
+					b, err := json.Marshal(wf)
+					if err != nil {
+						return err
+					}
+					if err := nc.Publish(actions, b); err != nil {
+						return fmt.Errorf("publishing workflow: %w", err)
+					}
+					return nc.Flush()
+				}
+				list := func() []spec.Event {
+					mu.Lock()
+					defer mu.Unlock()
+					return append([]spec.Event(nil), events...)
+				}
+
+				return agenttest.Transport{Reader: tr, Writer: tr, Submit: submit, Events: list}
+			})
+		})
+	}
+}
+
+// TestJetStreamRedelivery tests that a workflow without a final event is read again after a restart,
+// and that it is not once its final event is written.
+func TestJetStreamRedelivery(t *testing.T) {
+	ns := runServer(t, true)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	first := newTransport(ns, agenttest.Logger(t))
+	first.JetStream = true
+	stop := start(t, first)
+	js, stream := waitForStream(ctx, t, ns)
+	// A list of actions, which gets the same generated workflow ID when it is redelivered.
+	if _, err := js.Publish(ctx, actions, []byte(`[{"id": "a1", "name": "first", "image": "registry.example.com/first:v1"}]`)); err != nil {
+		t.Fatal(err)
+	}
+	wf, err := first.Read(ctx)
+	if err != nil {
+		t.Fatalf("reading workflow: %v", err)
+	}
+	if err := first.Write(ctx, spec.Event{Type: spec.EventTypeWorkflow, WorkflowID: wf.ID, State: spec.StateRunning}); err != nil {
+		t.Fatalf("writing event: %v", err)
+	}
+	stop()
+
+	second := newTransport(ns, agenttest.Logger(t))
+	second.JetStream = true
+	stop = start(t, second)
+	again, err := second.Read(ctx)
+	if err != nil {
+		t.Fatalf("reading redelivered workflow: %v", err)
+	}
+	if again.ID != wf.ID {
+		t.Fatalf("redelivered workflow has ID %q, want %q", again.ID, wf.ID)
+	}
+	if err := second.Write(ctx, spec.Event{Type: spec.EventTypeWorkflow, WorkflowID: wf.ID, State: spec.StateSuccess}); err != nil {
+		t.Fatalf("writing final event: %v", err)
+	}
+	stop()
+
+	cons, err := stream.Consumer(ctx, "agent1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := cons.Info(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.NumAckPending != 0 || info.NumPending != 0 {
+		t.Errorf("consumer has %d workflows waiting for an ack and %d pending, want none", info.NumAckPending, info.NumPending)
+	}
+}
+
+// TestJetStreamFinalEventFails tests that a workflow whose final event cannot be published is
+// released for redelivery instead of holding up the consumer.
+func TestJetStreamFinalEventFails(t *testing.T) {
+	ns := runServer(t, true)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	nc, err := natsgo.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	js, err := jetstream.New(nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A stream without the events subject, so publishing any event fails.
+	if _, err := js.CreateStream(ctx, jetstream.StreamConfig{Name: "tinkerbell", Subjects: []string{"tinkerbell.*.actions"}}); err != nil {
+		t.Fatal(err)
+	}
+	tr := newTransport(ns, agenttest.Logger(t))
+	tr.JetStream = true
+	start(t, tr)
+	if _, err := js.Publish(ctx, actions, []byte(`[{"id": "a1", "name": "first", "image": "registry.example.com/first:v1"}]`)); err != nil {
+		t.Fatal(err)
+	}
+	wf, err := tr.Read(ctx)
+	if err != nil {
+		t.Fatalf("reading workflow: %v", err)
+	}
+	if err := tr.Write(ctx, spec.Event{Type: spec.EventTypeWorkflow, WorkflowID: wf.ID, State: spec.StateFailure}); err == nil {
+		t.Fatal("writing final event to a stream without the events subject succeeded")
+	}
+
+	again, err := tr.Read(ctx)
+	if err != nil {
+		t.Fatalf("reading redelivered workflow: %v", err)
+	}
+	if again.ID != wf.ID {
+		t.Fatalf("redelivered workflow has ID %q, want %q", again.ID, wf.ID)
+	}
+}
+
+// TestJetStreamDuplicateEvents tests that an event written twice is only stored in the stream once.
+func TestJetStreamDuplicateEvents(t *testing.T) {
+	ns := runServer(t, true)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	tr := newTransport(ns, agenttest.Logger(t))
+	tr.JetStream = true
+	start(t, tr)
+	_, stream := waitForStream(ctx, t, ns)
+
+	started := time.Now()
+	events := []spec.Event{
+		{Type: spec.EventTypeAction, WorkflowID: "wf1", Action: spec.Action{ID: "a1"}, State: spec.StateRetrying, Result: spec.Result{Started: started}},
+		{Type: spec.EventTypeAction, WorkflowID: "wf1", Action: spec.Action{ID: "a1"}, State: spec.StateRetrying, Result: spec.Result{Started: started}},
+		{Type: spec.EventTypeAction, WorkflowID: "wf1", Action: spec.Action{ID: "a1"}, State: spec.StateRetrying, Result: spec.Result{Started: started.Add(time.Second)}},
+		// Events of actions without an ID are told apart by the ID of the event.
+		{ID: "e1", Type: spec.EventTypeAction, WorkflowID: "wf1", State: spec.StateRunning},
+		{ID: "e2", Type: spec.EventTypeAction, WorkflowID: "wf1", State: spec.StateRunning},
+		{ID: "e2", Type: spec.EventTypeAction, WorkflowID: "wf1", State: spec.StateRunning},
+	}
+	for _, e := range events {
+		for {
+			err := tr.Write(ctx, e)
+			if err == nil {
+				break
+			}
+			// Write fails until the transport has connected.
+			if ctx.Err() != nil {
+				t.Fatalf("writing event: %v", err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	info, err := stream.Info(ctx, jetstream.WithSubjectFilter("tinkerbell.agent1.events"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := info.State.Subjects["tinkerbell.agent1.events"]; got != 4 {
+		t.Errorf("stream has %d events, want 4", got)
+	}
+}
+
+// TestEventEncoding tests that events are published with headers and in a form that decodes to the event written.
+func TestEventEncoding(t *testing.T) {
+	started := time.Date(2024, 10, 1, 12, 0, 0, 500, time.UTC)
+	e := spec.Event{
+		Type:       spec.EventTypeAction,
+		WorkflowID: "wf1",
+		Action:     spec.Action{ID: "a1", Name: "first"},
+		Message:    "action failed",
+		State:      spec.StateFailure,
+		Result:     spec.Result{ExitCode: 2, Started: started, Finished: started.Add(time.Second), Reason: "NonZeroExit"},
+	}
+	tests := map[nats.Encoding]struct {
+		contentType string
+		decode      func([]byte, *nats.Event) error
+	}{
+		nats.EncodingJSON:     {"application/json", func(b []byte, e *nats.Event) error { return json.Unmarshal(b, e) }},
+		nats.EncodingProtobuf: {"application/protobuf", func(b []byte, e *nats.Event) error { return e.UnmarshalProto(b) }},
+	}
+	for enc, tt := range tests {
+		t.Run(string(enc), func(t *testing.T) {
+			ns := runServer(t, false)
+			nc, err := natsgo.Connect(ns.ClientURL())
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(nc.Close)
+			sub, err := nc.SubscribeSync("tinkerbell.agent1.events")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := nc.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			tr := newTransport(ns, agenttest.Logger(t))
+			tr.Encoding = enc
+			start(t, tr)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			for {
+				err := tr.Write(ctx, e)
+				if err == nil {
+					break
+				}
+				// Write fails until the transport has connected.
+				if ctx.Err() != nil {
+					t.Fatalf("writing event: %v", err)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			m, err := sub.NextMsgWithContext(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for k, want := range map[string]string{
+				nats.HeaderContentType:  tt.contentType,
+				nats.HeaderEventVersion: nats.EventVersion,
+				nats.HeaderAgentID:      "agent1",
+				nats.HeaderWorkflowID:   "wf1",
+				nats.HeaderActionID:     "a1",
+			} {
+				if got := m.Header.Get(k); got != want {
+					t.Errorf("header %v is %q, want %q", k, got, want)
+				}
+			}
+			var got nats.Event
+			if err := tt.decode(m.Data, &got); err != nil {
+				t.Fatalf("decoding event: %v", err)
+			}
+			if got.Time.IsZero() {
+				t.Error("event has no time")
+			}
+			got.Time = time.Time{}
+			finished, code := started.Add(time.Second), 2
+			want := nats.Event{
+				Version:    nats.EventVersion,
+				ID:         got.ID,
+				AgentID:    "agent1",
+				Type:       "action",
+				WorkflowID: "wf1",
+				ActionID:   "a1",
+				ActionName: "first",
+				State:      "failure",
+				Message:    "action failed",
+				Started:    &started,
+				Finished:   &finished,
+				ExitCode:   &code,
+				Reason:     "NonZeroExit",
+			}
+			if got.ID == "" {
+				t.Error("event has no ID")
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("unexpected event (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// TestAuth tests that the transport authenticates with the server and connects with TLS.
+func TestAuth(t *testing.T) {
+	certs := tlsconfigtest.Generate(t)
+	user, err := nkeys.CreateUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seed, err := user.Seed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seedFile := filepath.Join(t.TempDir(), "agent.nk")
+	if err := os.WriteFile(seedFile, seed, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	pub, err := user.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := func(t *testing.T, f tlsconfig.Files) *tls.Config {
+		cfg, err := f.Client()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cfg
+	}
+
+	tests := map[string]struct {
+		server    func(t *testing.T) *server.Options
+		transport func(t *testing.T, tr *nats.Config)
+	}{
+		"user and password": {
+			server:    func(*testing.T) *server.Options { return &server.Options{Username: "agent", Password: "secret"} },
+			transport: func(_ *testing.T, tr *nats.Config) { tr.User, tr.Password = "agent", "secret" },
+		},
+		"token": {
+			server:    func(*testing.T) *server.Options { return &server.Options{Authorization: "secret"} },
+			transport: func(_ *testing.T, tr *nats.Config) { tr.Token = "secret" },
+		},
+		"nkey": {
+			server:    func(*testing.T) *server.Options { return &server.Options{Nkeys: []*server.NkeyUser{{Nkey: pub}}} },
+			transport: func(_ *testing.T, tr *nats.Config) { tr.NKeySeedFile = seedFile },
+		},
+		"tls": {
+			server: func(t *testing.T) *server.Options {
+				return &server.Options{TLS: true, TLSConfig: certs.Server(t, false)}
+			},
+			transport: func(t *testing.T, tr *nats.Config) {
+				tr.TLS = client(t, tlsconfig.Files{CA: certs.CA, ServerName: certs.ServerName})
+			},
+		},
+		"mutual tls": {
+			server: func(t *testing.T) *server.Options {
+				return &server.Options{TLS: true, TLSVerify: true, TLSConfig: certs.Server(t, true)}
+			},
+			transport: func(t *testing.T, tr *nats.Config) {
+				tr.TLS = client(t, tlsconfig.Files{CA: certs.CA, Cert: certs.ClientCert, Key: certs.ClientKey})
+			},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			ns := runServerWith(t, tt.server(t))
+			tr := newTransport(ns, agenttest.Logger(t))
+			tt.transport(t, tr)
+			start(t, tr)
+
+			// The transport only subscribes once it is connected.
+			deadline := time.Now().Add(10 * time.Second)
+			for !ns.GlobalAccount().SubscriptionInterest(actions) {
+				if time.Now().After(deadline) {
+					t.Fatal("transport did not connect")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
+
+// TestAuthInvalid tests that Start fails when the agent cannot authenticate the way it is asked to.
+func TestAuthInvalid(t *testing.T) {
+	tests := map[string]func(tr *nats.Config){
+		"more than one method": func(tr *nats.Config) { tr.User, tr.Password, tr.Token = "agent", "secret", "secret" },
+		"missing nkey seed":    func(tr *nats.Config) { tr.NKeySeedFile = filepath.Join(t.TempDir(), "missing.nk") },
+		"missing credentials":  func(tr *nats.Config) { tr.CredentialsFile = filepath.Join(t.TempDir(), "missing.creds") },
+	}
+	for name, set := range tests {
+		t.Run(name, func(t *testing.T) {
+			ns := runServer(t, false)
+			tr := newTransport(ns, agenttest.Logger(t))
+			set(tr)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if err := tr.Start(ctx); err == nil {
+				t.Error("got no error starting the transport")
+			}
+		})
+	}
+}
+
+// actions is the subject the test transports read actions from.
+const actions = "tinkerbell.agent1.actions"
+
+func newTransport(ns *server.Server, log *slog.Logger) *nats.Config {
+	return &nats.Config{
+		StreamName:     "tinkerbell",
+		EventsSubject:  "events",
+		ActionsSubject: "actions",
+		IPPort:         netip.MustParseAddrPort(ns.Addr().String()),
+		Log:            log,
+		AgentID:        "agent1",
+		Workflows:      make(chan spec.Workflow),
+	}
+}
+
+// start runs tr until the returned function or the cleanup of t is called.
+func start(t *testing.T, tr *nats.Config) func() {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := tr.Start(ctx); err != nil {
+			t.Errorf("starting transport: %v", err)
+		}
+	}()
+	stop := func() {
+		cancel()
+		<-done
+	}
+	t.Cleanup(stop)
+
+	return stop
+}
+
+// waitForStream waits for a transport to create the tinkerbell stream.
+func waitForStream(ctx context.Context, t *testing.T, ns *server.Server) (jetstream.JetStream, jetstream.Stream) {
+	t.Helper()
+	nc, err := natsgo.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+	js, err := jetstream.New(nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		stream, err := js.Stream(ctx, "tinkerbell")
+		if err == nil {
+			return js, stream
+		}
+		if ctx.Err() != nil {
+			t.Fatalf("getting stream: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// runServer starts a NATS server on a random local port that is shut down when t completes.
+func runServer(t *testing.T, jetStream bool) *server.Server {
+	t.Helper()
+	opts := &server.Options{}
+	if jetStream {
+		opts.JetStream = true
+		opts.StoreDir = t.TempDir()
+	}
+
+	return runServerWith(t, opts)
+}
+
+// runServerWith is runServer with the server configured by opts.
+func runServerWith(t *testing.T, opts *server.Options) *server.Server {
+	t.Helper()
+	opts.Host, opts.Port, opts.NoLog, opts.NoSigs = "127.0.0.1", server.RANDOM_PORT, true, true
+	ns, err := server.NewServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ns.Start()
+	if !ns.ReadyForConnections(10 * time.Second) {
+		t.Fatal("nats server did not start")
+	}
+	t.Cleanup(func() {
+		ns.Shutdown()
+		ns.WaitForShutdown()
+	})
+
+	return ns
+}